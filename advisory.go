@@ -0,0 +1,229 @@
+package unpub
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Severities of an advisory, as used by GitHub security advisories.
+const (
+	SeverityLow      = "LOW"
+	SeverityModerate = "MODERATE"
+	SeverityHigh     = "HIGH"
+	SeverityCritical = "CRITICAL"
+)
+
+// advisoryIDPattern matches IDs such as UNPUB-2024-1 or GHSA-xxxx-xxxx-xxxx.
+var advisoryIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Advisory is a security advisory for versions of a package, which is served
+// to pub in the OSV format.
+type Advisory struct {
+	ID      string `json:"id"`
+	Package string `json:"package"`
+	Summary string `json:"summary"`
+	Details string `json:"details,omitempty"`
+	// Severity is one of the severities above.
+	Severity string `json:"severity"`
+	// CVSS is an optional CVSS v3 vector, such as
+	// CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H.
+	CVSS       string              `json:"cvss,omitempty"`
+	Aliases    []string            `json:"aliases,omitempty"`
+	Affected   []AdvisoryRange     `json:"affected"`
+	References []AdvisoryReference `json:"references,omitempty"`
+	Published  time.Time           `json:"published"`
+	Modified   time.Time           `json:"modified"`
+	// Withdrawn is set once the advisory no longer applies, after which pub
+	// ignores it.
+	Withdrawn *time.Time `json:"withdrawn,omitempty"`
+}
+
+// AdvisoryRange is a range of affected versions, from Introduced up to but
+// excluding Fixed. An empty Introduced starts at the first version, and an
+// empty Fixed affects every later version.
+type AdvisoryRange struct {
+	Introduced string `json:"introduced,omitempty"`
+	Fixed      string `json:"fixed,omitempty"`
+}
+
+// AdvisoryReference links to more information, with one of the OSV reference
+// types such as ADVISORY, FIX or WEB.
+type AdvisoryReference struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+var osvReferenceTypes = map[string]bool{
+	"ADVISORY":   true,
+	"ARTICLE":    true,
+	"DETECTION":  true,
+	"DISCUSSION": true,
+	"REPORT":     true,
+	"FIX":        true,
+	"INTRODUCED": true,
+	"PACKAGE":    true,
+	"EVIDENCE":   true,
+	"WEB":        true,
+}
+
+// Validate checks that an advisory is complete before it is saved.
+func (a Advisory) Validate() error {
+	if !advisoryIDPattern.MatchString(a.ID) {
+		return NewError(ErrInvalidInput, "invalid advisory id %q", a.ID)
+	}
+	if strings.TrimSpace(a.Summary) == "" {
+		return NewError(ErrInvalidInput, "advisory summary is required")
+	}
+	switch a.Severity {
+	case SeverityLow, SeverityModerate, SeverityHigh, SeverityCritical:
+	default:
+		return NewError(ErrInvalidInput, "severity must be LOW, MODERATE, HIGH or CRITICAL, got %q", a.Severity)
+	}
+	if a.CVSS != "" && !strings.HasPrefix(a.CVSS, "CVSS:3.") {
+		return NewError(ErrInvalidInput, "cvss must be a CVSS v3 vector")
+	}
+	if len(a.Affected) == 0 {
+		return NewError(ErrInvalidInput, "advisory must affect at least one range of versions")
+	}
+	for _, r := range a.Affected {
+		for _, v := range []string{r.Introduced, r.Fixed} {
+			if v != "" && !ValidVersion(v) {
+				return NewError(ErrInvalidInput, "invalid version %q in affected range", v)
+			}
+		}
+		if r.Introduced != "" && r.Fixed != "" && CompareVersions(r.Introduced, r.Fixed) >= 0 {
+			return NewError(ErrInvalidInput, "affected range must be introduced before %s is fixed", r.Fixed)
+		}
+	}
+	for _, ref := range a.References {
+		if !osvReferenceTypes[ref.Type] {
+			return NewError(ErrInvalidInput, "unknown reference type %q", ref.Type)
+		}
+		if u, err := url.Parse(ref.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return NewError(ErrInvalidInput, "invalid reference url %q", ref.URL)
+		}
+	}
+	return nil
+}
+
+// Affects reports whether version lies in one of the affected ranges of an
+// advisory which has not been withdrawn.
+func (a Advisory) Affects(version string) bool {
+	if a.Withdrawn != nil {
+		return false
+	}
+	for _, r := range a.Affected {
+		if r.Introduced != "" && CompareVersions(version, r.Introduced) < 0 {
+			continue
+		}
+		if r.Fixed != "" && CompareVersions(version, r.Fixed) >= 0 {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// OSVAdvisory is an advisory in the Open Source Vulnerability format, as
+// served by the advisories endpoint of the pub repository API.
+type OSVAdvisory struct {
+	SchemaVersion    string                 `json:"schema_version"`
+	ID               string                 `json:"id"`
+	Modified         time.Time              `json:"modified"`
+	Published        time.Time              `json:"published"`
+	Withdrawn        *time.Time             `json:"withdrawn,omitempty"`
+	Aliases          []string               `json:"aliases"`
+	Summary          string                 `json:"summary"`
+	Details          string                 `json:"details"`
+	Severity         []OSVSeverity          `json:"severity,omitempty"`
+	Affected         []OSVAffected          `json:"affected"`
+	References       []AdvisoryReference    `json:"references"`
+	DatabaseSpecific map[string]interface{} `json:"database_specific"`
+}
+
+type OSVSeverity struct {
+	Type  string `json:"type"`
+	Score string `json:"score"`
+}
+
+type OSVAffected struct {
+	Package OSVPackage `json:"package"`
+	Ranges  []OSVRange `json:"ranges"`
+}
+
+type OSVPackage struct {
+	Ecosystem string `json:"ecosystem"`
+	Name      string `json:"name"`
+}
+
+type OSVRange struct {
+	Type   string     `json:"type"`
+	Events []OSVEvent `json:"events"`
+}
+
+// OSVEvent sets exactly one of its fields.
+type OSVEvent struct {
+	Introduced string `json:"introduced,omitempty"`
+	Fixed      string `json:"fixed,omitempty"`
+}
+
+// OSV returns the advisory in the OSV format.
+func (a Advisory) OSV() OSVAdvisory {
+	osv := OSVAdvisory{
+		SchemaVersion: "1.4.0",
+		ID:            a.ID,
+		Modified:      a.Modified.UTC(),
+		Published:     a.Published.UTC(),
+		Aliases:       a.Aliases,
+		Summary:       a.Summary,
+		Details:       a.Details,
+		References:    a.References,
+		DatabaseSpecific: map[string]interface{}{
+			"severity": a.Severity,
+		},
+	}
+	if osv.Aliases == nil {
+		osv.Aliases = []string{}
+	}
+	if osv.References == nil {
+		osv.References = []AdvisoryReference{}
+	}
+	if a.Withdrawn != nil {
+		withdrawn := a.Withdrawn.UTC()
+		osv.Withdrawn = &withdrawn
+	}
+	if a.CVSS != "" {
+		osv.Severity = []OSVSeverity{{Type: "CVSS_V3", Score: a.CVSS}}
+	}
+	affected := OSVAffected{
+		Package: OSVPackage{Ecosystem: "Pub", Name: a.Package},
+	}
+	for _, r := range a.Affected {
+		introduced := r.Introduced
+		if introduced == "" {
+			introduced = "0"
+		}
+		events := []OSVEvent{{Introduced: introduced}}
+		if r.Fixed != "" {
+			events = append(events, OSVEvent{Fixed: r.Fixed})
+		}
+		affected.Ranges = append(affected.Ranges, OSVRange{Type: "SEMVER", Events: events})
+	}
+	osv.Affected = []OSVAffected{affected}
+	return osv
+}
+
+// AdvisoriesUpdated returns the time the newest of advisories was modified,
+// or nil if there are none.
+func AdvisoriesUpdated(advisories []Advisory) *time.Time {
+	var updated *time.Time
+	for i := range advisories {
+		if updated == nil || advisories[i].Modified.After(*updated) {
+			modified := advisories[i].Modified.UTC()
+			updated = &modified
+		}
+	}
+	return updated
+}
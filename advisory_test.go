@@ -0,0 +1,94 @@
+package unpub
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testAdvisory() Advisory {
+	published := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	return Advisory{
+		ID:       "UNPUB-2024-1",
+		Package:  packageName,
+		Summary:  "Path traversal in archive extraction",
+		Severity: SeverityHigh,
+		CVSS:     "CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:N/A:N",
+		Affected: []AdvisoryRange{
+			{Fixed: "1.0.2"},
+			{Introduced: "2.0.0-dev.1", Fixed: "2.0.1"},
+		},
+		Published: published,
+		Modified:  published,
+	}
+}
+
+func TestAdvisoryValidate(t *testing.T) {
+	require.NoError(t, testAdvisory().Validate())
+
+	tests := map[string]func(a *Advisory){
+		"id":         func(a *Advisory) { a.ID = "../etc" },
+		"summary":    func(a *Advisory) { a.Summary = " " },
+		"severity":   func(a *Advisory) { a.Severity = "high" },
+		"cvss":       func(a *Advisory) { a.CVSS = "AV:N/AC:L" },
+		"affected":   func(a *Advisory) { a.Affected = nil },
+		"version":    func(a *Advisory) { a.Affected[0].Fixed = "1.0" },
+		"range":      func(a *Advisory) { a.Affected[1].Fixed = "2.0.0-dev.1" },
+		"reference":  func(a *Advisory) { a.References = []AdvisoryReference{{Type: "LINK", URL: "https://example.com"}} },
+		"url scheme": func(a *Advisory) { a.References = []AdvisoryReference{{Type: "WEB", URL: "javascript:alert(1)"}} },
+	}
+	for name, modify := range tests {
+		t.Run(name, func(t *testing.T) {
+			a := testAdvisory()
+			modify(&a)
+			require.ErrorIs(t, a.Validate(), ErrInvalidInput)
+		})
+	}
+}
+
+func TestAdvisoryAffects(t *testing.T) {
+	require := require.New(t)
+	a := testAdvisory()
+	for version, affected := range map[string]bool{
+		"0.1.0":       true,
+		"1.0.1":       true,
+		"1.0.2":       false,
+		"1.5.0":       false,
+		"2.0.0-dev.1": true,
+		"2.0.0":       true,
+		"2.0.1":       false,
+	} {
+		require.Equal(affected, a.Affects(version), version)
+	}
+
+	withdrawn := a.Modified.Add(time.Hour)
+	a.Withdrawn = &withdrawn
+	require.False(a.Affects("1.0.1"))
+}
+
+func TestAdvisoryOSV(t *testing.T) {
+	require := require.New(t)
+	b, err := json.Marshal(testAdvisory().OSV())
+	require.NoError(err)
+	require.JSONEq(`{
+		"schema_version": "1.4.0",
+		"id": "UNPUB-2024-1",
+		"modified": "2024-03-01T12:00:00Z",
+		"published": "2024-03-01T12:00:00Z",
+		"aliases": [],
+		"summary": "Path traversal in archive extraction",
+		"details": "",
+		"severity": [{"type": "CVSS_V3", "score": "CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:N/A:N"}],
+		"affected": [{
+			"package": {"ecosystem": "Pub", "name": "my_pkg"},
+			"ranges": [
+				{"type": "SEMVER", "events": [{"introduced": "0"}, {"fixed": "1.0.2"}]},
+				{"type": "SEMVER", "events": [{"introduced": "2.0.0-dev.1"}, {"fixed": "2.0.1"}]}
+			]
+		}],
+		"references": [],
+		"database_specific": {"severity": "HIGH"}
+	}`, string(b))
+}
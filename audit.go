@@ -0,0 +1,111 @@
+package unpub
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Actions recorded in the audit log.
+const (
+	AuditPublish        = "publish"
+	AuditAddUploader    = "uploader.add"
+	AuditRemoveUploader = "uploader.remove"
+	AuditAddReader      = "reader.add"
+	AuditRemoveReader   = "reader.remove"
+	AuditRetract        = "retract"
+	AuditUnretract      = "unretract"
+	AuditOptions        = "options"
+	AuditTrust          = "trust"
+	AuditDelete         = "delete"
+	AuditExpire         = "expire"
+
+	AuditAdvisory         = "advisory.create"
+	AuditWithdrawAdvisory = "advisory.withdraw"
+
+	AuditCreateToken = "token.create"
+	AuditRevokeToken = "token.revoke"
+)
+
+// AuditEvent records a change to the registry. Before and After summarize the
+// affected state, e.g. the uploaders of a package before and after one was
+// added.
+type AuditEvent struct {
+	// ID orders events by the time they were recorded, and is assigned by
+	// UnpubDb.RecordAudit.
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Actor    string    `json:"actor"`
+	ClientIP string    `json:"clientIp"`
+	Package  string    `json:"package"`
+	Version  string    `json:"version,omitempty"`
+	Before   string    `json:"before,omitempty"`
+	After    string    `json:"after,omitempty"`
+}
+
+// Matches reports whether the event is selected by the filters of query.
+func (e AuditEvent) Matches(query AuditQuery) bool {
+	return (query.Package == "" || e.Package == query.Package) &&
+		(query.Version == "" || e.Version == query.Version) &&
+		(query.Action == "" || e.Action == query.Action) &&
+		(query.Actor == "" || e.Actor == query.Actor) &&
+		(query.Since.IsZero() || !e.Time.Before(query.Since)) &&
+		(query.Until.IsZero() || e.Time.Before(query.Until))
+}
+
+// Limits on AuditQuery.Limit.
+const (
+	DefaultAuditLimit = 50
+	MaxAuditLimit     = 1000
+)
+
+// AuditQuery selects a page of audit events, newest first. Empty filters match
+// every event, and Until is exclusive. Cursor continues from the NextCursor of
+// a previous page.
+type AuditQuery struct {
+	Package string
+	Version string
+	Action  string
+	Actor   string
+	Since   time.Time
+	Until   time.Time
+	Cursor  string
+	Limit   int
+}
+
+// limit returns the page size of the query.
+func (q AuditQuery) limit() int {
+	switch {
+	case q.Limit <= 0:
+		return DefaultAuditLimit
+	case q.Limit > MaxAuditLimit:
+		return MaxAuditLimit
+	default:
+		return q.Limit
+	}
+}
+
+// AuditResult is a page of audit events. NextCursor is empty on the last page.
+type AuditResult struct {
+	Events     []AuditEvent `json:"events"`
+	NextCursor string       `json:"nextCursor,omitempty"`
+}
+
+// prepareAuditEvent fills in the time and ID of an event about to be recorded.
+// IDs start with the time in nanoseconds, followed by random bits to keep
+// events recorded at the same time apart.
+func prepareAuditEvent(event AuditEvent) (AuditEvent, error) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.ID == "" {
+		b := make([]byte, 4)
+		if _, err := rand.Read(b); err != nil {
+			return event, err
+		}
+		event.ID = fmt.Sprintf("%016x%08x", event.Time.UnixNano(), binary.BigEndian.Uint32(b))
+	}
+	return event, nil
+}
@@ -0,0 +1,337 @@
+package unpub
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+// BackupVersion is the version of the archive format written by Backup.
+// Restore accepts archives of this version or older.
+//
+// Version 2 added advisories, tokens and the audit log.
+const BackupVersion = 2
+
+const (
+	backupFormat        = "unpub-backup"
+	backupManifestName  = "manifest.json"
+	backupTokensName    = "tokens.json"
+	backupPackagesDir   = "packages/"
+	backupBlobsDir      = "blobs/"
+	backupAdvisoriesDir = "advisories/"
+	backupAuditDir      = "audit/"
+)
+
+// backupManifest is the first entry of a backup archive.
+type backupManifest struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+var (
+	// ErrInvalidBackup is returned by Restore when the archive is malformed or
+	// of an unsupported version.
+	ErrInvalidBackup = &Error{Kind: ErrInvalidInput, Message: "invalid backup"}
+	// ErrRestoreNotEmpty is returned by Restore when the DB or blob store
+	// already holds data.
+	ErrRestoreNotEmpty = &Error{Kind: ErrConflict, Message: "restore requires an empty DB and blob store"}
+)
+
+// Backup writes every package, version and archive to w as a gzipped tar
+// archive. It starts with manifest.json, followed by each package as
+// packages/<name>.json, preceded by any of its archives not yet written as
+// blobs/<digest>.tar.gz and followed by its advisories as
+// advisories/<name>.json. Last come the API tokens as tokens.json, holding
+// their hashes rather than their secrets, and the audit log in pages of up to
+// MaxAuditLimit events as audit/<page>.json.
+//
+// Package metadata is read from a single snapshot of the DB, so the backup is
+// consistent while publishes continue. Advisories, tokens and the audit log
+// are read as they are when written. Since archives are stored before the
+// metadata referring to them is committed, every archive in the snapshot is
+// also in the blob store.
+//
+// A version which expires or is deleted while the backup is written may have
+// its archive removed before it is read. Such a version is left out, as is a
+// package left with none.
+//
+// Download statistics other than each package's total are not included.
+func Backup(w io.Writer, db UnpubDb, blobs BlobStore) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	now := time.Now()
+	err := writeBackupJSON(tw, backupManifestName, now, backupManifest{
+		Format:    backupFormat,
+		Version:   BackupVersion,
+		CreatedAt: now,
+	})
+	if err != nil {
+		return err
+	}
+
+	written := make(map[string]bool)
+	err = db.ExportPackages(func(pkg UnpubPackage) error {
+		removed := false
+		for _, v := range pkg.Versions {
+			digest := v.ArchiveSHA256
+			if digest == "" || written[digest] {
+				continue
+			}
+			err := writeBackupBlob(tw, blobs, digest, now)
+			if errors.Is(err, ErrNotFound) && !isLiveVersion(db, pkg.Name, v) {
+				log.Printf("Skipping %s %s, removed during backup\n", pkg.Name, v.Version)
+				delete(pkg.Versions, v.Version)
+				removed = true
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("archive of %s %s: %w", pkg.Name, v.Version, err)
+			}
+			written[digest] = true
+		}
+		if removed {
+			if len(pkg.Versions) == 0 {
+				return nil
+			}
+			pkg.updateLatest()
+		}
+		if err := writeBackupJSON(tw, backupPackagesDir+pkg.Name+".json", pkg.UpdatedAt, pkg); err != nil {
+			return err
+		}
+		advisories, err := db.QueryAdvisories(pkg.Name)
+		if err != nil || len(advisories) == 0 {
+			return err
+		}
+		return writeBackupJSON(tw, backupAdvisoriesDir+pkg.Name+".json", now, advisories)
+	})
+	if err != nil {
+		return err
+	}
+	tokens, err := db.QueryTokens()
+	if err != nil {
+		return err
+	}
+	if err := writeBackupJSON(tw, backupTokensName, now, tokens); err != nil {
+		return err
+	}
+	query := AuditQuery{Limit: MaxAuditLimit}
+	for page := 0; ; page++ {
+		result, err := db.QueryAudit(query)
+		if err != nil {
+			return err
+		}
+		if len(result.Events) > 0 {
+			if err := writeBackupJSON(tw, fmt.Sprintf("%s%d.json", backupAuditDir, page), now, result.Events); err != nil {
+				return err
+			}
+		}
+		if result.NextCursor == "" {
+			break
+		}
+		query.Cursor = result.NextCursor
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// isLiveVersion reports whether v is still stored with the same archive,
+// outside of the snapshot being backed up. Errors are taken to mean it is.
+func isLiveVersion(db UnpubDb, name string, v UnpubVersion) bool {
+	current, err := db.QueryVersion(name, v.Version)
+	if errors.Is(err, ErrNotFound) {
+		return false
+	}
+	return err != nil || current.ArchiveSHA256 == v.ArchiveSHA256
+}
+
+func writeBackupJSON(tw *tar.Writer, name string, modTime time.Time, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0o644,
+		Size:     int64(len(b)),
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(b)
+	return err
+}
+
+func writeBackupBlob(tw *tar.Writer, blobs BlobStore, digest string, modTime time.Time) error {
+	blob, err := blobs.Get(digest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     backupBlobsDir + digest + ".tar.gz",
+		Mode:     0o644,
+		Size:     blob.Size(),
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, blob)
+	return err
+}
+
+// Restore loads an archive written by Backup into an empty DB and blob store,
+// which may be of a different kind than the ones backed up. Each archive is
+// verified against its digest, and stored before the package referring to it.
+// Tokens and audit events keep their IDs, so they may be merged with ones
+// created before the restore.
+func Restore(r io.Reader, db UnpubDb, blobs BlobStore) error {
+	if err := requireEmptyStore(db, blobs); err != nil {
+		return err
+	}
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	if hdr.Name != backupManifestName {
+		return fmt.Errorf("%w: missing %s", ErrInvalidBackup, backupManifestName)
+	}
+	var manifest backupManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidBackup, backupManifestName, err)
+	}
+	if manifest.Format != backupFormat || manifest.Version < 1 || manifest.Version > BackupVersion {
+		return fmt.Errorf("%w: unsupported format %q version %d", ErrInvalidBackup, manifest.Format, manifest.Version)
+	}
+
+	restored := make(map[string]bool)
+	var packages, advisories, tokens, events int
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+		}
+		dir, file := path.Split(hdr.Name)
+		switch dir {
+		case backupBlobsDir:
+			digest, ok := strings.CutSuffix(file, ".tar.gz")
+			if !ok {
+				return fmt.Errorf("%w: unexpected entry %s", ErrInvalidBackup, hdr.Name)
+			}
+			if _, err := blobs.Put(digest, tr); err != nil {
+				return fmt.Errorf("%s: %w", hdr.Name, err)
+			}
+			restored[digest] = true
+		case backupPackagesDir:
+			var pkg UnpubPackage
+			if err := json.NewDecoder(tr).Decode(&pkg); err != nil {
+				return fmt.Errorf("%w: %s: %v", ErrInvalidBackup, hdr.Name, err)
+			}
+			if file != pkg.Name+".json" {
+				return fmt.Errorf("%w: %s holds package %q", ErrInvalidBackup, hdr.Name, pkg.Name)
+			}
+			for _, v := range pkg.Versions {
+				if v.ArchiveSHA256 != "" && !restored[v.ArchiveSHA256] {
+					return fmt.Errorf("%w: missing archive of %s %s", ErrInvalidBackup, pkg.Name, v.Version)
+				}
+			}
+			if err := db.SavePackage(pkg); err != nil {
+				return fmt.Errorf("%s: %w", hdr.Name, err)
+			}
+			packages++
+		case backupAdvisoriesDir:
+			var list []Advisory
+			if err := json.NewDecoder(tr).Decode(&list); err != nil {
+				return fmt.Errorf("%w: %s: %v", ErrInvalidBackup, hdr.Name, err)
+			}
+			for _, advisory := range list {
+				if file != advisory.Package+".json" {
+					return fmt.Errorf("%w: %s holds an advisory of package %q", ErrInvalidBackup, hdr.Name, advisory.Package)
+				}
+				if err := db.SaveAdvisory(advisory); err != nil {
+					return fmt.Errorf("%s: %w", hdr.Name, err)
+				}
+				advisories++
+			}
+		case backupAuditDir:
+			var list []AuditEvent
+			if err := json.NewDecoder(tr).Decode(&list); err != nil {
+				return fmt.Errorf("%w: %s: %v", ErrInvalidBackup, hdr.Name, err)
+			}
+			for _, event := range list {
+				if event.ID == "" {
+					return fmt.Errorf("%w: %s holds an event without an ID", ErrInvalidBackup, hdr.Name)
+				}
+				if err := db.RecordAudit(event); err != nil {
+					return fmt.Errorf("%s: %w", hdr.Name, err)
+				}
+				events++
+			}
+		case "":
+			if file != backupTokensName {
+				return fmt.Errorf("%w: unexpected entry %s", ErrInvalidBackup, hdr.Name)
+			}
+			var list []Token
+			if err := json.NewDecoder(tr).Decode(&list); err != nil {
+				return fmt.Errorf("%w: %s: %v", ErrInvalidBackup, hdr.Name, err)
+			}
+			for _, token := range list {
+				if token.ID == "" || token.Hash == "" {
+					return fmt.Errorf("%w: %s holds a token without an ID or hash", ErrInvalidBackup, hdr.Name)
+				}
+				if err := db.SaveToken(token); err != nil {
+					return fmt.Errorf("%s: %w", hdr.Name, err)
+				}
+				tokens++
+			}
+		default:
+			return fmt.Errorf("%w: unexpected entry %s", ErrInvalidBackup, hdr.Name)
+		}
+	}
+	log.Printf("Restored %d packages, %d archives, %d advisories, %d tokens and %d audit events\n",
+		packages, len(restored), advisories, tokens, events)
+	return nil
+}
+
+// errStoreNotEmpty stops BlobStore.List at the first blob.
+var errStoreNotEmpty = errors.New("store not empty")
+
+func requireEmptyStore(db UnpubDb, blobs BlobStore) error {
+	result, err := db.QueryPackages(UnpubDbQuery{Size: 1, IncludeUnlisted: true, IncludePrivate: true})
+	if err != nil {
+		return err
+	}
+	if result.Count > 0 {
+		return ErrRestoreNotEmpty
+	}
+	err = blobs.List(func(string) error {
+		return errStoreNotEmpty
+	})
+	if errors.Is(err, errStoreNotEmpty) {
+		return ErrRestoreNotEmpty
+	}
+	return err
+}
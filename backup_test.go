@@ -0,0 +1,243 @@
+package unpub
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// saveTestArchive stores data and records it as the archive of a version.
+func saveTestArchive(t *testing.T, db UnpubDb, blobs BlobStore, name, version, data string) string {
+	digest, err := BlobDigest(strings.NewReader(data))
+	require.NoError(t, err)
+	_, err = blobs.Put(digest, strings.NewReader(data))
+	require.NoError(t, err)
+	require.NoError(t, db.UpdatePackage(name, func(pkg *UnpubPackage, exists bool) error {
+		v := pkg.Versions[version]
+		v.ArchiveSHA256 = digest
+		pkg.Versions[version] = v
+		return nil
+	}))
+	return digest
+}
+
+const testReadme = "# my_pkg"
+
+// writeTestBackup backs up two packages, the first of which has two versions
+// sharing an archive and an advisory, along with a token and more audit
+// events than fit in a page.
+func writeTestBackup(t *testing.T) (backup []byte, digest, otherDigest string) {
+	require := require.New(t)
+	srcDb, err := NewUnpubLocalDb(true, "")
+	require.NoError(err)
+	defer srcDb.Close()
+	srcBlobs := testBlobStores(t)["badger"]
+
+	readme := testReadme
+	pkg := NewPackage(packageName, false, []string{uploader})
+	_, err = pkg.CreateVersion("1.0.0", "name: my_pkg\nversion: 1.0.0", nil, &readme, nil)
+	require.NoError(err)
+	_, err = pkg.CreateVersion("1.1.0", "name: my_pkg\nversion: 1.1.0", nil, nil, nil)
+	require.NoError(err)
+	require.NoError(srcDb.SavePackage(pkg))
+	require.NoError(srcDb.IncreaseDownloads(packageName, "1.0.0"))
+	digest = saveTestArchive(t, srcDb, srcBlobs, packageName, "1.0.0", "archive")
+	// Identical archives are only written once.
+	saveTestArchive(t, srcDb, srcBlobs, packageName, "1.1.0", "archive")
+	saveTestPackage(t, srcDb, "other_pkg", "0.1.0", []string{uploader}, "")
+	otherDigest = saveTestArchive(t, srcDb, srcBlobs, "other_pkg", "0.1.0", "other archive")
+	require.NoError(srcDb.SaveAdvisory(Advisory{ID: "UNPUB-2024-1", Package: packageName, Summary: "Path traversal"}))
+	token, _, err := NewToken("ci@example.com", []string{ScopePublish}, 0, time.Now())
+	require.NoError(err)
+	require.NoError(srcDb.SaveToken(token))
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i <= MaxAuditLimit; i++ {
+		require.NoError(srcDb.RecordAudit(AuditEvent{
+			Time:    start.Add(time.Duration(i) * time.Second),
+			Action:  AuditPublish,
+			Actor:   uploader,
+			Package: packageName,
+		}))
+	}
+
+	var buf bytes.Buffer
+	require.NoError(Backup(&buf, srcDb, srcBlobs))
+	return buf.Bytes(), digest, otherDigest
+}
+
+func TestBackupRestore(t *testing.T) {
+	backup, digest, otherDigest := writeTestBackup(t)
+	for name, db := range testDBs(t) {
+		db := db
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			blobs := testBlobStores(t)["fs"]
+			require.NoError(Restore(bytes.NewReader(backup), db, blobs))
+
+			got, err := db.QueryPackage(packageName)
+			require.NoError(err)
+			require.Equal([]string{uploader}, got.Uploaders)
+			require.Equal("1.1.0", got.Latest)
+			require.Equal(1, got.Downloads)
+			require.Equal(digest, got.Versions["1.1.0"].ArchiveSHA256)
+			v, err := db.QueryVersion(packageName, "1.0.0")
+			require.NoError(err)
+			require.Equal(testReadme, *v.Readme)
+			require.Equal(digest, v.ArchiveSHA256)
+
+			v, err = db.QueryVersion("other_pkg", "0.1.0")
+			require.NoError(err)
+			require.Equal(otherDigest, v.ArchiveSHA256)
+
+			var digests []string
+			require.NoError(blobs.List(func(digest string) error {
+				digests = append(digests, digest)
+				return nil
+			}))
+			require.ElementsMatch([]string{digest, otherDigest}, digests)
+
+			advisories, err := db.QueryAdvisories(packageName)
+			require.NoError(err)
+			require.Len(advisories, 1)
+			require.Equal("Path traversal", advisories[0].Summary)
+			tokens, err := db.QueryTokens()
+			require.NoError(err)
+			require.Len(tokens, 1)
+			require.Equal("ci@example.com", tokens[0].Identity)
+			require.NotEmpty(tokens[0].Hash)
+			events := 0
+			for query := (AuditQuery{Limit: MaxAuditLimit}); ; {
+				result, err := db.QueryAudit(query)
+				require.NoError(err)
+				events += len(result.Events)
+				if result.NextCursor == "" {
+					break
+				}
+				query.Cursor = result.NextCursor
+			}
+			require.Equal(MaxAuditLimit+1, events)
+
+			// Restoring over existing data is refused.
+			err = Restore(bytes.NewReader(backup), db, testBlobStores(t)["fs"])
+			require.ErrorIs(err, ErrRestoreNotEmpty)
+		})
+	}
+}
+
+// hookedBlobStore calls onGet before each blob is read.
+type hookedBlobStore struct {
+	BlobStore
+	onGet func(digest string)
+}
+
+func (s hookedBlobStore) Get(digest string) (Blob, error) {
+	s.onGet(digest)
+	return s.BlobStore.Get(digest)
+}
+
+func TestBackupDuringExpiry(t *testing.T) {
+	for name, db := range testDBs(t) {
+		db := db
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			blobs := testBlobStores(t)["fs"]
+			saveTestPackage(t, db, packageName, "1.0.0", []string{uploader}, "")
+			saveTestArchive(t, db, blobs, packageName, "1.0.0", "archive")
+			expiresAt := time.Now().Add(time.Hour)
+			require.NoError(db.UpdatePackage(packageName, func(pkg *UnpubPackage, exists bool) error {
+				return pkg.AddVersion(UnpubVersion{Version: "1.1.0-dev", CreatedAt: time.Now(), ExpiresAt: &expiresAt})
+			}))
+			preview := saveTestArchive(t, db, blobs, packageName, "1.1.0-dev", "preview archive")
+			saveTestPackage(t, db, "preview_pkg", "0.1.0-dev", []string{uploader}, "")
+			require.NoError(db.UpdatePackage("preview_pkg", func(pkg *UnpubPackage, exists bool) error {
+				v := pkg.Versions["0.1.0-dev"]
+				v.ExpiresAt = &expiresAt
+				pkg.Versions["0.1.0-dev"] = v
+				return nil
+			}))
+			otherPreview := saveTestArchive(t, db, blobs, "preview_pkg", "0.1.0-dev", "other preview archive")
+
+			// The previews expire after the snapshot is taken, but before
+			// their archives are read, as the sweeper would remove them.
+			expired := false
+			hooked := hookedBlobStore{BlobStore: blobs, onGet: func(digest string) {
+				if expired || (digest != preview && digest != otherPreview) {
+					return
+				}
+				expired = true
+				require.NoError(db.UpdatePackage(packageName, func(pkg *UnpubPackage, exists bool) error {
+					pkg.RemoveExpired(expiresAt)
+					return nil
+				}))
+				require.NoError(db.DeletePackage("preview_pkg"))
+				require.NoError(blobs.Delete(preview))
+				require.NoError(blobs.Delete(otherPreview))
+			}}
+			var buf bytes.Buffer
+			require.NoError(Backup(&buf, db, hooked))
+
+			restoredDb, err := NewUnpubLocalDb(true, "")
+			require.NoError(err)
+			defer restoredDb.Close()
+			require.NoError(Restore(&buf, restoredDb, testBlobStores(t)["fs"]))
+			pkg, err := restoredDb.QueryPackage(packageName)
+			require.NoError(err)
+			require.Len(pkg.Versions, 1)
+			require.Equal("1.0.0", pkg.Latest)
+			_, err = restoredDb.QueryPackage("preview_pkg")
+			require.ErrorIs(err, ErrNotFound)
+
+			// An archive missing for a version which is still live fails
+			// the backup.
+			digest := saveTestArchive(t, db, blobs, packageName, "1.0.0", "new archive")
+			require.NoError(blobs.Delete(digest))
+			require.ErrorIs(Backup(io.Discard, db, blobs), ErrNotFound)
+		})
+	}
+}
+
+func TestRestoreInvalid(t *testing.T) {
+	archive := func(entries ...string) io.Reader {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		for i := 0; i < len(entries); i += 2 {
+			data := []byte(entries[i+1])
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: entries[i], Mode: 0o644, Size: int64(len(data))}))
+			_, err := tw.Write(data)
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+		require.NoError(t, gw.Close())
+		return &buf
+	}
+	manifest := fmt.Sprintf(`{"format":"unpub-backup","version":%d}`, BackupVersion)
+
+	for name, r := range map[string]io.Reader{
+		"not gzip":        strings.NewReader("not a backup"),
+		"no manifest":     archive("packages/my_pkg.json", `{"name":"my_pkg"}`),
+		"newer version":   archive(backupManifestName, fmt.Sprintf(`{"format":"unpub-backup","version":%d}`, BackupVersion+1)),
+		"unknown entry":   archive(backupManifestName, manifest, "other/file", ""),
+		"renamed package": archive(backupManifestName, manifest, "packages/other.json", `{"name":"my_pkg"}`),
+		"missing archive": archive(backupManifestName, manifest, "packages/my_pkg.json",
+			`{"name":"my_pkg","versions":{"1.0.0":{"version":"1.0.0","archiveSha256":"0123abcd"}}}`),
+		"misplaced advisory": archive(backupManifestName, manifest, "advisories/other.json",
+			`[{"id":"UNPUB-2024-1","package":"my_pkg"}]`),
+		"token without hash": archive(backupManifestName, manifest, backupTokensName, `[{"id":"0123abcd"}]`),
+	} {
+		r := r
+		t.Run(name, func(t *testing.T) {
+			db, err := NewUnpubLocalDb(true, "")
+			require.NoError(t, err)
+			defer db.Close()
+			require.ErrorIs(t, Restore(r, db, testBlobStores(t)["fs"]), ErrInvalidBackup)
+		})
+	}
+}
@@ -0,0 +1,614 @@
+package unpub
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// BlobStore stores package archives under the hex-encoded SHA-256 digest of
+// their contents. Blobs are immutable, so storing an existing digest again is a
+// no-op.
+type BlobStore interface {
+	// Put stores the contents of r under digest, reporting whether the blob was
+	// created or was already stored. Contents which do not match digest are
+	// rejected with ErrDigestMismatch.
+	Put(digest string, r io.Reader) (created bool, err error)
+	// Get opens a blob for reading, or returns ErrNotFound.
+	Get(digest string) (Blob, error)
+	Delete(digest string) error
+	// List calls fn with the digest of every stored blob.
+	List(fn func(digest string) error) error
+}
+
+// Blob is a stored blob, opened for reading. Reads are streamed from the
+// store rather than loaded into memory up front.
+type Blob interface {
+	io.ReadSeekCloser
+	Size() int64
+	ModTime() time.Time
+}
+
+// ErrDigestMismatch is returned by BlobStore.Put when the contents of a blob
+// do not match its digest.
+var ErrDigestMismatch = &Error{Kind: ErrInvalidInput, Message: "blob does not match digest"}
+
+// BlobDigest returns the hex-encoded SHA-256 digest of the contents of r.
+func BlobDigest(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readBlob reads the contents of r, checking them against digest.
+func readBlob(digest string, r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != digest {
+		return nil, ErrDigestMismatch
+	}
+	return data, nil
+}
+
+// FileBlobStore stores blobs as <digest>.tar.gz files in a directory.
+type FileBlobStore struct {
+	Dir string
+	// Key is the master key blobs are encrypted with, if any. See
+	// encryption.go for the file format.
+	Key []byte
+}
+
+// fileBlobStagingDir is the directory under FileBlobStore.Dir holding blobs
+// which are still being written.
+const fileBlobStagingDir = ".staging"
+
+// NewFileBlobStore creates dir if needed, and deletes blobs left partially
+// written by a crash.
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	if err := os.RemoveAll(filepath.Join(dir, fileBlobStagingDir)); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, fileBlobStagingDir), 0o755); err != nil {
+		return nil, err
+	}
+	log.Printf("Opened blob store at: %s", dir)
+	return &FileBlobStore{Dir: dir}, nil
+}
+
+func (s *FileBlobStore) path(digest string) string {
+	return filepath.Join(s.Dir, digest+".tar.gz")
+}
+
+// Put writes the blob to a staging file, which is linked into place once it
+// is complete and verified, so a blob is never visible partially written.
+// Linking fails if the blob was stored meanwhile, so of concurrent calls
+// storing the same blob only one reports it created.
+func (s *FileBlobStore) Put(digest string, r io.Reader) (created bool, err error) {
+	path := s.path(digest)
+	if _, err := os.Stat(path); err == nil {
+		return false, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+
+	staged, err := os.CreateTemp(filepath.Join(s.Dir, fileBlobStagingDir), "blob.*")
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if rmErr := os.Remove(staged.Name()); rmErr != nil {
+			log.Printf("Error removing staged blob %s: %v\n", staged.Name(), rmErr)
+		}
+	}()
+	var w io.WriteCloser = nopWriteCloser{staged}
+	if s.Key != nil {
+		if w, err = newEncryptingWriter(staged, s.Key, digest); err != nil {
+			staged.Close()
+			return false, err
+		}
+	}
+	h := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(w, h), r); err != nil {
+		staged.Close()
+		return false, err
+	}
+	if err = w.Close(); err != nil {
+		staged.Close()
+		return false, err
+	}
+	if err = staged.Sync(); err != nil {
+		staged.Close()
+		return false, err
+	}
+	if err = staged.Close(); err != nil {
+		return false, err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != digest {
+		err = ErrDigestMismatch
+		return false, err
+	}
+	if err = os.Link(staged.Name(), path); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type fileBlob struct {
+	*os.File
+	info os.FileInfo
+}
+
+func (b fileBlob) Size() int64 {
+	return b.info.Size()
+}
+
+func (b fileBlob) ModTime() time.Time {
+	return b.info.ModTime()
+}
+
+func (s *FileBlobStore) Get(digest string) (Blob, error) {
+	f, err := os.Open(s.path(digest))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.Key != nil {
+		blob, err := openEncryptedBlob(f, s.Key, digest)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("blob %s: %w", digest, err)
+		}
+		return blob, nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	// Never serve the contents of an encrypted blob as they are.
+	magic := make([]byte, len(encryptedBlobMagic))
+	if _, err := io.ReadFull(f, magic); err == nil && string(magic) == encryptedBlobMagic {
+		f.Close()
+		return nil, fmt.Errorf("blob %s is encrypted, but no key was given", digest)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return fileBlob{File: f, info: info}, nil
+}
+
+func (s *FileBlobStore) Delete(digest string) error {
+	err := os.Remove(s.path(digest))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileBlobStore) List(fn func(digest string) error) error {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		digest, ok := strings.CutSuffix(entry.Name(), ".tar.gz")
+		if entry.IsDir() || !ok {
+			continue
+		}
+		if err := fn(digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BadgerBlobStore stores blobs in a badger DB, split into chunks so that they
+// can be written and read without holding them in memory.
+//
+// A blob is written as chunks under a random ID, and becomes visible once its
+// info record naming that ID is committed. Puts which fail or lose a race
+// therefore never touch the chunks of a stored blob.
+type BadgerBlobStore struct {
+	db *badger.DB
+}
+
+const (
+	// legacyBlobPrefix holds unchunked blobs, which are converted on open.
+	legacyBlobPrefix = "blob_"
+	blobInfoPrefix   = "blobinfo_"
+	blobChunkPrefix  = "blobchunk_"
+
+	// blobChunkSize stays below badger's default value threshold, since an
+	// in-memory DB has no value log for larger values.
+	blobChunkSize = 256 << 10
+)
+
+// badgerBlobInfo is the record stored under a blob info key.
+type badgerBlobInfo struct {
+	ID      string    `json:"id"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+func makeBlobInfoKey(digest string) []byte {
+	return []byte(fmt.Sprintf("%s%s", blobInfoPrefix, digest))
+}
+
+func makeBlobChunkPrefix(digest, id string) []byte {
+	return []byte(fmt.Sprintf("%s%s/%s/", blobChunkPrefix, digest, id))
+}
+
+func makeBlobChunkKey(digest, id string, index int64) []byte {
+	return []byte(fmt.Sprintf("%s%08x", makeBlobChunkPrefix(digest, id), index))
+}
+
+// NewBadgerBlobStore opens a badger DB for blobs under path, or in memory. Any
+// chunks left behind by a crash are deleted.
+func NewBadgerBlobStore(inMem bool, path string) (*BadgerBlobStore, error) {
+	return newBadgerBlobStore(inMem, path, nil)
+}
+
+// NewEncryptedBadgerBlobStore opens a badger DB for blobs under path using
+// badger's encryption at rest, with key as the master key.
+func NewEncryptedBadgerBlobStore(path string, key []byte) (*BadgerBlobStore, error) {
+	return newBadgerBlobStore(false, path, key)
+}
+
+// RotateBadgerBlobStoreKey switches the encrypted blob store under path from
+// oldKey to newKey. The store must not be open.
+func RotateBadgerBlobStoreKey(path string, oldKey, newKey []byte) error {
+	return rotateBadgerKey(filepath.Join(path, "blobs"), oldKey, newKey)
+}
+
+func newBadgerBlobStore(inMem bool, path string, key []byte) (*BadgerBlobStore, error) {
+	var dbPath string
+	if !inMem {
+		dbPath = filepath.Join(path, "blobs")
+	}
+	db, err := badger.Open(badgerOptions(dbPath, inMem, key))
+	if err != nil {
+		return nil, err
+	}
+	s := &BadgerBlobStore{db: db}
+	if err := s.convertLegacyBlobs(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := s.deleteOrphanedChunks(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	dbLoc := dbPath
+	if inMem {
+		dbLoc = "memory"
+	}
+	log.Printf("Opened blob store at: %s", dbLoc)
+	return s, nil
+}
+
+// convertLegacyBlobs splits blobs stored under a single key into chunks.
+func (s *BadgerBlobStore) convertLegacyBlobs() error {
+	var digests []string
+	err := s.db.View(func(txn *badger.Txn) error {
+		iterateKeys(txn, []byte(legacyBlobPrefix), func(digest string) {
+			digests = append(digests, digest)
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, digest := range digests {
+		key := []byte(legacyBlobPrefix + digest)
+		var data []byte
+		err := s.db.View(func(txn *badger.Txn) error {
+			item, err := txn.Get(key)
+			if err != nil {
+				return err
+			}
+			data, err = item.ValueCopy(nil)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := s.Put(digest, bytes.NewReader(data)); err != nil {
+			return fmt.Errorf("converting blob %s: %w", digest, err)
+		}
+		err = s.db.Update(func(txn *badger.Txn) error {
+			return txn.Delete(key)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteOrphanedChunks deletes chunks not named by an info record, left behind
+// by Puts interrupted by a crash.
+func (s *BadgerBlobStore) deleteOrphanedChunks() error {
+	var orphaned [][]byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		ids := make(map[string]string)
+		iterateKeys(txn, []byte(blobChunkPrefix), func(key string) {
+			digest, rest, _ := strings.Cut(key, "/")
+			id, _, _ := strings.Cut(rest, "/")
+			if _, ok := ids[digest]; !ok {
+				info, err := s.info(txn, digest)
+				if err == nil {
+					ids[digest] = info.ID
+				} else {
+					ids[digest] = ""
+				}
+			}
+			if ids[digest] != id {
+				orphaned = append(orphaned, []byte(blobChunkPrefix+key))
+			}
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.deleteKeys(orphaned)
+}
+
+func (s *BadgerBlobStore) deleteKeys(keys [][]byte) error {
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, key := range keys {
+		if err := wb.Delete(key); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+func (s *BadgerBlobStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BadgerBlobStore) info(txn *badger.Txn, digest string) (info badgerBlobInfo, err error) {
+	item, err := txn.Get(makeBlobInfoKey(digest))
+	if err != nil {
+		return
+	}
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &info)
+	})
+	return
+}
+
+func (s *BadgerBlobStore) exists(digest string) (bool, error) {
+	err := s.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(makeBlobInfoKey(digest))
+		return err
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *BadgerBlobStore) Put(digest string, r io.Reader) (created bool, err error) {
+	if exists, err := s.exists(digest); err != nil || exists {
+		return false, err
+	}
+
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return false, err
+	}
+	info := badgerBlobInfo{ID: hex.EncodeToString(idBytes)}
+	defer func() {
+		if err != nil || !created {
+			if rmErr := s.deleteChunks(digest, info.ID); rmErr != nil {
+				log.Printf("Error removing chunks of blob %s: %v\n", digest, rmErr)
+			}
+		}
+	}()
+
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	h := sha256.New()
+	for index := int64(0); ; index++ {
+		chunk := make([]byte, blobChunkSize)
+		n, readErr := io.ReadFull(r, chunk)
+		if n > 0 {
+			h.Write(chunk[:n])
+			if err = wb.Set(makeBlobChunkKey(digest, info.ID, index), chunk[:n]); err != nil {
+				return false, err
+			}
+			info.Size += int64(n)
+		}
+		if errors.Is(readErr, io.EOF) || errors.Is(readErr, io.ErrUnexpectedEOF) {
+			break
+		}
+		if readErr != nil {
+			return false, readErr
+		}
+	}
+	if err = wb.Flush(); err != nil {
+		return false, err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != digest {
+		return false, ErrDigestMismatch
+	}
+
+	info.ModTime = time.Now()
+	b, err := json.Marshal(info)
+	if err != nil {
+		return false, err
+	}
+	for {
+		err = s.db.Update(func(txn *badger.Txn) error {
+			key := makeBlobInfoKey(digest)
+			_, err := txn.Get(key)
+			if !errors.Is(err, badger.ErrKeyNotFound) {
+				created = false
+				return err
+			}
+			created = true
+			return txn.Set(key, b)
+		})
+		if !errors.Is(err, badger.ErrConflict) {
+			return created, err
+		}
+	}
+}
+
+func (s *BadgerBlobStore) deleteChunks(digest, id string) error {
+	var keys [][]byte
+	prefix := makeBlobChunkPrefix(digest, id)
+	err := s.db.View(func(txn *badger.Txn) error {
+		iterateKeys(txn, prefix, func(index string) {
+			keys = append(keys, append(append([]byte(nil), prefix...), index...))
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.deleteKeys(keys)
+}
+
+func (s *BadgerBlobStore) Get(digest string) (Blob, error) {
+	var info badgerBlobInfo
+	err := s.db.View(func(txn *badger.Txn) (err error) {
+		info, err = s.info(txn, digest)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &badgerBlob{db: s.db, digest: digest, info: info}, nil
+}
+
+// badgerBlob reads a blob one chunk at a time, each in its own transaction.
+type badgerBlob struct {
+	db     *badger.DB
+	digest string
+	info   badgerBlobInfo
+	offset int64
+}
+
+func (b *badgerBlob) Read(p []byte) (n int, err error) {
+	if b.offset >= b.info.Size {
+		return 0, io.EOF
+	}
+	err = b.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(makeBlobChunkKey(b.digest, b.info.ID, b.offset/blobChunkSize))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			n = copy(p, val[b.offset%blobChunkSize:])
+			return nil
+		})
+	})
+	b.offset += int64(n)
+	return n, err
+}
+
+func (b *badgerBlob) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.info.Size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	b.offset = offset
+	return offset, nil
+}
+
+func (b *badgerBlob) Close() error {
+	return nil
+}
+
+func (b *badgerBlob) Size() int64 {
+	return b.info.Size
+}
+
+func (b *badgerBlob) ModTime() time.Time {
+	return b.info.ModTime
+}
+
+func (s *BadgerBlobStore) Delete(digest string) error {
+	var info badgerBlobInfo
+	err := s.db.Update(func(txn *badger.Txn) (err error) {
+		info, err = s.info(txn, digest)
+		if err != nil {
+			return err
+		}
+		return txn.Delete(makeBlobInfoKey(digest))
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.deleteChunks(digest, info.ID)
+}
+
+func (s *BadgerBlobStore) List(fn func(digest string) error) error {
+	var digests []string
+	err := s.db.View(func(txn *badger.Txn) error {
+		iterateKeys(txn, []byte(blobInfoPrefix), func(digest string) {
+			digests = append(digests, digest)
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, digest := range digests {
+		if err := fn(digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ = (BlobStore)(&FileBlobStore{})
+	_ = (BlobStore)(&BadgerBlobStore{})
+)
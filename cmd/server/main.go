@@ -3,15 +3,21 @@ package main
 import (
 	"context"
 	"embed"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/dnys1/unpub"
 	"github.com/dnys1/unpub/server"
@@ -25,6 +31,17 @@ var (
 	inMemory      = flag.Bool("memory", false, "Runs the server in-memory, using no storage")
 	path          = flag.String("path", "", "Directory to store DB files (defaults to temp dir, only valid if memory=false)")
 	addr          = flag.String("addr", "localhost", "The hostname to serve unpub as")
+	dbType        = flag.String("db", "badger", "The metadata store to use (badger or sqlite)")
+	blobStore     = flag.String("blobs", "", "The archive store to use (fs, badger or s3; defaults to badger if memory=true, else fs)")
+	s3Endpoint    = flag.String("s3-endpoint", "https://s3.amazonaws.com", "The S3-compatible endpoint to store archives in (only valid if blobs=s3)")
+	s3Region      = flag.String("s3-region", "us-east-1", "The region of the S3 bucket (only valid if blobs=s3)")
+	s3Bucket      = flag.String("s3-bucket", "", "The S3 bucket to store archives in (only valid if blobs=s3)")
+	s3Prefix      = flag.String("s3-prefix", "", "The key prefix of archives in the S3 bucket (only valid if blobs=s3)")
+	keyFile       = flag.String("encryption-key-file", "", "File holding the hex-encoded master key to encrypt data at rest with (defaults to $UNPUB_ENCRYPTION_KEY)")
+	sweepInterval = flag.Duration("expiry-sweep-interval", time.Minute, "How often to remove preview versions whose time-to-live has passed")
+	migrateDryRun = flag.Bool("migrate-dry-run", false, "Reports the pending DB migrations under path without applying them, then exits")
+	auth          = flag.String("auth", server.AuthNone, "The requests which need a bearer token (none, write or all)")
+	oidcIssuers   = flag.String("oidc-issuers", "", "JSON file listing the OIDC issuers whose identity tokens can publish packages which trust them")
 
 	//go:embed build
 	staticFS embed.FS
@@ -36,8 +53,20 @@ func init() {
 }
 
 func main() {
+	if !server.ValidAuth(*auth) {
+		log.Fatalf("bad auth mode: %s\n", *auth)
+	}
+	key, err := loadEncryptionKey()
+	if err != nil {
+		log.Fatalf("error loading encryption key: %v\n", err)
+	}
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args(), key); err != nil {
+			log.Fatalf("error running %s: %v\n", flag.Arg(0), err)
+		}
+		return
+	}
 	if !*inMemory && *path == "" {
-		var err error
 		*path, err = os.MkdirTemp("", "unpub")
 		if err != nil {
 			log.Fatalf("error creating temp dir: %v\n", err)
@@ -45,10 +74,23 @@ func main() {
 	} else if *inMemory {
 		*path = ""
 	}
-	db, err := unpub.NewUnpubLocalDb(*inMemory, *path)
+	if *migrateDryRun {
+		if *inMemory || *dbType != "badger" {
+			log.Fatalln("migrate-dry-run requires a badger db on disk")
+		}
+		if err := unpub.MigrateUnpubLocalDb(*path, key, true); err != nil {
+			log.Fatalf("error migrating db: %v\n", err)
+		}
+		return
+	}
+	db, err := openDB(*dbType, *inMemory, *path, key)
 	if err != nil {
 		log.Fatalf("error opening db: %v\n", err)
 	}
+	blobs, err := openBlobStore(*blobStore, *inMemory, *path, key)
+	if err != nil {
+		log.Fatalf("error opening blob store: %v\n", err)
+	}
 	if *port == 0 {
 		if envPort := os.Getenv("UNPUB_PORT"); envPort != "" {
 			*port, err = strconv.Atoi(envPort)
@@ -62,13 +104,28 @@ func main() {
 	if *addr == "localhost" {
 		*addr = fmt.Sprintf("http://localhost:%d", *port)
 	}
+	oidc, err := loadOIDCVerifier(*oidcIssuers, *addr)
+	if err != nil {
+		log.Fatalf("error loading OIDC issuers: %v\n", err)
+	}
 	svc := &server.UnpubServiceImpl{
-		InMemory:      *inMemory,
 		Path:          *path,
 		DB:            db,
+		Blobs:         blobs,
 		UploaderEmail: *uploaderEmail,
 		Addr:          *addr,
+		Auth:          *auth,
+		OIDC:          oidc,
 	}
+	if err := svc.RecoverPublishes(); err != nil {
+		log.Fatalf("error recovering publishes: %v\n", err)
+	}
+	ctx, stopSweeper := context.WithCancel(context.Background())
+	sweeperDone := make(chan struct{})
+	go func() {
+		defer close(sweeperDone)
+		svc.SweepExpired(ctx, *sweepInterval)
+	}()
 
 	r := mux.NewRouter()
 	server.SetupRoutes(r, svc)
@@ -111,9 +168,241 @@ func main() {
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error shutting down server: %v\n", err)
 	}
+	stopSweeper()
+	<-sweeperDone
 
 	err = db.Close()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error closing db: %v\n", err)
 	}
+	if closer, ok := blobs.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "error closing blob store: %v\n", err)
+		}
+	}
+}
+
+// loadOIDCVerifier reads the issuers listed in file, or returns nil if it is
+// empty. Issuers without an audience expect the address of the server.
+func loadOIDCVerifier(file, addr string) (*unpub.OIDCVerifier, error) {
+	if file == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var issuers []unpub.OIDCIssuer
+	if err := json.Unmarshal(b, &issuers); err != nil {
+		return nil, err
+	}
+	for i := range issuers {
+		if issuers[i].Audience == "" {
+			issuers[i].Audience = addr
+		}
+	}
+	return unpub.NewOIDCVerifier(issuers)
+}
+
+// runCommand runs the backup, restore, rotate-key or create-token subcommand
+// against the stores selected by the flags. Backups hold the packages, their
+// archives and advisories, the API tokens and the audit log. A badger DB can
+// only be opened by one process, so to back up a running server use its
+// /admin/backup endpoint instead.
+func runCommand(args []string, key []byte) error {
+	valid := len(args) == 2 && (args[0] == "backup" || args[0] == "restore" || args[0] == "rotate-key")
+	if !valid && !(len(args) == 3 && args[0] == "create-token") {
+		return errors.New("usage: unpub [flags] backup|restore <file> | rotate-key <new-key-file> | create-token <identity> <scopes>")
+	}
+	if *inMemory || *path == "" {
+		return errors.New("path is required, and memory must be false")
+	}
+	if args[0] == "rotate-key" {
+		return rotateKey(key, args[1])
+	}
+	if err := os.MkdirAll(*path, 0o755); err != nil {
+		return err
+	}
+	db, err := openDB(*dbType, false, *path, key)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if args[0] == "create-token" {
+		return createToken(db, args[1], args[2])
+	}
+	blobs, err := openBlobStore(*blobStore, false, *path, key)
+	if err != nil {
+		return err
+	}
+	if closer, ok := blobs.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	filename := args[1]
+	if args[0] == "restore" {
+		var r io.Reader = os.Stdin
+		if filename != "-" {
+			f, err := os.Open(filename)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		return unpub.Restore(r, db, blobs)
+	}
+
+	if filename == "-" {
+		return unpub.Backup(os.Stdout, db, blobs)
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = unpub.Backup(f, db, blobs)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename)
+		return err
+	}
+	log.Printf("Wrote backup to: %s\n", filename)
+	return nil
+}
+
+// createToken creates a token with the comma-separated scopes, and prints its
+// secret. It is how the first admin token of a registry is made.
+func createToken(db unpub.UnpubDb, identity, scopes string) error {
+	token, secret, err := unpub.NewToken(identity, strings.Split(scopes, ","), 0, time.Now())
+	if err != nil {
+		return err
+	}
+	token.Description = "Created with create-token"
+	if err := db.SaveToken(token); err != nil {
+		return err
+	}
+	log.Printf("Created token %s for %s\n", token.ID, identity)
+	fmt.Println(secret)
+	return nil
+}
+
+// rotateKey re-encrypts the stores selected by the flags from key to the key
+// in newKeyFile. The server must not be running. Archives in S3 are not
+// encrypted by unpub, and are left as they are.
+func rotateKey(key []byte, newKeyFile string) error {
+	if key == nil {
+		return errors.New("the current key is required")
+	}
+	newKey, err := readEncryptionKey(newKeyFile)
+	if err != nil {
+		return err
+	}
+	if *dbType != "badger" {
+		return fmt.Errorf("the %s db cannot be encrypted", *dbType)
+	}
+	if err := unpub.RotateUnpubLocalDbKey(*path, key, newKey); err != nil {
+		return fmt.Errorf("rotating db key: %w", err)
+	}
+	switch *blobStore {
+	case "", "fs":
+		var blobs *unpub.FileBlobStore
+		if blobs, err = unpub.NewFileBlobStore(filepath.Join(*path, "archives")); err == nil {
+			blobs.Key = key
+			err = blobs.RotateKey(newKey)
+		}
+	case "badger":
+		err = unpub.RotateBadgerBlobStoreKey(*path, key, newKey)
+	}
+	if err != nil {
+		return fmt.Errorf("rotating blob store key: %w", err)
+	}
+	log.Printf("Rotated encryption key of: %s\n", *path)
+	return nil
+}
+
+// loadEncryptionKey returns the master key given by -encryption-key-file or
+// $UNPUB_ENCRYPTION_KEY, or nil if there is none.
+func loadEncryptionKey() ([]byte, error) {
+	if *keyFile != "" {
+		return readEncryptionKey(*keyFile)
+	}
+	if env := os.Getenv("UNPUB_ENCRYPTION_KEY"); env != "" {
+		return unpub.ParseEncryptionKey(env)
+	}
+	return nil, nil
+}
+
+func readEncryptionKey(filename string) ([]byte, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return unpub.ParseEncryptionKey(strings.TrimSpace(string(b)))
+}
+
+// openDB opens the metadata store selected by the -db flag, encrypted with key
+// unless it is nil.
+func openDB(typ string, inMem bool, path string, key []byte) (unpub.UnpubDb, error) {
+	if key != nil && (inMem || typ != "badger") {
+		return nil, errors.New("encryption requires a badger db on disk")
+	}
+	switch typ {
+	case "badger":
+		if key != nil {
+			return unpub.NewEncryptedUnpubLocalDb(path, key)
+		}
+		return unpub.NewUnpubLocalDb(inMem, path)
+	case "sqlite":
+		return unpub.NewUnpubSQLDb(inMem, path)
+	default:
+		return nil, fmt.Errorf("unknown db type: %q", typ)
+	}
+}
+
+// openBlobStore opens the archive store selected by the -blobs flag, encrypted
+// with key unless it is nil. S3 credentials are read from AWS_ACCESS_KEY_ID
+// and AWS_SECRET_ACCESS_KEY.
+func openBlobStore(typ string, inMem bool, path string, key []byte) (unpub.BlobStore, error) {
+	if typ == "" {
+		typ = "fs"
+		if inMem {
+			typ = "badger"
+		}
+	}
+	switch typ {
+	case "fs":
+		if inMem {
+			return nil, errors.New("the fs blob store requires memory=false")
+		}
+		store, err := unpub.NewFileBlobStore(filepath.Join(path, "archives"))
+		if err != nil {
+			return nil, err
+		}
+		store.Key = key
+		return store, nil
+	case "badger":
+		if key != nil {
+			return unpub.NewEncryptedBadgerBlobStore(path, key)
+		}
+		return unpub.NewBadgerBlobStore(inMem, path)
+	case "s3":
+		if *s3Bucket == "" {
+			return nil, errors.New("s3-bucket is required")
+		}
+		if key != nil {
+			log.Println("Archives in S3 are not encrypted by unpub; enable server-side encryption on the bucket instead")
+		}
+		return &unpub.S3BlobStore{
+			Endpoint:        *s3Endpoint,
+			Region:          *s3Region,
+			Bucket:          *s3Bucket,
+			Prefix:          *s3Prefix,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown blob store: %q", typ)
+	}
 }
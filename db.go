@@ -2,17 +2,30 @@ package unpub
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
+	"math"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/dgraph-io/badger/v3"
 )
 
+// Sort orders accepted in UnpubDbQuery.Sort.
+const (
+	SortDownload  = "download"
+	SortUpdated   = "updated"
+	SortCreated   = "created"
+	SortName      = "name"
+	SortRelevance = "relevance"
+)
+
+// UnpubDbQuery selects a page of packages. Page is zero-based, and a Size of
+// zero returns every matching package.
 type UnpubDbQuery struct {
 	Size       int
 	Page       int
@@ -20,17 +33,77 @@ type UnpubDbQuery struct {
 	Keyword    string
 	Uploader   string
 	Dependency string
+	// IncludeUnlisted also selects unlisted packages, which are otherwise
+	// hidden.
+	IncludeUnlisted bool
+	// IncludePrivate also selects private packages. Otherwise only those
+	// which Reader may read, or whose trust policies match Trusted, are
+	// selected.
+	IncludePrivate bool
+	Reader         string
+	// Trusted are the claims of the identity token making the query, if any.
+	Trusted *IdentityClaims
 }
 
+// ErrNotFound is returned by an UnpubDb when a package or file does not exist.
+var ErrNotFound = badger.ErrKeyNotFound
+
+// PackageUpdate modifies pkg in place. exists is false when the package has not
+// been saved before, in which case pkg is empty and fn may create it. fn may be
+// called more than once if the update has to be retried, and any error it
+// returns aborts the update.
+type PackageUpdate func(pkg *UnpubPackage, exists bool) error
+
 type UnpubDb interface {
+	// QueryPackage returns a package and all of its versions, without their
+	// READMEs and changelogs.
 	QueryPackage(name string) (UnpubPackage, error)
+	// QueryVersion returns a single version of a package, including its README
+	// and changelog.
+	QueryVersion(name, version string) (UnpubVersion, error)
 	QueryPackages(query UnpubDbQuery) (*UnpubQueryResult, error)
 	SavePackage(pkg UnpubPackage) error
+	// UpdatePackage atomically applies fn to the named package and saves the
+	// result, so concurrent updates are never lost. A package left without
+	// versions is deleted.
+	UpdatePackage(name string, fn PackageUpdate) error
 	AddUploader(name, email string) error
 	RemoveUploader(name, email string) error
 	IncreaseDownloads(name, version string) error
-	SaveFile(pkgName, version string, data []byte) error
-	GetFile(pkgName, version string) (io.Reader, error)
+	// QueryDownloads returns the per-version download counts of a package,
+	// with daily counts from the given day onwards.
+	QueryDownloads(name string, since time.Time) (*DownloadStats, error)
+	// ExportPackages calls fn with every package, including the READMEs and
+	// changelogs of its versions, as of a single point in time.
+	ExportPackages(fn func(pkg UnpubPackage) error) error
+	// DeletePackage deletes a package with all of its versions, download
+	// counts and advisories. Its archives are left for the server to collect.
+	DeletePackage(name string) error
+	// RecordAudit appends an event to the audit log, assigning its ID and, if
+	// unset, its time.
+	RecordAudit(event AuditEvent) error
+	// QueryAudit returns a page of audit events, newest first.
+	QueryAudit(query AuditQuery) (*AuditResult, error)
+	// QueryExpiredPackages returns the names of the packages with versions
+	// which have expired at now.
+	QueryExpiredPackages(now time.Time) ([]string, error)
+	// QueryPackageNames returns the names of every listed package which is
+	// not private in alphabetical order.
+	QueryPackageNames() ([]string, error)
+	// SaveAdvisory creates or replaces an advisory, identified by its package
+	// and ID.
+	SaveAdvisory(advisory Advisory) error
+	// QueryAdvisories returns the advisories of a package ordered by ID,
+	// including withdrawn ones.
+	QueryAdvisories(name string) ([]Advisory, error)
+	SaveToken(token Token) error
+	// QueryToken returns the token with the given ID, or ErrNotFound.
+	QueryToken(id string) (Token, error)
+	// QueryTokens returns every token ordered by ID.
+	QueryTokens() ([]Token, error)
+	// DeleteToken revokes a token, returning ErrNotFound if it does not exist.
+	DeleteToken(id string) error
+	Close() error
 }
 
 type UnpubLocalDb struct {
@@ -39,16 +112,53 @@ type UnpubLocalDb struct {
 	db       *badger.DB
 }
 
+// NewUnpubLocalDb opens the DB and runs any pending schema migrations.
 func NewUnpubLocalDb(inMem bool, path string) (*UnpubLocalDb, error) {
+	return newUnpubLocalDb(inMem, path, nil)
+}
+
+// NewEncryptedUnpubLocalDb opens the DB under path using badger's encryption
+// at rest, with key as the master key.
+func NewEncryptedUnpubLocalDb(path string, key []byte) (*UnpubLocalDb, error) {
+	return newUnpubLocalDb(false, path, key)
+}
+
+func newUnpubLocalDb(inMem bool, path string, key []byte) (*UnpubLocalDb, error) {
+	db, err := openUnpubLocalDb(inMem, path, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Migrate(false); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// MigrateUnpubLocalDb runs the pending schema migrations of the DB under path
+// and closes it. With dryRun, the DB on disk is left untouched. key is nil
+// unless the DB is encrypted.
+func MigrateUnpubLocalDb(path string, key []byte, dryRun bool) error {
+	db, err := openUnpubLocalDb(false, path, key)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Migrate(dryRun)
+}
+
+// RotateUnpubLocalDbKey switches the encrypted DB under path from oldKey to
+// newKey. The DB must not be open.
+func RotateUnpubLocalDbKey(path string, oldKey, newKey []byte) error {
+	return rotateBadgerKey(filepath.Join(path, "db"), oldKey, newKey)
+}
+
+func openUnpubLocalDb(inMem bool, path string, key []byte) (*UnpubLocalDb, error) {
 	var dbPath string
 	if !inMem {
 		dbPath = filepath.Join(path, "db")
 	}
-	badgerDb, err := badger.Open(
-		badger.
-			DefaultOptions(dbPath).
-			WithInMemory(inMem),
-	)
+	badgerDb, err := badger.Open(badgerOptions(dbPath, inMem, key))
 	if err != nil {
 		return nil, err
 	}
@@ -65,16 +175,176 @@ func NewUnpubLocalDb(inMem bool, path string) (*UnpubLocalDb, error) {
 }
 
 const (
-	packagePrefix = "package_"
-	filePrefix    = "file_"
+	packagePrefix         = "package_"
+	versionPrefix         = "version_"
+	readmePrefix          = "readme_"
+	changelogPrefix       = "changelog_"
+	nameIndexPrefix       = "idx_name_"
+	uploaderIndexPrefix   = "idx_uploader_"
+	dependencyIndexPrefix = "idx_dependency_"
+	sortIndexPrefix       = "idx_sort_"
+	searchIndexPrefix     = "idx_fts_"
+	searchDocPrefix       = "search_"
+	versionDownloadPrefix = "downloads_version_"
+	dailyDownloadPrefix   = "downloads_daily_"
+	auditPrefix           = "audit_"
+	expiryIndexPrefix     = "idx_expiry_"
+	unlistedIndexPrefix   = "idx_unlisted_"
+	privateIndexPrefix    = "idx_private_"
+	readerIndexPrefix     = "idx_reader_"
+	advisoryPrefix        = "advisory_"
+	tokenPrefix           = "token_"
 )
 
 func makePackageKey(packageName string) []byte {
 	return []byte(fmt.Sprintf("%s%s", packagePrefix, packageName))
 }
 
-func makeFileKey(packageName, version string) []byte {
-	return []byte(fmt.Sprintf("%s%s_%s", filePrefix, packageName, version))
+func makeVersionPrefix(packageName string) []byte {
+	return []byte(fmt.Sprintf("%s%s/", versionPrefix, packageName))
+}
+
+func makeVersionKey(packageName, version string) []byte {
+	return append(makeVersionPrefix(packageName), version...)
+}
+
+func makeReadmeKey(packageName, version string) []byte {
+	return []byte(fmt.Sprintf("%s%s/%s", readmePrefix, packageName, version))
+}
+
+func makeChangelogKey(packageName, version string) []byte {
+	return []byte(fmt.Sprintf("%s%s/%s", changelogPrefix, packageName, version))
+}
+
+// Index keys end in a "/" separated package name, since package names may not
+// contain slashes but can share prefixes (e.g. http and http_parser).
+
+func makeNameIndexKey(packageName string) []byte {
+	return []byte(fmt.Sprintf("%s%s", nameIndexPrefix, packageName))
+}
+
+func makeUploaderIndexPrefix(email string) []byte {
+	return []byte(fmt.Sprintf("%s%s/", uploaderIndexPrefix, email))
+}
+
+func makeUploaderIndexKey(email, packageName string) []byte {
+	return append(makeUploaderIndexPrefix(email), packageName...)
+}
+
+func makeDependencyIndexPrefix(dependency string) []byte {
+	return []byte(fmt.Sprintf("%s%s/", dependencyIndexPrefix, dependency))
+}
+
+func makeDependencyIndexKey(dependency, packageName string) []byte {
+	return append(makeDependencyIndexPrefix(dependency), packageName...)
+}
+
+func makeSortIndexPrefix(sort string) []byte {
+	return []byte(fmt.Sprintf("%s%s_", sortIndexPrefix, sort))
+}
+
+// makeSortIndexKey returns a key which orders packages by descending value
+// when iterating forward.
+func makeSortIndexKey(sort string, value uint64, packageName string) []byte {
+	return []byte(fmt.Sprintf("%s%016x/%s", makeSortIndexPrefix(sort), math.MaxUint64-value, packageName))
+}
+
+func makeSearchIndexPrefix(term string) []byte {
+	return []byte(fmt.Sprintf("%s%s/", searchIndexPrefix, term))
+}
+
+func makeSearchIndexKey(term, packageName string) []byte {
+	return append(makeSearchIndexPrefix(term), packageName...)
+}
+
+func makeSearchDocKey(packageName string) []byte {
+	return []byte(fmt.Sprintf("%s%s", searchDocPrefix, packageName))
+}
+
+func makeVersionDownloadPrefix(packageName string) []byte {
+	return []byte(fmt.Sprintf("%s%s/", versionDownloadPrefix, packageName))
+}
+
+func makeVersionDownloadKey(packageName, version string) []byte {
+	return append(makeVersionDownloadPrefix(packageName), version...)
+}
+
+func makeDailyDownloadPrefix(packageName string) []byte {
+	return []byte(fmt.Sprintf("%s%s/", dailyDownloadPrefix, packageName))
+}
+
+func makeDailyDownloadKey(packageName, day, version string) []byte {
+	return []byte(fmt.Sprintf("%s%s/%s", makeDailyDownloadPrefix(packageName), day, version))
+}
+
+func makeAuditKey(id string) []byte {
+	return []byte(fmt.Sprintf("%s%s", auditPrefix, id))
+}
+
+func makeAdvisoryPrefix(packageName string) []byte {
+	return []byte(fmt.Sprintf("%s%s/", advisoryPrefix, packageName))
+}
+
+func makeAdvisoryKey(packageName, id string) []byte {
+	return append(makeAdvisoryPrefix(packageName), id...)
+}
+
+func makeTokenKey(id string) []byte {
+	return []byte(fmt.Sprintf("%s%s", tokenPrefix, id))
+}
+
+func makeUnlistedIndexKey(packageName string) []byte {
+	return []byte(fmt.Sprintf("%s%s", unlistedIndexPrefix, packageName))
+}
+
+func makePrivateIndexKey(packageName string) []byte {
+	return []byte(fmt.Sprintf("%s%s", privateIndexPrefix, packageName))
+}
+
+func makeReaderIndexPrefix(email string) []byte {
+	return []byte(fmt.Sprintf("%s%s/", readerIndexPrefix, email))
+}
+
+func makeReaderIndexKey(email, packageName string) []byte {
+	return append(makeReaderIndexPrefix(email), packageName...)
+}
+
+// makeExpiryIndexKey orders versions by the time they expire, in milliseconds.
+func makeExpiryIndexKey(expiresAt time.Time, packageName, version string) []byte {
+	return []byte(fmt.Sprintf("%s%016x/%s/%s", expiryIndexPrefix, uint64(expiresAt.UnixMilli()), packageName, version))
+}
+
+// indexKeys returns the secondary index keys which point to pkg.
+func indexKeys(pkg UnpubPackage) [][]byte {
+	keys := [][]byte{
+		makeSortIndexKey(SortDownload, uint64(pkg.Downloads), pkg.Name),
+		makeSortIndexKey(SortUpdated, uint64(pkg.UpdatedAt.UnixMilli()), pkg.Name),
+		makeSortIndexKey(SortCreated, uint64(pkg.CreatedAt.UnixMilli()), pkg.Name),
+	}
+	for _, email := range pkg.Uploaders {
+		keys = append(keys, makeUploaderIndexKey(email, pkg.Name))
+	}
+	for _, dep := range pkg.DependencyNames() {
+		keys = append(keys, makeDependencyIndexKey(dep, pkg.Name))
+	}
+	for _, email := range pkg.Readers {
+		keys = append(keys, makeReaderIndexKey(email, pkg.Name))
+	}
+	if pkg.IsUnlisted {
+		keys = append(keys, makeUnlistedIndexKey(pkg.Name))
+	}
+	if pkg.Private {
+		keys = append(keys, makePrivateIndexKey(pkg.Name))
+	}
+	if !pkg.IsUnlisted && !pkg.Private {
+		keys = append(keys, makeNameIndexKey(pkg.Name))
+	}
+	for _, v := range pkg.Versions {
+		if v.ExpiresAt != nil {
+			keys = append(keys, makeExpiryIndexKey(*v.ExpiresAt, pkg.Name, v.Version))
+		}
+	}
+	return keys
 }
 
 func (db *UnpubLocalDb) Close() error {
@@ -83,127 +353,908 @@ func (db *UnpubLocalDb) Close() error {
 
 func (db *UnpubLocalDb) QueryPackage(name string) (pkg UnpubPackage, err error) {
 	err = db.db.View(func(txn *badger.Txn) error {
-		key := makePackageKey(name)
-		item, err := txn.Get(key)
+		pkg, err = getPackage(txn, name)
+		return err
+	})
+	return
+}
+
+// packageHeader is the record stored under a package key. Each version is
+// stored under its own key, and their READMEs and changelogs under separate
+// keys again, so that updating a package does not rewrite all of its versions.
+type packageHeader struct {
+	Name      string    `json:"name"`
+	Latest    string    `json:"latest"`
+	Private   bool      `json:"private"`
+	Uploaders []string  `json:"uploaders"`
+	Downloads int       `json:"download"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	IsDiscontinued bool   `json:"isDiscontinued,omitempty"`
+	ReplacedBy     string `json:"replacedBy,omitempty"`
+	IsUnlisted     bool   `json:"isUnlisted,omitempty"`
+
+	TrustPolicies []TrustPolicy `json:"trustPolicies,omitempty"`
+	Readers       []string      `json:"readers,omitempty"`
+}
+
+// getPackageHeader returns a package without its versions.
+func getPackageHeader(txn *badger.Txn, name string) (pkg UnpubPackage, err error) {
+	item, err := txn.Get(makePackageKey(name))
+	if err != nil {
+		return
+	}
+	var header packageHeader
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &header)
+	})
+	pkg = UnpubPackage{
+		Name:      header.Name,
+		Latest:    header.Latest,
+		Private:   header.Private,
+		Uploaders: header.Uploaders,
+		Downloads: header.Downloads,
+		CreatedAt: header.CreatedAt,
+		UpdatedAt: header.UpdatedAt,
+		Versions:  make(map[string]UnpubVersion),
+
+		IsDiscontinued: header.IsDiscontinued,
+		ReplacedBy:     header.ReplacedBy,
+		IsUnlisted:     header.IsUnlisted,
+
+		TrustPolicies: header.TrustPolicies,
+		Readers:       header.Readers,
+	}
+	return
+}
+
+func savePackageHeader(txn *badger.Txn, pkg UnpubPackage) error {
+	b, err := json.Marshal(packageHeader{
+		Name:      pkg.Name,
+		Latest:    pkg.Latest,
+		Private:   pkg.Private,
+		Uploaders: pkg.Uploaders,
+		Downloads: pkg.Downloads,
+		CreatedAt: pkg.CreatedAt,
+		UpdatedAt: pkg.UpdatedAt,
+
+		IsDiscontinued: pkg.IsDiscontinued,
+		ReplacedBy:     pkg.ReplacedBy,
+		IsUnlisted:     pkg.IsUnlisted,
+
+		TrustPolicies: pkg.TrustPolicies,
+		Readers:       pkg.Readers,
+	})
+	if err != nil {
+		return err
+	}
+	return txn.Set(makePackageKey(pkg.Name), b)
+}
+
+// getPackage returns a package and its versions, without READMEs and
+// changelogs.
+func getPackage(txn *badger.Txn, name string) (UnpubPackage, error) {
+	pkg, err := getPackageHeader(txn, name)
+	if err != nil {
+		return pkg, err
+	}
+	prefix := makeVersionPrefix(name)
+	it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		var v UnpubVersion
+		err := it.Item().Value(func(val []byte) error {
+			return json.Unmarshal(val, &v)
+		})
+		if err != nil {
+			return pkg, err
+		}
+		pkg.Versions[v.Version] = v
+	}
+	return pkg, nil
+}
+
+func (db *UnpubLocalDb) QueryVersion(name, version string) (v UnpubVersion, err error) {
+	err = db.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(makeVersionKey(name, version))
 		if err != nil {
 			return err
 		}
-		return item.Value(func(val []byte) error {
-			return json.Unmarshal(val, &pkg)
+		err = item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &v)
 		})
+		if err != nil {
+			return err
+		}
+		if v.Readme, err = getText(txn, makeReadmeKey(name, version)); err != nil {
+			return err
+		}
+		v.Changelog, err = getText(txn, makeChangelogKey(name, version))
+		return err
 	})
 	return
 }
 
-func (db *UnpubLocalDb) QueryPackages(query UnpubDbQuery) (*UnpubQueryResult, error) {
-	var packages []*UnpubPackage
-	err := db.db.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
-
-		prefix := []byte(packagePrefix)
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			item := it.Item()
-			key := strings.TrimPrefix(string(item.Key()), packagePrefix)
-			if query.Keyword == "" || strings.Contains(key, query.Keyword) {
-				var pkg UnpubPackage
-				err := item.Value(func(val []byte) error {
-					return json.Unmarshal(val, &pkg)
-				})
-				if err != nil {
+// ExportPackages reads every package in one transaction, which sees a snapshot
+// of the DB and does not block writers.
+func (db *UnpubLocalDb) ExportPackages(fn func(pkg UnpubPackage) error) error {
+	return db.db.View(func(txn *badger.Txn) error {
+		var names []string
+		iterateKeys(txn, []byte(packagePrefix), func(name string) {
+			names = append(names, name)
+		})
+		for _, name := range names {
+			pkg, err := getPackage(txn, name)
+			if err != nil {
+				return err
+			}
+			for version, v := range pkg.Versions {
+				if v.Readme, err = getText(txn, makeReadmeKey(name, version)); err != nil {
+					return err
+				}
+				if v.Changelog, err = getText(txn, makeChangelogKey(name, version)); err != nil {
 					return err
 				}
-				packages = append(packages, &pkg)
+				pkg.Versions[version] = v
+			}
+			if err := fn(pkg); err != nil {
+				return err
 			}
 		}
+		return nil
+	})
+}
 
+// getText returns the string stored at key, or nil if there is none.
+func getText(txn *badger.Txn, key []byte) (*string, error) {
+	item, err := txn.Get(key)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	text := string(b)
+	return &text, nil
+}
+
+func (db *UnpubLocalDb) QueryPackages(query UnpubDbQuery) (*UnpubQueryResult, error) {
+	var packages []*UnpubPackage
+	var count int
+	snippets := make(map[string]string)
+	err := db.db.View(func(txn *badger.Txn) error {
+		names, err := queryPackageNames(txn, query)
+		if err != nil {
+			return err
+		}
+		count = len(names)
+		terms := queryTerms(query.Keyword)
+		for _, name := range paginate(names, query.Page, query.Size) {
+			pkg, err := getPackage(txn, name)
+			if err != nil {
+				return err
+			}
+			packages = append(packages, &pkg)
+			if len(terms) == 0 {
+				continue
+			}
+			doc, err := getSearchDocument(txn, name)
+			if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+				return err
+			}
+			if snippet := doc.snippet(terms); snippet != "" {
+				snippets[name] = snippet
+			}
+		}
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
 	return &UnpubQueryResult{
-		Count:    len(packages),
+		Count:    count,
 		Packages: packages,
+		Snippets: snippets,
 	}, nil
 }
 
+// queryPackageNames returns the names of all packages matching query in the
+// requested sort order. Filters come from the uploader, dependency, search,
+// unlisted, private and reader indexes, and the order from the sort indexes or
+// the search ranking.
+func queryPackageNames(txn *badger.Txn, query UnpubDbQuery) ([]string, error) {
+	var filterPrefix []byte
+	switch {
+	case query.Uploader != "":
+		filterPrefix = makeUploaderIndexPrefix(query.Uploader)
+	case query.Dependency != "":
+		filterPrefix = makeDependencyIndexPrefix(query.Dependency)
+	}
+	var filter map[string]bool
+	if filterPrefix != nil {
+		filter = make(map[string]bool)
+		iterateKeys(txn, filterPrefix, func(key string) {
+			filter[key] = true
+		})
+	}
+	var unlisted map[string]bool
+	if !query.IncludeUnlisted {
+		unlisted = make(map[string]bool)
+		iterateKeys(txn, []byte(unlistedIndexPrefix), func(key string) {
+			unlisted[key] = true
+		})
+	}
+	var private map[string]bool
+	if !query.IncludePrivate {
+		private = make(map[string]bool)
+		iterateKeys(txn, []byte(privateIndexPrefix), func(key string) {
+			private[key] = true
+		})
+		if query.Reader != "" {
+			for _, prefix := range [][]byte{makeUploaderIndexPrefix(query.Reader), makeReaderIndexPrefix(query.Reader)} {
+				iterateKeys(txn, prefix, func(key string) {
+					delete(private, key)
+				})
+			}
+		}
+		if query.Trusted != nil {
+			// Only the private packages are checked, by their headers.
+			for name := range private {
+				pkg, err := getPackageHeader(txn, name)
+				if err != nil {
+					return nil, err
+				}
+				if pkg.Trusts(*query.Trusted) {
+					delete(private, name)
+				}
+			}
+		}
+	}
+	include := func(name string) bool {
+		return (filter == nil || filter[name]) && !unlisted[name] && !private[name]
+	}
+
+	if query.Keyword != "" {
+		hits, err := searchPackages(txn, query.Keyword)
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		matches := make(map[string]bool)
+		for _, hit := range hits {
+			if include(hit.Package) {
+				names = append(names, hit.Package)
+				matches[hit.Package] = true
+			}
+		}
+		if query.Sort == SortRelevance {
+			return names, nil
+		}
+		filter = matches
+	}
+
+	sortBy := query.Sort
+	if sortBy == "" || sortBy == SortRelevance {
+		sortBy = SortDownload
+	}
+	var prefix []byte
+	switch sortBy {
+	case SortName:
+		prefix = []byte(packagePrefix)
+	case SortDownload, SortUpdated, SortCreated:
+		prefix = makeSortIndexPrefix(sortBy)
+	default:
+		return nil, fmt.Errorf("unknown sort: %s", query.Sort)
+	}
+
+	var names []string
+	iterateKeys(txn, prefix, func(key string) {
+		name := key
+		if i := strings.LastIndexByte(key, '/'); i >= 0 {
+			name = key[i+1:]
+		}
+		if include(name) {
+			names = append(names, name)
+		}
+	})
+	return names, nil
+}
+
+// searchPackages ranks every package against keyword using the search index.
+func searchPackages(txn *badger.Txn, keyword string) ([]searchHit, error) {
+	var names []string
+	iterateKeys(txn, []byte(packagePrefix), func(name string) {
+		names = append(names, name)
+	})
+
+	terms := queryTerms(keyword)
+	postings := make(map[string][]searchPosting)
+	for _, term := range terms {
+		prefix := makeSearchIndexPrefix(term)
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			var weight float64
+			err := item.Value(func(val []byte) error {
+				weight = math.Float64frombits(binary.BigEndian.Uint64(val))
+				return nil
+			})
+			if err != nil {
+				it.Close()
+				return nil, err
+			}
+			postings[term] = append(postings[term], searchPosting{
+				Package: string(item.Key()[len(prefix):]),
+				Weight:  weight,
+			})
+		}
+		it.Close()
+	}
+	return rankSearch(keyword, terms, postings, names), nil
+}
+
+// iterateKeys calls fn with the remainder of every key starting with prefix.
+func iterateKeys(txn *badger.Txn, prefix []byte, fn func(key string)) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = prefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		fn(string(it.Item().Key()[len(prefix):]))
+	}
+}
+
+// paginate returns the page of names selected by page and size.
+func paginate(names []string, page, size int) []string {
+	if size <= 0 {
+		return names
+	}
+	start := page * size
+	if page < 0 || start >= len(names) {
+		return nil
+	}
+	end := start + size
+	if end > len(names) {
+		end = len(names)
+	}
+	return names[start:end]
+}
+
 func (db *UnpubLocalDb) SavePackage(pkg UnpubPackage) (err error) {
 	return db.db.Update(func(txn *badger.Txn) error {
-		b, err := json.Marshal(pkg)
+		return savePackage(txn, pkg)
+	})
+}
+
+// savePackage writes pkg and brings its secondary index entries up to date.
+func savePackage(txn *badger.Txn, pkg UnpubPackage) error {
+	prev, err := getPackage(txn, pkg.Name)
+	switch {
+	case err == nil:
+		for _, key := range indexKeys(prev) {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+	case !errors.Is(err, badger.ErrKeyNotFound):
+		return err
+	}
+
+	if err := savePackageHeader(txn, pkg); err != nil {
+		return err
+	}
+	for _, v := range pkg.Versions {
+		prevVersion, exists := prev.Versions[v.Version]
+		if err := saveVersion(txn, pkg.Name, v, prevVersion, exists); err != nil {
+			return err
+		}
+	}
+	for version := range prev.Versions {
+		if _, ok := pkg.Versions[version]; ok {
+			continue
+		}
+		for _, key := range [][]byte{
+			makeVersionKey(pkg.Name, version),
+			makeReadmeKey(pkg.Name, version),
+			makeChangelogKey(pkg.Name, version),
+		} {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	for _, key := range indexKeys(pkg) {
+		if err := txn.Set(key, nil); err != nil {
+			return err
+		}
+	}
+	return indexSearchDocument(txn, pkg)
+}
+
+// saveVersion writes v unless it is unchanged from prev. A nil README or
+// changelog means it was not loaded, and leaves the stored one in place.
+func saveVersion(txn *badger.Txn, name string, v, prev UnpubVersion, exists bool) error {
+	readme, changelog := v.Readme, v.Changelog
+	v.Readme, v.Changelog = nil, nil
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	changed := !exists
+	if exists {
+		prevB, err := json.Marshal(prev)
 		if err != nil {
 			return err
 		}
-		return txn.Set(makePackageKey(pkg.Name), b)
+		changed = !bytes.Equal(b, prevB)
+	}
+	if changed {
+		if err := txn.Set(makeVersionKey(name, v.Version), b); err != nil {
+			return err
+		}
+	}
+	if readme != nil {
+		if err := txn.Set(makeReadmeKey(name, v.Version), []byte(*readme)); err != nil {
+			return err
+		}
+	}
+	if changelog != nil {
+		if err := txn.Set(makeChangelogKey(name, v.Version), []byte(*changelog)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getSearchDocument(txn *badger.Txn, name string) (doc searchDocument, err error) {
+	item, err := txn.Get(makeSearchDocKey(name))
+	if err != nil {
+		return
+	}
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &doc)
 	})
+	return
 }
 
-func (db *UnpubLocalDb) AddUploader(name, email string) error {
-	pkg, err := db.QueryPackage(name)
+// indexSearchDocument updates the search index when the latest version of pkg
+// has changed since it was last indexed.
+func indexSearchDocument(txn *badger.Txn, pkg UnpubPackage) error {
+	prev, err := getSearchDocument(txn, pkg.Name)
+	switch {
+	case err == nil:
+		if prev.Version == pkg.Latest {
+			return nil
+		}
+		for term := range prev.Terms {
+			if err := txn.Delete(makeSearchIndexKey(term, pkg.Name)); err != nil {
+				return err
+			}
+		}
+	case !errors.Is(err, badger.ErrKeyNotFound):
+		return err
+	}
+
+	latest := pkg.LatestVersion()
+	if latest.Readme == nil {
+		if latest.Readme, err = getText(txn, makeReadmeKey(pkg.Name, latest.Version)); err != nil {
+			return err
+		}
+	}
+	doc := newSearchDocument(pkg.Name, latest)
+	b, err := json.Marshal(doc)
 	if err != nil {
 		return err
 	}
-	var contains bool
-	for _, uploader := range pkg.Uploaders {
-		if uploader == email {
-			contains = true
+	if err := txn.Set(makeSearchDocKey(pkg.Name), b); err != nil {
+		return err
+	}
+	for term, weight := range doc.Terms {
+		val := make([]byte, 8)
+		binary.BigEndian.PutUint64(val, math.Float64bits(weight))
+		if err := txn.Set(makeSearchIndexKey(term, pkg.Name), val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// update runs fn in a read-write transaction, retrying it for as long as it
+// conflicts with a concurrent transaction.
+func (db *UnpubLocalDb) update(fn func(txn *badger.Txn) error) error {
+	for {
+		err := db.db.Update(fn)
+		if !errors.Is(err, badger.ErrConflict) {
+			return err
 		}
 	}
-	if !contains {
-		pkg.Uploaders = append(pkg.Uploaders, email)
-		return db.SavePackage(pkg)
-	} else {
-		return errors.New("uploader already exists")
+}
+
+func (db *UnpubLocalDb) UpdatePackage(name string, fn PackageUpdate) error {
+	return db.update(func(txn *badger.Txn) error {
+		return updatePackage(txn, name, fn)
+	})
+}
+
+func updatePackage(txn *badger.Txn, name string, fn PackageUpdate) error {
+	pkg, err := getPackage(txn, name)
+	exists := err == nil
+	if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+		return err
+	}
+	if err := fn(&pkg, exists); err != nil {
+		return err
 	}
+	if exists && len(pkg.Versions) == 0 {
+		return deletePackage(txn, name)
+	}
+	return savePackage(txn, pkg)
+}
+
+func (db *UnpubLocalDb) AddUploader(name, email string) error {
+	return db.UpdatePackage(name, func(pkg *UnpubPackage, exists bool) error {
+		if !exists {
+			return ErrNotFound
+		}
+		for _, uploader := range pkg.Uploaders {
+			if uploader == email {
+				return errors.New("uploader already exists")
+			}
+		}
+		pkg.Uploaders = append(pkg.Uploaders, email)
+		return nil
+	})
 }
 
 func (db *UnpubLocalDb) RemoveUploader(name, email string) error {
-	pkg, err := db.QueryPackage(name)
+	return db.UpdatePackage(name, func(pkg *UnpubPackage, exists bool) error {
+		if !exists {
+			return ErrNotFound
+		}
+		var newUploaders []string
+		for _, uploader := range pkg.Uploaders {
+			if uploader != email {
+				newUploaders = append(newUploaders, uploader)
+			}
+		}
+		if len(newUploaders) == len(pkg.Uploaders) {
+			return errors.New("uploader does not exist")
+		}
+		pkg.Uploaders = newUploaders
+		return nil
+	})
+}
+
+func (db *UnpubLocalDb) IncreaseDownloads(name, version string) error {
+	day := DownloadDay(time.Now())
+	return db.update(func(txn *badger.Txn) error {
+		// Only the header and download sort index change, so the versions are
+		// neither read nor written.
+		pkg, err := getPackageHeader(txn, name)
+		if err != nil {
+			return err
+		}
+		if err := txn.Delete(makeSortIndexKey(SortDownload, uint64(pkg.Downloads), name)); err != nil {
+			return err
+		}
+		pkg.Downloads++
+		if err := txn.Set(makeSortIndexKey(SortDownload, uint64(pkg.Downloads), name), nil); err != nil {
+			return err
+		}
+		if err := savePackageHeader(txn, pkg); err != nil {
+			return err
+		}
+		if err := incrementCounter(txn, makeVersionDownloadKey(name, version)); err != nil {
+			return err
+		}
+		return incrementCounter(txn, makeDailyDownloadKey(name, day, version))
+	})
+}
+
+func (db *UnpubLocalDb) QueryDownloads(name string, since time.Time) (*DownloadStats, error) {
+	stats := &DownloadStats{
+		Versions: make(map[string]int),
+	}
+	err := db.db.View(func(txn *badger.Txn) error {
+		prefix := makeVersionDownloadPrefix(name)
+		err := iterateCounters(txn, prefix, prefix, func(key string, count uint64) {
+			stats.Versions[key] = int(count)
+		})
+		if err != nil {
+			return err
+		}
+
+		prefix = makeDailyDownloadPrefix(name)
+		start := append(prefix, DownloadDay(since)...)
+		return iterateCounters(txn, prefix, start, func(key string, count uint64) {
+			day, version, _ := strings.Cut(key, "/")
+			stats.Daily = append(stats.Daily, DailyDownloads{
+				Day:     day,
+				Version: version,
+				Count:   int(count),
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (db *UnpubLocalDb) DeletePackage(name string) error {
+	return db.update(func(txn *badger.Txn) error {
+		return deletePackage(txn, name)
+	})
+}
+
+// deletePackage deletes every key belonging to the named package.
+func deletePackage(txn *badger.Txn, name string) error {
+	pkg, err := getPackage(txn, name)
 	if err != nil {
 		return err
 	}
-	var newUploaders []string
-	for _, uploader := range pkg.Uploaders {
-		if uploader != email {
-			newUploaders = append(newUploaders, email)
+	keys := append(indexKeys(pkg), makePackageKey(name), makeSearchDocKey(name))
+	for version := range pkg.Versions {
+		keys = append(keys,
+			makeVersionKey(name, version),
+			makeReadmeKey(name, version),
+			makeChangelogKey(name, version),
+		)
+	}
+	doc, err := getSearchDocument(txn, name)
+	switch {
+	case err == nil:
+		for term := range doc.Terms {
+			keys = append(keys, makeSearchIndexKey(term, name))
 		}
+	case !errors.Is(err, badger.ErrKeyNotFound):
+		return err
 	}
-	if len(newUploaders) == len(pkg.Uploaders) {
-		return errors.New("uploader does not exist")
+	for _, prefix := range [][]byte{makeVersionDownloadPrefix(name), makeDailyDownloadPrefix(name), makeAdvisoryPrefix(name)} {
+		iterateKeys(txn, prefix, func(key string) {
+			keys = append(keys, append(append([]byte(nil), prefix...), key...))
+		})
 	}
-	return db.SavePackage(pkg)
+	for _, key := range keys {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (db *UnpubLocalDb) IncreaseDownloads(name, version string) error {
-	pkg, err := db.QueryPackage(name)
+func (db *UnpubLocalDb) QueryExpiredPackages(now time.Time) ([]string, error) {
+	var names []string
+	err := db.db.View(func(txn *badger.Txn) error {
+		end := fmt.Sprintf("%016x", uint64(now.UnixMilli()))
+		seen := make(map[string]bool)
+		prefix := []byte(expiryIndexPrefix)
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		// Keys are ordered by expiry, so the scan stops at the first one
+		// which has not expired.
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := string(it.Item().Key()[len(prefix):])
+			expiresAt, rest, _ := strings.Cut(key, "/")
+			if expiresAt > end {
+				break
+			}
+			name, _, _ := strings.Cut(rest, "/")
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		return nil
+	})
+	return names, err
+}
+
+func (db *UnpubLocalDb) RecordAudit(event AuditEvent) error {
+	event, err := prepareAuditEvent(event)
 	if err != nil {
 		return err
 	}
-	pkg.Downloads++
-	return db.SavePackage(pkg)
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return db.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(makeAuditKey(event.ID), b)
+	})
 }
 
-func (db *UnpubLocalDb) SaveFile(pkgName, version string, data []byte) error {
+// QueryAudit scans the events backwards from the cursor, which is cheap for
+// the recent events usually asked for.
+func (db *UnpubLocalDb) QueryAudit(query AuditQuery) (*AuditResult, error) {
+	limit := query.limit()
+	result := &AuditResult{Events: []AuditEvent{}}
+	err := db.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = true
+		opts.Prefix = []byte(auditPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		// Reverse iteration starts at the last key <= the seek key.
+		start := append([]byte(auditPrefix), 0xff)
+		if query.Cursor != "" {
+			start = makeAuditKey(query.Cursor)
+		}
+		for it.Seek(start); it.ValidForPrefix(opts.Prefix); it.Next() {
+			var event AuditEvent
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &event)
+			})
+			if err != nil {
+				return err
+			}
+			if event.ID == query.Cursor {
+				continue
+			}
+			if !query.Since.IsZero() && event.Time.Before(query.Since) {
+				break
+			}
+			if !event.Matches(query) {
+				continue
+			}
+			if len(result.Events) == limit {
+				result.NextCursor = result.Events[limit-1].ID
+				break
+			}
+			result.Events = append(result.Events, event)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// QueryPackageNames reads the name index, which holds no values, so no
+// package records have to be decoded.
+func (db *UnpubLocalDb) QueryPackageNames() ([]string, error) {
+	var names []string
+	err := db.db.View(func(txn *badger.Txn) error {
+		iterateKeys(txn, []byte(nameIndexPrefix), func(key string) {
+			names = append(names, key)
+		})
+		return nil
+	})
+	return names, err
+}
+
+func (db *UnpubLocalDb) SaveAdvisory(advisory Advisory) error {
+	b, err := json.Marshal(advisory)
+	if err != nil {
+		return err
+	}
 	return db.db.Update(func(txn *badger.Txn) error {
-		return txn.Set(makeFileKey(pkgName, version), data)
+		return txn.Set(makeAdvisoryKey(advisory.Package, advisory.ID), b)
 	})
 }
 
-func (db *UnpubLocalDb) GetFile(pkgName, version string) (io.Reader, error) {
-	var data []byte
+func (db *UnpubLocalDb) QueryAdvisories(name string) ([]Advisory, error) {
+	advisories := []Advisory{}
 	err := db.db.View(func(txn *badger.Txn) error {
-		key := makeFileKey(pkgName, version)
-		item, err := txn.Get(key)
+		prefix := makeAdvisoryPrefix(name)
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			var advisory Advisory
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &advisory)
+			})
+			if err != nil {
+				return err
+			}
+			advisories = append(advisories, advisory)
+		}
+		return nil
+	})
+	return advisories, err
+}
+
+func (db *UnpubLocalDb) SaveToken(token Token) error {
+	b, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return db.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(makeTokenKey(token.ID), b)
+	})
+}
+
+func (db *UnpubLocalDb) QueryToken(id string) (token Token, err error) {
+	err = db.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(makeTokenKey(id))
 		if err != nil {
 			return err
 		}
-		data, err = item.ValueCopy(nil)
-		return err
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &token)
+		})
 	})
-	if err != nil {
-		return nil, err
+	return
+}
+
+func (db *UnpubLocalDb) QueryTokens() ([]Token, error) {
+	tokens := []Token{}
+	err := db.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: []byte(tokenPrefix)})
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			var token Token
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &token)
+			})
+			if err != nil {
+				return err
+			}
+			tokens = append(tokens, token)
+		}
+		return nil
+	})
+	return tokens, err
+}
+
+func (db *UnpubLocalDb) DeleteToken(id string) error {
+	return db.db.Update(func(txn *badger.Txn) error {
+		if _, err := txn.Get(makeTokenKey(id)); err != nil {
+			return err
+		}
+		return txn.Delete(makeTokenKey(id))
+	})
+}
+
+// incrementCounter adds one to the big-endian counter stored at key.
+func incrementCounter(txn *badger.Txn, key []byte) error {
+	var count uint64
+	item, err := txn.Get(key)
+	switch {
+	case err == nil:
+		err = item.Value(func(val []byte) error {
+			count = binary.BigEndian.Uint64(val)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	case !errors.Is(err, badger.ErrKeyNotFound):
+		return err
+	}
+	val := make([]byte, 8)
+	binary.BigEndian.PutUint64(val, count+1)
+	return txn.Set(key, val)
+}
+
+// iterateCounters calls fn with the remainder and value of every counter key
+// starting with prefix, beginning at start.
+func iterateCounters(txn *badger.Txn, prefix, start []byte, fn func(key string, count uint64)) error {
+	it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+	defer it.Close()
+
+	for it.Seek(start); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		err := item.Value(func(val []byte) error {
+			fn(string(item.Key()[len(prefix):]), binary.BigEndian.Uint64(val))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
 	}
-	return bytes.NewReader(data), err
+	return nil
 }
 
 // Interface guard
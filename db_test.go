@@ -2,7 +2,9 @@ package unpub
 
 import (
 	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/require"
@@ -13,29 +15,933 @@ var (
 	packageName = "my_pkg"
 )
 
+// testDBs returns an in-memory instance of every UnpubDb implementation.
+func testDBs(t *testing.T) map[string]UnpubDb {
+	localDb, err := NewUnpubLocalDb(true, "")
+	require.NoError(t, err)
+	sqlDb, err := NewUnpubSQLDb(true, "")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		localDb.Close()
+		sqlDb.Close()
+	})
+	return map[string]UnpubDb{
+		"badger": localDb,
+		"sqlite": sqlDb,
+	}
+}
+
 func TestDB(t *testing.T) {
-	require := require.New(t)
-	db, err := NewUnpubLocalDb(true, "")
-	require.NoError(err)
-	require.NotNil(db)
-
-	pkg := NewPackage(
-		packageName,
-		false,
-		[]string{uploader},
-	)
-	pkg.CreateVersion(
-		"0.0.1",
-		fmt.Sprintf(`
+	for name, db := range testDBs(t) {
+		db := db
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+
+			pkg := NewPackage(
+				packageName,
+				false,
+				[]string{uploader},
+			)
+			pkg.CreateVersion(
+				"0.0.1",
+				fmt.Sprintf(`
 name: %s
 version: 0.0.1
 description: My package`, packageName),
+				nil, nil, nil,
+			)
+			err := db.SavePackage(pkg)
+			require.NoError(err)
+
+			getPkg, err := db.QueryPackage(packageName)
+			require.NoError(err)
+			require.Truef(cmp.Equal(pkg, getPkg), "Want: %+v\nGot: %+v", pkg, getPkg)
+
+			_, err = db.QueryPackage("missing")
+			require.ErrorIs(err, ErrNotFound)
+		})
+	}
+}
+
+// saveTestPackage creates and saves a package with a single version.
+func saveTestPackage(t *testing.T, db UnpubDb, name, version string, uploaders []string, pubspec string) UnpubPackage {
+	pkg := NewPackage(name, false, uploaders)
+	_, err := pkg.CreateVersion(
+		version,
+		fmt.Sprintf("name: %s\nversion: %s\n%s", name, version, pubspec),
 		nil, nil, nil,
 	)
-	err = db.SavePackage(pkg)
-	require.NoError(err)
+	require.NoError(t, err)
+	require.NoError(t, db.SavePackage(pkg))
+	return pkg
+}
+
+func packageNames(result *UnpubQueryResult) []string {
+	names := []string{}
+	for _, pkg := range result.Packages {
+		names = append(names, pkg.Name)
+	}
+	return names
+}
+
+func TestDBQueryPackagesIndexes(t *testing.T) {
+	for name, db := range testDBs(t) {
+		db := db
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+
+			saveTestPackage(t, db, "http", "1.0.0", []string{"a@example.com"}, "")
+			saveTestPackage(t, db, "http_parser", "1.0.0", []string{"a@example.com", "b@example.com"}, `
+dependencies:
+  http: ^1.0.0`)
+			saveTestPackage(t, db, "client", "1.0.0", []string{"b@example.com"}, `
+dependencies:
+  http_parser: ^1.0.0
+dev_dependencies:
+  http: ^1.0.0`)
+
+			query := func(q UnpubDbQuery) []string {
+				result, err := db.QueryPackages(q)
+				require.NoError(err)
+				require.Equal(len(result.Packages), result.Count)
+				return packageNames(result)
+			}
+
+			require.Equal([]string{"http", "http_parser"}, query(UnpubDbQuery{Uploader: "a@example.com"}))
+			require.Equal([]string{"client", "http_parser"}, query(UnpubDbQuery{Uploader: "b@example.com"}))
+			require.Equal([]string{"http_parser"}, query(UnpubDbQuery{Dependency: "http"}))
+			require.Equal([]string{"client"}, query(UnpubDbQuery{Dependency: "http_parser"}))
+			require.Equal([]string{}, query(UnpubDbQuery{Uploader: "c@example.com"}))
+
+			// Index entries follow uploader changes and new versions.
+			require.NoError(db.RemoveUploader("http_parser", "a@example.com"))
+			require.NoError(db.AddUploader("client", "a@example.com"))
+			require.Equal([]string{"client", "http"}, query(UnpubDbQuery{Uploader: "a@example.com"}))
+
+			pkg, err := db.QueryPackage("http_parser")
+			require.NoError(err)
+			require.Equal([]string{"b@example.com"}, pkg.Uploaders)
+			_, err = pkg.CreateVersion("2.0.0", "name: http_parser\nversion: 2.0.0", nil, nil, nil)
+			require.NoError(err)
+			require.NoError(db.SavePackage(pkg))
+			require.Equal([]string{}, query(UnpubDbQuery{Dependency: "http"}))
+		})
+	}
+}
+
+func TestDBQueryPackagesSortAndPage(t *testing.T) {
+	for name, db := range testDBs(t) {
+		db := db
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+
+			created := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+			for i, pkgName := range []string{"beta", "alpha", "alphabet", "gamma"} {
+				pkg := NewPackage(pkgName, false, []string{uploader})
+				_, err := pkg.CreateVersion("1.0.0", "name: "+pkgName+"\nversion: 1.0.0", nil, nil, nil)
+				require.NoError(err)
+				pkg.CreatedAt = created.Add(time.Duration(i) * time.Hour)
+				pkg.UpdatedAt = created.Add(time.Duration(10-i) * time.Hour)
+				require.NoError(db.SavePackage(pkg))
+			}
+			for pkgName, downloads := range map[string]int{"gamma": 3, "alpha": 2, "alphabet": 1} {
+				for i := 0; i < downloads; i++ {
+					require.NoError(db.IncreaseDownloads(pkgName, "1.0.0"))
+				}
+			}
+
+			query := func(q UnpubDbQuery) ([]string, int) {
+				result, err := db.QueryPackages(q)
+				require.NoError(err)
+				return packageNames(result), result.Count
+			}
+
+			names, count := query(UnpubDbQuery{})
+			require.Equal([]string{"gamma", "alpha", "alphabet", "beta"}, names)
+			require.Equal(4, count)
+
+			names, _ = query(UnpubDbQuery{Sort: SortName})
+			require.Equal([]string{"alpha", "alphabet", "beta", "gamma"}, names)
+			names, _ = query(UnpubDbQuery{Sort: SortCreated})
+			require.Equal([]string{"gamma", "alphabet", "alpha", "beta"}, names)
+			names, _ = query(UnpubDbQuery{Sort: SortUpdated})
+			require.Equal([]string{"beta", "alpha", "alphabet", "gamma"}, names)
+			names, _ = query(UnpubDbQuery{Sort: SortRelevance, Keyword: "alphabet"})
+			require.Equal([]string{"alphabet"}, names)
+			names, _ = query(UnpubDbQuery{Sort: SortRelevance, Keyword: "a"})
+			require.Equal([]string{"alpha", "alphabet", "beta", "gamma"}, names)
+
+			names, count = query(UnpubDbQuery{Sort: SortName, Size: 3, Page: 1})
+			require.Equal([]string{"gamma"}, names)
+			require.Equal(4, count)
+			names, count = query(UnpubDbQuery{Sort: SortName, Size: 1, Page: 1, Keyword: "alpha"})
+			require.Equal([]string{"alphabet"}, names)
+			require.Equal(2, count)
+			names, count = query(UnpubDbQuery{Size: 2, Page: 5})
+			require.Equal([]string{}, names)
+			require.Equal(4, count)
+
+			_, err := db.QueryPackages(UnpubDbQuery{Sort: "popularity"})
+			require.Error(err)
+		})
+	}
+}
+
+func TestDBQueryPackagesSearch(t *testing.T) {
+	for name, db := range testDBs(t) {
+		db := db
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+
+			saveTestPackage(t, db, "auth_kit", "1.0.0", []string{uploader}, `
+description: OAuth and OpenID Connect flows for internal services.
+repository: https://github.com/example/auth_kit`)
+			saveTestPackage(t, db, "log_sink", "1.0.0", []string{uploader}, `
+description: Structured logging for servers.`)
+
+			pkg := NewPackage("oauth", false, []string{uploader})
+			readme := "# oauth\n\nLow level primitives. See [auth_kit](https://example.com) for complete OAuth logins."
+			_, err := pkg.CreateVersion("1.0.0", "name: oauth\nversion: 1.0.0\ndescription: Token helpers.", nil, &readme, nil)
+			require.NoError(err)
+			require.NoError(db.SavePackage(pkg))
+
+			search := func(keyword string) *UnpubQueryResult {
+				result, err := db.QueryPackages(UnpubDbQuery{Keyword: keyword, Sort: SortRelevance})
+				require.NoError(err)
+				require.Equal(len(result.Packages), result.Count)
+				return result
+			}
+
+			result := search("oauth")
+			require.Equal([]string{"oauth", "auth_kit"}, packageNames(result))
+			require.Equal("OAuth and OpenID Connect flows for internal services.", result.Snippets["auth_kit"])
+			require.Equal("oauth Low level primitives. See auth_kit for complete OAuth logins.", result.Snippets["oauth"])
+
+			result = search("logs")
+			require.Equal([]string{"log_sink"}, packageNames(result))
+			require.Equal("Structured logging for servers.", result.Snippets["log_sink"])
+
+			require.Equal([]string{"auth_kit"}, packageNames(search("openid services")))
+			require.Equal([]string{"auth_kit"}, packageNames(search("github example")))
+			require.Equal([]string{}, packageNames(search("openid logging")))
+			require.Equal([]string{"auth_kit", "oauth"}, packageNames(search("auth")))
+
+			// Reindexing follows the latest version.
+			pkg, err = db.QueryPackage("log_sink")
+			require.NoError(err)
+			_, err = pkg.CreateVersion("2.0.0", "name: log_sink\nversion: 2.0.0\ndescription: Metrics exporter.", nil, nil, nil)
+			require.NoError(err)
+			require.NoError(db.SavePackage(pkg))
+			require.Equal([]string{}, packageNames(search("structured")))
+			require.Equal([]string{"log_sink"}, packageNames(search("metric")))
+		})
+	}
+}
+
+func TestDBQueryPackagesDuringDelete(t *testing.T) {
+	for name, db := range testDBs(t) {
+		db := db
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			const total = 30
+			for i := 0; i < total; i++ {
+				saveTestPackage(t, db, fmt.Sprintf("pkg_%02d", i), "1.0.0", []string{uploader}, "")
+			}
+			done := make(chan error)
+			go func() {
+				for i := 0; i < total; i++ {
+					if err := db.DeletePackage(fmt.Sprintf("pkg_%02d", i)); err != nil {
+						done <- err
+						return
+					}
+				}
+				done <- nil
+			}()
+
+			// Every listing sees the registry at a single point in time.
+			for deleted := false; !deleted; {
+				select {
+				case err := <-done:
+					require.NoError(err)
+					deleted = true
+				default:
+				}
+				result, err := db.QueryPackages(UnpubDbQuery{Size: 10, Sort: SortName})
+				require.NoError(err)
+				want := result.Count
+				if want > 10 {
+					want = 10
+				}
+				require.Len(result.Packages, want)
+				if result.Count > 0 {
+					require.Equal(fmt.Sprintf("pkg_%02d", total-result.Count), result.Packages[0].Name)
+				}
+			}
+		})
+	}
+}
+
+func TestDBArchiveDigest(t *testing.T) {
+	const digest = "0123abcd"
+	for name, db := range testDBs(t) {
+		db := db
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+
+			pkg := NewPackage(packageName, false, []string{uploader})
+			v, err := pkg.CreateVersion("1.0.0", "name: my_pkg\nversion: 1.0.0", nil, nil, nil)
+			require.NoError(err)
+			v.ArchiveSHA256 = digest
+			pkg.Versions[v.Version] = v
+			require.NoError(db.SavePackage(pkg))
+
+			got, err := db.QueryPackage(packageName)
+			require.NoError(err)
+			require.Equal(digest, got.Versions["1.0.0"].ArchiveSHA256)
+			v, err = db.QueryVersion(packageName, "1.0.0")
+			require.NoError(err)
+			require.Equal(digest, v.ArchiveSHA256)
+		})
+	}
+}
+
+func TestDBConcurrentUpdates(t *testing.T) {
+	const (
+		downloaders = 8
+		downloads   = 50
+		publishes   = 20
+		uploaders   = 10
+	)
+	for name, db := range testDBs(t) {
+		db := db
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			saveTestPackage(t, db, packageName, "1.0.0", []string{uploader}, "")
+
+			var wg sync.WaitGroup
+			errs := make(chan error, downloaders*downloads+publishes+uploaders)
+			for i := 0; i < downloaders; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < downloads; j++ {
+						errs <- db.IncreaseDownloads(packageName, "1.0.0")
+					}
+				}()
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 1; i <= publishes; i++ {
+					version := fmt.Sprintf("1.0.%d", i)
+					errs <- db.UpdatePackage(packageName, func(pkg *UnpubPackage, exists bool) error {
+						_, err := pkg.CreateVersion(version, "name: my_pkg\nversion: "+version, nil, nil, nil)
+						return err
+					})
+				}
+			}()
+			for i := 0; i < uploaders; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs <- db.AddUploader(packageName, fmt.Sprintf("user%d@example.com", i))
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				require.NoError(err)
+			}
+
+			pkg, err := db.QueryPackage(packageName)
+			require.NoError(err)
+			require.Equal(downloaders*downloads, pkg.Downloads)
+			require.Len(pkg.Versions, publishes+1)
+			require.Equal(fmt.Sprintf("1.0.%d", publishes), pkg.Latest)
+			require.Len(pkg.Uploaders, uploaders+1)
+		})
+	}
+}
+
+func TestDBQueryDownloads(t *testing.T) {
+	for name, db := range testDBs(t) {
+		db := db
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			saveTestPackage(t, db, packageName, "1.0.0", []string{uploader}, "")
+
+			for version, n := range map[string]int{"1.0.0": 3, "0.9.0": 1} {
+				for i := 0; i < n; i++ {
+					require.NoError(db.IncreaseDownloads(packageName, version))
+				}
+			}
+			require.ErrorIs(db.IncreaseDownloads("missing", "1.0.0"), ErrNotFound)
+
+			today := DownloadDay(time.Now())
+			stats, err := db.QueryDownloads(packageName, time.Now().AddDate(0, 0, -1))
+			require.NoError(err)
+			require.Equal(map[string]int{"1.0.0": 3, "0.9.0": 1}, stats.Versions)
+			require.Equal([]DailyDownloads{
+				{Day: today, Version: "0.9.0", Count: 1},
+				{Day: today, Version: "1.0.0", Count: 3},
+			}, stats.Daily)
+
+			stats, err = db.QueryDownloads(packageName, time.Now().AddDate(0, 0, 1))
+			require.NoError(err)
+			require.Len(stats.Versions, 2)
+			require.Empty(stats.Daily)
+
+			pkg, err := db.QueryPackage(packageName)
+			require.NoError(err)
+			require.Equal(4, pkg.Downloads)
+		})
+	}
+}
+
+func TestDBQueryVersion(t *testing.T) {
+	for name, db := range testDBs(t) {
+		db := db
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+
+			readme, changelog := "# my_pkg", "## 1.0.0"
+			pkg := NewPackage(packageName, false, []string{uploader})
+			_, err := pkg.CreateVersion("1.0.0", "name: my_pkg\nversion: 1.0.0", nil, &readme, &changelog)
+			require.NoError(err)
+			require.NoError(db.SavePackage(pkg))
+
+			// Packages are loaded without READMEs and changelogs.
+			got, err := db.QueryPackage(packageName)
+			require.NoError(err)
+			require.Nil(got.Versions["1.0.0"].Readme)
+			require.Nil(got.Versions["1.0.0"].Changelog)
+
+			// Saving a package loaded without them keeps the stored ones.
+			require.NoError(db.IncreaseDownloads(packageName, "1.0.0"))
+			require.NoError(db.UpdatePackage(packageName, func(pkg *UnpubPackage, exists bool) error {
+				_, err := pkg.CreateVersion("1.1.0", "name: my_pkg\nversion: 1.1.0", nil, nil, nil)
+				return err
+			}))
+
+			v, err := db.QueryVersion(packageName, "1.0.0")
+			require.NoError(err)
+			require.Equal("1.0.0", v.Version)
+			require.Equal(&readme, v.Readme)
+			require.Equal(&changelog, v.Changelog)
+
+			v, err = db.QueryVersion(packageName, "1.1.0")
+			require.NoError(err)
+			require.Nil(v.Readme)
+
+			_, err = db.QueryVersion(packageName, "2.0.0")
+			require.ErrorIs(err, ErrNotFound)
+			_, err = db.QueryVersion("missing", "1.0.0")
+			require.ErrorIs(err, ErrNotFound)
+		})
+	}
+}
+
+func TestDBDeletePackage(t *testing.T) {
+	for name, db := range testDBs(t) {
+		db := db
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			saveTestPackage(t, db, packageName, "1.0.0", []string{uploader}, "description: A test package")
+			saveTestPackage(t, db, "other_pkg", "1.0.0", []string{uploader}, "description: Another test package")
+			require.NoError(db.IncreaseDownloads(packageName, "1.0.0"))
+			advisory := Advisory{ID: "UNPUB-2024-1", Package: packageName, Summary: "Path traversal"}
+			require.NoError(db.SaveAdvisory(advisory))
+			advisory.Package = "other_pkg"
+			require.NoError(db.SaveAdvisory(advisory))
+
+			require.NoError(db.DeletePackage(packageName))
+			_, err := db.QueryPackage(packageName)
+			require.ErrorIs(err, ErrNotFound)
+			_, err = db.QueryVersion(packageName, "1.0.0")
+			require.ErrorIs(err, ErrNotFound)
+
+			// The package is gone from every index.
+			result, err := db.QueryPackages(UnpubDbQuery{Size: 10, Uploader: uploader})
+			require.NoError(err)
+			require.Equal([]string{"other_pkg"}, packageNames(result))
+			result, err = db.QueryPackages(UnpubDbQuery{Size: 10, Keyword: "test"})
+			require.NoError(err)
+			require.Equal([]string{"other_pkg"}, packageNames(result))
+
+			// Advisories are deleted with the package, so they do not apply
+			// to another one published under its name.
+			saveTestPackage(t, db, packageName, "2.0.0", []string{uploader}, "")
+			advisories, err := db.QueryAdvisories(packageName)
+			require.NoError(err)
+			require.Empty(advisories)
+			advisories, err = db.QueryAdvisories("other_pkg")
+			require.NoError(err)
+			require.Len(advisories, 1)
+			require.NoError(db.DeletePackage(packageName))
+
+			require.ErrorIs(db.DeletePackage(packageName), ErrNotFound)
+		})
+	}
+}
+
+func TestDBAudit(t *testing.T) {
+	for name, db := range testDBs(t) {
+		db := db
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+
+			start := time.Now().Add(-time.Hour).Truncate(time.Second)
+			events := []AuditEvent{
+				{Action: AuditPublish, Package: "a", Version: "1.0.0", After: "sha256:1"},
+				{Action: AuditPublish, Package: "b", Version: "1.0.0", After: "sha256:2"},
+				{Action: AuditAddUploader, Package: "a", Before: uploader, After: uploader + ",other@example.com"},
+				{Action: AuditPublish, Package: "a", Version: "1.1.0", Before: "1.0.0", After: "sha256:3"},
+				{Action: AuditDelete, Package: "b", Before: "1.0.0"},
+			}
+			for i, event := range events {
+				event.Time = start.Add(time.Duration(i) * time.Minute)
+				event.Actor = uploader
+				event.ClientIP = "127.0.0.1"
+				require.NoError(db.RecordAudit(event))
+			}
+
+			actions := func(result *AuditResult) []string {
+				var actions []string
+				for _, event := range result.Events {
+					actions = append(actions, event.Package+" "+event.Action+" "+event.Version)
+				}
+				return actions
+			}
+
+			result, err := db.QueryAudit(AuditQuery{})
+			require.NoError(err)
+			require.Len(result.Events, 5)
+			require.Empty(result.NextCursor)
+			latest := result.Events[0]
+			require.NotEmpty(latest.ID)
+			require.True(latest.Time.Equal(start.Add(4*time.Minute)), latest.Time)
+			latest.ID, latest.Time = "", time.Time{}
+			require.Equal(AuditEvent{
+				Action:   AuditDelete,
+				Actor:    uploader,
+				ClientIP: "127.0.0.1",
+				Package:  "b",
+				Before:   "1.0.0",
+			}, latest)
+
+			result, err = db.QueryAudit(AuditQuery{Package: "a", Action: AuditPublish})
+			require.NoError(err)
+			require.Equal([]string{"a publish 1.1.0", "a publish 1.0.0"}, actions(result))
+
+			result, err = db.QueryAudit(AuditQuery{Since: start.Add(time.Minute), Until: start.Add(3 * time.Minute)})
+			require.NoError(err)
+			require.Equal([]string{"a uploader.add ", "b publish 1.0.0"}, actions(result))
+
+			// Pages continue where the previous one ended.
+			var pages [][]string
+			query := AuditQuery{Limit: 2}
+			for {
+				result, err := db.QueryAudit(query)
+				require.NoError(err)
+				pages = append(pages, actions(result))
+				if result.NextCursor == "" {
+					break
+				}
+				query.Cursor = result.NextCursor
+			}
+			require.Equal([][]string{
+				{"b delete ", "a publish 1.1.0"},
+				{"a uploader.add ", "b publish 1.0.0"},
+				{"a publish 1.0.0"},
+			}, pages)
+		})
+	}
+}
+
+func TestDBExpiredVersions(t *testing.T) {
+	for name, db := range testDBs(t) {
+		db := db
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			now := time.Now().Truncate(time.Millisecond)
+			soon, later := now.Add(time.Minute), now.Add(time.Hour)
+
+			saveTestPackage(t, db, packageName, "1.0.0", []string{uploader}, "")
+			require.NoError(db.UpdatePackage(packageName, func(pkg *UnpubPackage, exists bool) error {
+				return pkg.AddVersion(UnpubVersion{
+					Version:     "1.1.0-pr.1",
+					PubspecYAML: "name: my_pkg\nversion: 1.1.0-pr.1",
+					ExpiresAt:   &soon,
+					CreatedAt:   now,
+				})
+			}))
+			preview := saveTestPackage(t, db, "preview_pkg", "0.0.1-pr.2", []string{uploader}, "")
+			require.NoError(db.UpdatePackage("preview_pkg", func(pkg *UnpubPackage, exists bool) error {
+				v := pkg.Versions["0.0.1-pr.2"]
+				v.ExpiresAt = &later
+				pkg.Versions[v.Version] = v
+				return nil
+			}))
+
+			got, err := db.QueryPackage(packageName)
+			require.NoError(err)
+			require.True(soon.Equal(*got.Versions["1.1.0-pr.1"].ExpiresAt))
+			v, err := db.QueryVersion("preview_pkg", "0.0.1-pr.2")
+			require.NoError(err)
+			require.True(later.Equal(*v.ExpiresAt))
+
+			names, err := db.QueryExpiredPackages(now)
+			require.NoError(err)
+			require.Empty(names)
+			names, err = db.QueryExpiredPackages(soon)
+			require.NoError(err)
+			require.Equal([]string{packageName}, names)
+			names, err = db.QueryExpiredPackages(later)
+			require.NoError(err)
+			require.ElementsMatch([]string{packageName, "preview_pkg"}, names)
+
+			// Removing the expired versions also removes them from the index.
+			require.NoError(db.UpdatePackage(packageName, func(pkg *UnpubPackage, exists bool) error {
+				pkg.RemoveExpired(soon)
+				return nil
+			}))
+			got, err = db.QueryPackage(packageName)
+			require.NoError(err)
+			require.Equal("1.0.0", got.Latest)
+			names, err = db.QueryExpiredPackages(later)
+			require.NoError(err)
+			require.Equal([]string{"preview_pkg"}, names)
+
+			// A package left without versions is deleted.
+			require.NoError(db.UpdatePackage(preview.Name, func(pkg *UnpubPackage, exists bool) error {
+				pkg.RemoveExpired(later)
+				return nil
+			}))
+			_, err = db.QueryPackage(preview.Name)
+			require.ErrorIs(err, ErrNotFound)
+			result, err := db.QueryPackages(UnpubDbQuery{Uploader: uploader})
+			require.NoError(err)
+			require.Equal([]string{packageName}, packageNames(result))
+			names, err = db.QueryExpiredPackages(later)
+			require.NoError(err)
+			require.Empty(names)
+		})
+	}
+}
+
+func TestDBRetracted(t *testing.T) {
+	for name, db := range testDBs(t) {
+		db := db
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			saveTestPackage(t, db, packageName, "1.0.0", []string{uploader}, "")
+			require.NoError(db.UpdatePackage(packageName, func(pkg *UnpubPackage, exists bool) error {
+				if _, err := pkg.CreateVersion("1.1.0", "name: my_pkg\nversion: 1.1.0", nil, nil, nil); err != nil {
+					return err
+				}
+				return pkg.SetRetracted("1.1.0", true, time.Now())
+			}))
+
+			pkg, err := db.QueryPackage(packageName)
+			require.NoError(err)
+			require.Equal("1.0.0", pkg.Latest)
+			require.True(pkg.Versions["1.1.0"].Retracted)
+			require.False(pkg.Versions["1.0.0"].Retracted)
+			v, err := db.QueryVersion(packageName, "1.1.0")
+			require.NoError(err)
+			require.True(v.Retracted)
+		})
+	}
+}
+
+func TestDBUnlistedPackages(t *testing.T) {
+	for name, db := range testDBs(t) {
+		db := db
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			saveTestPackage(t, db, packageName, "1.0.0", []string{uploader}, "description: A test package")
+			saveTestPackage(t, db, "old_pkg", "1.0.0", []string{uploader}, "description: An old test package")
+			require.NoError(db.UpdatePackage("old_pkg", func(pkg *UnpubPackage, exists bool) error {
+				pkg.IsDiscontinued = true
+				pkg.ReplacedBy = packageName
+				pkg.IsUnlisted = true
+				return nil
+			}))
+
+			// Unlisted packages can still be resolved.
+			pkg, err := db.QueryPackage("old_pkg")
+			require.NoError(err)
+			require.True(pkg.IsDiscontinued)
+			require.Equal(packageName, pkg.ReplacedBy)
+			require.True(pkg.IsUnlisted)
+
+			for _, query := range []UnpubDbQuery{
+				{},
+				{Sort: SortName},
+				{Uploader: uploader},
+				{Keyword: "test"},
+				{Keyword: "test", Sort: SortRelevance},
+			} {
+				result, err := db.QueryPackages(query)
+				require.NoError(err)
+				require.Equal(1, result.Count, "%+v", query)
+				require.Equal([]string{packageName}, packageNames(result), "%+v", query)
+
+				query.IncludeUnlisted = true
+				result, err = db.QueryPackages(query)
+				require.NoError(err)
+				require.Equal(2, result.Count, "%+v", query)
+			}
+
+			require.NoError(db.UpdatePackage("old_pkg", func(pkg *UnpubPackage, exists bool) error {
+				pkg.IsUnlisted = false
+				return nil
+			}))
+			result, err := db.QueryPackages(UnpubDbQuery{})
+			require.NoError(err)
+			require.Equal(2, result.Count)
+		})
+	}
+}
+
+func TestDBAdvisories(t *testing.T) {
+	for name, db := range testDBs(t) {
+		db := db
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			advisories, err := db.QueryAdvisories(packageName)
+			require.NoError(err)
+			require.Empty(advisories)
+
+			published := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+			advisory := Advisory{
+				ID:       "UNPUB-2024-2",
+				Package:  packageName,
+				Summary:  "Path traversal",
+				Severity: SeverityHigh,
+				Aliases:  []string{"CVE-2024-0001"},
+				Affected: []AdvisoryRange{{Introduced: "1.0.0", Fixed: "1.0.1"}},
+				References: []AdvisoryReference{
+					{Type: "WEB", URL: "https://example.com/UNPUB-2024-2"},
+				},
+				Published: published,
+				Modified:  published,
+			}
+			require.NoError(db.SaveAdvisory(advisory))
+			other := advisory
+			other.ID = "UNPUB-2024-1"
+			require.NoError(db.SaveAdvisory(other))
+			other.Package = "http_parser"
+			require.NoError(db.SaveAdvisory(other))
+
+			withdrawn := published.Add(time.Hour)
+			advisory.Withdrawn = &withdrawn
+			advisory.Modified = withdrawn
+			require.NoError(db.SaveAdvisory(advisory))
+
+			advisories, err = db.QueryAdvisories(packageName)
+			require.NoError(err)
+			require.Len(advisories, 2)
+			require.Equal("UNPUB-2024-1", advisories[0].ID)
+			require.Equal("UNPUB-2024-2", advisories[1].ID)
+			require.True(withdrawn.Equal(*advisories[1].Withdrawn))
+			require.Equal(advisory.Affected, advisories[1].Affected)
+			require.Equal(advisory.References, advisories[1].References)
+		})
+	}
+}
+
+func TestDBPackageNames(t *testing.T) {
+	for name, db := range testDBs(t) {
+		db := db
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			names, err := db.QueryPackageNames()
+			require.NoError(err)
+			require.Empty(names)
+
+			saveTestPackage(t, db, "http_parser", "1.0.0", []string{uploader}, "")
+			saveTestPackage(t, db, "http", "1.0.0", []string{uploader}, "")
+			saveTestPackage(t, db, packageName, "1.0.0", []string{uploader}, "")
+			names, err = db.QueryPackageNames()
+			require.NoError(err)
+			require.Equal([]string{"http", "http_parser", packageName}, names)
+
+			require.NoError(db.UpdatePackage("http", func(pkg *UnpubPackage, exists bool) error {
+				pkg.IsUnlisted = true
+				return nil
+			}))
+			require.NoError(db.DeletePackage(packageName))
+			names, err = db.QueryPackageNames()
+			require.NoError(err)
+			require.Equal([]string{"http_parser"}, names)
+		})
+	}
+}
+
+func TestDBTokens(t *testing.T) {
+	for name, db := range testDBs(t) {
+		db := db
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			tokens, err := db.QueryTokens()
+			require.NoError(err)
+			require.Empty(tokens)
+			_, err = db.QueryToken("missing")
+			require.ErrorIs(err, ErrNotFound)
+
+			now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+			token, secret, err := NewToken(uploader, []string{ScopeRead, ScopePublish}, time.Hour, now)
+			require.NoError(err)
+			token.Description = "CI"
+			require.NoError(db.SaveToken(token))
+			other, _, err := NewToken("admin@example.com", []string{ScopeAdmin}, 0, now)
+			require.NoError(err)
+			require.NoError(db.SaveToken(other))
+
+			saved, err := db.QueryToken(TokenID(secret))
+			require.NoError(err)
+			require.True(saved.Matches(secret))
+			require.Equal(token.Identity, saved.Identity)
+			require.Equal(token.Scopes, saved.Scopes)
+			require.Equal("CI", saved.Description)
+			require.True(token.CreatedAt.Equal(saved.CreatedAt))
+			require.True(token.ExpiresAt.Equal(*saved.ExpiresAt))
+
+			tokens, err = db.QueryTokens()
+			require.NoError(err)
+			require.Len(tokens, 2)
+			require.Less(tokens[0].ID, tokens[1].ID)
+
+			require.NoError(db.DeleteToken(token.ID))
+			require.ErrorIs(db.DeleteToken(token.ID), ErrNotFound)
+			_, err = db.QueryToken(token.ID)
+			require.ErrorIs(err, ErrNotFound)
+			tokens, err = db.QueryTokens()
+			require.NoError(err)
+			require.Len(tokens, 1)
+			require.Nil(tokens[0].ExpiresAt)
+		})
+	}
+}
+
+func TestDBTrustPolicies(t *testing.T) {
+	for name, db := range testDBs(t) {
+		db := db
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			saveTestPackage(t, db, packageName, "1.0.0", []string{uploader}, "")
+			pkg, err := db.QueryPackage(packageName)
+			require.NoError(err)
+			require.Empty(pkg.TrustPolicies)
+
+			policies := []TrustPolicy{{
+				Issuer: "https://ci.example.com",
+				Claims: map[string]string{"repository": "acme/packages", "ref": "refs/tags/v*"},
+			}}
+			require.NoError(db.UpdatePackage(packageName, func(pkg *UnpubPackage, exists bool) error {
+				pkg.TrustPolicies = policies
+				return nil
+			}))
+			pkg, err = db.QueryPackage(packageName)
+			require.NoError(err)
+			require.Equal(policies, pkg.TrustPolicies)
+
+			require.NoError(db.UpdatePackage(packageName, func(pkg *UnpubPackage, exists bool) error {
+				pkg.TrustPolicies = nil
+				return nil
+			}))
+			pkg, err = db.QueryPackage(packageName)
+			require.NoError(err)
+			require.Empty(pkg.TrustPolicies)
+		})
+	}
+}
+
+func TestDBPrivatePackages(t *testing.T) {
+	const reader = "reader@example.com"
+	for name, db := range testDBs(t) {
+		db := db
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			saveTestPackage(t, db, packageName, "1.0.0", []string{uploader}, "description: A test package")
+			saveTestPackage(t, db, "secret_pkg", "1.0.0", []string{"owner@example.com"}, "description: A secret test package")
+			require.NoError(db.UpdatePackage("secret_pkg", func(pkg *UnpubPackage, exists bool) error {
+				pkg.Private = true
+				pkg.Readers = []string{reader}
+				return nil
+			}))
+
+			pkg, err := db.QueryPackage("secret_pkg")
+			require.NoError(err)
+			require.True(pkg.Private)
+			require.Equal([]string{reader}, pkg.Readers)
+
+			for _, query := range []UnpubDbQuery{
+				{},
+				{Sort: SortName},
+				{Keyword: "test"},
+				{Keyword: "test", Sort: SortRelevance},
+				{Reader: uploader},
+			} {
+				result, err := db.QueryPackages(query)
+				require.NoError(err)
+				require.Equal(1, result.Count, "%+v", query)
+				require.Equal([]string{packageName}, packageNames(result), "%+v", query)
+			}
+			for _, query := range []UnpubDbQuery{
+				{IncludePrivate: true},
+				{Reader: reader},
+				{Reader: "owner@example.com"},
+				{Reader: reader, Keyword: "test", Sort: SortRelevance},
+			} {
+				result, err := db.QueryPackages(query)
+				require.NoError(err)
+				require.Equal(2, result.Count, "%+v", query)
+			}
+
+			// Identity tokens select the private packages trusting them.
+			claims := IdentityClaims{
+				Issuer:  "https://ci.example.com",
+				Subject: "repo:acme/packages",
+				Claims:  map[string]interface{}{"repository": "acme/packages"},
+			}
+			result, err := db.QueryPackages(UnpubDbQuery{Trusted: &claims})
+			require.NoError(err)
+			require.Equal(1, result.Count)
+			require.NoError(db.UpdatePackage("secret_pkg", func(pkg *UnpubPackage, exists bool) error {
+				pkg.TrustPolicies = []TrustPolicy{{Issuer: claims.Issuer, Claims: map[string]string{"repository": "acme/*"}}}
+				return nil
+			}))
+			for _, query := range []UnpubDbQuery{
+				{Trusted: &claims},
+				{Trusted: &claims, Size: 1, Page: 1, Sort: SortName},
+				{Trusted: &claims, Keyword: "secret"},
+			} {
+				result, err := db.QueryPackages(query)
+				require.NoError(err)
+				require.Contains(packageNames(result), "secret_pkg", "%+v", query)
+			}
+			claims.Claims["repository"] = "other/packages"
+			result, err = db.QueryPackages(UnpubDbQuery{Trusted: &claims})
+			require.NoError(err)
+			require.Equal([]string{packageName}, packageNames(result))
+
+			// Private packages are never in the name index.
+			names, err := db.QueryPackageNames()
+			require.NoError(err)
+			require.Equal([]string{packageName}, names)
 
-	getPkg, err := db.QueryPackage(packageName)
-	require.NoError(err)
-	require.Truef(cmp.Equal(pkg, getPkg), "Want: %+v\nGot: %+v", pkg, getPkg)
+			require.NoError(db.UpdatePackage("secret_pkg", func(pkg *UnpubPackage, exists bool) error {
+				pkg.Readers = nil
+				return nil
+			}))
+			result, err = db.QueryPackages(UnpubDbQuery{Reader: reader})
+			require.NoError(err)
+			require.Equal(1, result.Count)
+			pkg, err = db.QueryPackage("secret_pkg")
+			require.NoError(err)
+			require.Empty(pkg.Readers)
+		})
+	}
 }
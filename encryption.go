@@ -0,0 +1,373 @@
+package unpub
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// ParseEncryptionKey decodes a hex-encoded 256-bit master key, as generated by
+// `openssl rand -hex 32`.
+func ParseEncryptionKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key must be hex-encoded: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// badgerOptions returns the options for a badger DB at dbPath, encrypted
+// with key unless it is nil.
+func badgerOptions(dbPath string, inMem bool, key []byte) badger.Options {
+	opts := badger.DefaultOptions(dbPath).WithInMemory(inMem)
+	if key != nil {
+		// Badger requires an index cache when encryption is enabled.
+		opts = opts.WithEncryptionKey(key).WithIndexCacheSize(64 << 20)
+	}
+	return opts
+}
+
+// rotateBadgerKey re-encrypts the data keys of the badger DB in dir with
+// newKey. The data itself stays encrypted with the data keys. A DB already
+// using newKey is left as is, so an interrupted rotation can be rerun.
+func rotateBadgerKey(dir string, oldKey, newKey []byte) error {
+	opts := badger.KeyRegistryOptions{
+		Dir:           dir,
+		ReadOnly:      true,
+		EncryptionKey: oldKey,
+	}
+	registry, err := badger.OpenKeyRegistry(opts)
+	if errors.Is(err, badger.ErrEncryptionKeyMismatch) {
+		opts.EncryptionKey = newKey
+		if _, newErr := badger.OpenKeyRegistry(opts); newErr == nil {
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	opts.EncryptionKey = newKey
+	return badger.WriteKeyRegistry(registry, opts)
+}
+
+// Archives stored by an encrypted FileBlobStore use envelope encryption. Each
+// file starts with a header holding a random data key, sealed with the master
+// key and the blob's digest as additional data. The contents follow in
+// segments sealed with the data key, so that any range can be decrypted
+// without reading the whole file. Rotating the master key only rewrites the
+// header.
+//
+// Header: magic (8) | version (1) | nonce (12) | sealed data key (32 + 16)
+// Segments: up to encryptedSegmentSize bytes of contents, plus a 16 byte tag
+const (
+	encryptedBlobMagic   = "UNPUBENC"
+	encryptedBlobVersion = 1
+	encryptedHeaderSize  = len(encryptedBlobMagic) + 1 + 12 + 32 + 16
+	encryptedSegmentSize = 64 << 10
+	encryptedTagSize     = 16
+)
+
+// errNotEncrypted is returned when a blob read with a master key has no
+// encryption header.
+var errNotEncrypted = errors.New("blob is not encrypted")
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealDataKey returns a header holding dataKey sealed with masterKey.
+func sealDataKey(masterKey, dataKey []byte, digest string) ([]byte, error) {
+	gcm, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, encryptedHeaderSize)
+	header = append(header, encryptedBlobMagic...)
+	header = append(header, encryptedBlobVersion)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header = append(header, nonce...)
+	return gcm.Seal(header, nonce, dataKey, []byte(digest)), nil
+}
+
+// openDataKey returns the data key held by header.
+func openDataKey(masterKey, header []byte, digest string) ([]byte, error) {
+	if string(header[:len(encryptedBlobMagic)]) != encryptedBlobMagic {
+		return nil, errNotEncrypted
+	}
+	if v := header[len(encryptedBlobMagic)]; v != encryptedBlobVersion {
+		return nil, fmt.Errorf("unsupported encryption version %d", v)
+	}
+	gcm, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := header[len(encryptedBlobMagic)+1 : len(encryptedBlobMagic)+1+gcm.NonceSize()]
+	sealed := header[len(encryptedBlobMagic)+1+gcm.NonceSize():]
+	dataKey, err := gcm.Open(nil, nonce, sealed, []byte(digest))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting data key: %w", err)
+	}
+	return dataKey, nil
+}
+
+// segmentNonce returns the nonce of a segment. Since every blob has its own
+// data key, nonces only need to be unique within a blob. Marking the final
+// segment detects truncation.
+func segmentNonce(index int64, final bool) []byte {
+	nonce := make([]byte, 12)
+	if final {
+		nonce[0] = 1
+	}
+	binary.BigEndian.PutUint64(nonce[4:], uint64(index))
+	return nonce
+}
+
+// encryptingWriter seals everything written to it into segments, and must be
+// closed to write the final one.
+type encryptingWriter struct {
+	w     io.Writer
+	gcm   cipher.AEAD
+	buf   []byte
+	index int64
+}
+
+// newEncryptingWriter writes the header of a new blob to w and returns a
+// writer for its contents.
+func newEncryptingWriter(w io.Writer, masterKey []byte, digest string) (*encryptingWriter, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	header, err := sealDataKey(masterKey, dataKey, digest)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptingWriter{
+		w:   w,
+		gcm: gcm,
+		buf: make([]byte, 0, encryptedSegmentSize+encryptedTagSize),
+	}, nil
+}
+
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		// A full segment is only sealed once more data arrives, since the
+		// final segment is sealed differently.
+		if len(e.buf) == encryptedSegmentSize {
+			if err := e.seal(false); err != nil {
+				return 0, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):encryptedSegmentSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (e *encryptingWriter) seal(final bool) error {
+	sealed := e.gcm.Seal(e.buf[:0], segmentNonce(e.index, final), e.buf, nil)
+	if _, err := e.w.Write(sealed); err != nil {
+		return err
+	}
+	e.buf = e.buf[:0]
+	e.index++
+	return nil
+}
+
+func (e *encryptingWriter) Close() error {
+	return e.seal(true)
+}
+
+// encryptedBlob decrypts a blob one segment at a time.
+type encryptedBlob struct {
+	f        *os.File
+	modTime  time.Time
+	gcm      cipher.AEAD
+	size     int64
+	segments int64
+	offset   int64
+	// segment holds the contents of the segment at index.
+	segment []byte
+	index   int64
+}
+
+func openEncryptedBlob(f *os.File, masterKey []byte, digest string) (*encryptedBlob, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, encryptedHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errNotEncrypted
+		}
+		return nil, err
+	}
+	dataKey, err := openDataKey(masterKey, header, digest)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	body := info.Size() - int64(encryptedHeaderSize)
+	segments := (body + encryptedSegmentSize + encryptedTagSize - 1) / (encryptedSegmentSize + encryptedTagSize)
+	if body < encryptedTagSize {
+		return nil, errors.New("encrypted blob is truncated")
+	}
+	return &encryptedBlob{
+		f:        f,
+		modTime:  info.ModTime(),
+		gcm:      gcm,
+		size:     body - segments*encryptedTagSize,
+		segments: segments,
+		index:    -1,
+	}, nil
+}
+
+func (b *encryptedBlob) Read(p []byte) (int, error) {
+	if b.offset >= b.size {
+		return 0, io.EOF
+	}
+	index := b.offset / encryptedSegmentSize
+	if index != b.index {
+		sealed := make([]byte, encryptedSegmentSize+encryptedTagSize)
+		pos := int64(encryptedHeaderSize) + index*int64(len(sealed))
+		n, err := b.f.ReadAt(sealed, pos)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, err
+		}
+		b.segment, err = b.gcm.Open(b.segment[:0], segmentNonce(index, index == b.segments-1), sealed[:n], nil)
+		if err != nil {
+			b.index = -1
+			return 0, fmt.Errorf("decrypting blob: %w", err)
+		}
+		b.index = index
+	}
+	n := copy(p, b.segment[b.offset%encryptedSegmentSize:])
+	b.offset += int64(n)
+	return n, nil
+}
+
+func (b *encryptedBlob) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	b.offset = offset
+	return offset, nil
+}
+
+func (b *encryptedBlob) Close() error {
+	return b.f.Close()
+}
+
+func (b *encryptedBlob) Size() int64 {
+	return b.size
+}
+
+func (b *encryptedBlob) ModTime() time.Time {
+	return b.modTime
+}
+
+// RotateKey re-encrypts the data key of every blob with newKey, and switches
+// the store to it. Each file is rewritten through the staging directory, so
+// an interrupted rotation leaves every blob readable with one of the keys,
+// and can be rerun.
+func (s *FileBlobStore) RotateKey(newKey []byte) error {
+	if s.Key == nil {
+		return errors.New("blob store is not encrypted")
+	}
+	err := s.List(func(digest string) error {
+		return s.rotateBlobKey(digest, newKey)
+	})
+	if err != nil {
+		return err
+	}
+	s.Key = newKey
+	return nil
+}
+
+func (s *FileBlobStore) rotateBlobKey(digest string, newKey []byte) (err error) {
+	f, err := os.Open(s.path(digest))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header := make([]byte, encryptedHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return fmt.Errorf("blob %s: %w", digest, err)
+	}
+	if _, err := openDataKey(newKey, header, digest); err == nil {
+		return nil
+	}
+	dataKey, err := openDataKey(s.Key, header, digest)
+	if err != nil {
+		return fmt.Errorf("blob %s: %w", digest, err)
+	}
+	header, err = sealDataKey(newKey, dataKey, digest)
+	if err != nil {
+		return err
+	}
+
+	staged, err := os.CreateTemp(filepath.Join(s.Dir, fileBlobStagingDir), "blob.*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(staged.Name())
+		}
+	}()
+	if _, err = staged.Write(header); err == nil {
+		_, err = io.Copy(staged, f)
+	}
+	if err == nil {
+		err = staged.Sync()
+	}
+	if closeErr := staged.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(staged.Name(), s.path(digest))
+}
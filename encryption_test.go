@@ -0,0 +1,101 @@
+package unpub
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testEncryptionKey = bytes.Repeat([]byte{1}, 32)
+	testRotatedKey    = bytes.Repeat([]byte{2}, 32)
+)
+
+func TestParseEncryptionKey(t *testing.T) {
+	key, err := ParseEncryptionKey(strings.Repeat("01", 32))
+	require.NoError(t, err)
+	require.Equal(t, testEncryptionKey, key)
+
+	_, err = ParseEncryptionKey("not hex")
+	require.Error(t, err)
+	_, err = ParseEncryptionKey(strings.Repeat("01", 16))
+	require.Error(t, err)
+}
+
+func TestFileBlobStoreEncryption(t *testing.T) {
+	require := require.New(t)
+	store, err := NewFileBlobStore(t.TempDir())
+	require.NoError(err)
+	store.Key = testEncryptionKey
+
+	data := strings.Repeat("proprietary source code\n", 10000)
+	digest, err := BlobDigest(strings.NewReader(data))
+	require.NoError(err)
+	_, err = store.Put(digest, strings.NewReader(data))
+	require.NoError(err)
+
+	onDisk, err := os.ReadFile(store.path(digest))
+	require.NoError(err)
+	require.NotContains(string(onDisk), "proprietary")
+
+	readBlob := func(store *FileBlobStore) (string, error) {
+		blob, err := store.Get(digest)
+		if err != nil {
+			return "", err
+		}
+		defer blob.Close()
+		b, err := io.ReadAll(blob)
+		return string(b), err
+	}
+
+	// Without the right key the blob cannot be read.
+	_, err = readBlob(&FileBlobStore{Dir: store.Dir})
+	require.Error(err)
+	_, err = readBlob(&FileBlobStore{Dir: store.Dir, Key: testRotatedKey})
+	require.Error(err)
+
+	// A truncated blob is detected.
+	truncated := &FileBlobStore{Dir: t.TempDir(), Key: testEncryptionKey}
+	require.NoError(os.WriteFile(truncated.path(digest), onDisk[:len(onDisk)-encryptedSegmentSize], 0o644))
+	_, err = readBlob(truncated)
+	require.Error(err)
+
+	require.NoError(store.RotateKey(testRotatedKey))
+	got, err := readBlob(store)
+	require.NoError(err)
+	require.Equal(data, got)
+	_, err = readBlob(&FileBlobStore{Dir: store.Dir, Key: testEncryptionKey})
+	require.Error(err)
+
+	// Rotating again to the same key is a no-op.
+	store.Key = testEncryptionKey
+	require.NoError(store.RotateKey(testRotatedKey))
+}
+
+func TestUnpubLocalDbEncryption(t *testing.T) {
+	require := require.New(t)
+	path := t.TempDir()
+	db, err := NewEncryptedUnpubLocalDb(path, testEncryptionKey)
+	require.NoError(err)
+	saveTestPackage(t, db, packageName, "1.0.0", []string{uploader}, "")
+	require.NoError(db.Close())
+
+	_, err = NewUnpubLocalDb(false, path)
+	require.Error(err)
+
+	require.NoError(RotateUnpubLocalDbKey(path, testEncryptionKey, testRotatedKey))
+	// An interrupted rotation can be rerun.
+	require.NoError(RotateUnpubLocalDbKey(path, testEncryptionKey, testRotatedKey))
+	_, err = NewEncryptedUnpubLocalDb(path, testEncryptionKey)
+	require.Error(err)
+
+	db, err = NewEncryptedUnpubLocalDb(path, testRotatedKey)
+	require.NoError(err)
+	defer db.Close()
+	_, err = db.QueryPackage(packageName)
+	require.NoError(err)
+}
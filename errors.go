@@ -0,0 +1,36 @@
+package unpub
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of errors caused by a request rather than by the registry, which the
+// server reports to clients with a matching status. ErrNotFound is another.
+var (
+	ErrConflict       = errors.New("conflict")
+	ErrForbidden      = errors.New("forbidden")
+	ErrInvalidInput   = errors.New("invalid input")
+	ErrInvalidPubspec = errors.New("invalid pubspec")
+	ErrUnauthorized   = errors.New("unauthorized")
+)
+
+// Error is an error of one of the kinds above, with a message which can be
+// shown to clients.
+type Error struct {
+	Kind    error
+	Message string
+}
+
+// NewError returns an Error of the given kind.
+func NewError(kind error, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
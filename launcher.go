@@ -28,6 +28,8 @@ const (
 	envGitUrl    = "UNPUB_GIT_URL"
 	envBranch    = "UNPUB_GIT_REF"
 	envLocalPath = "UNPUB_LOCAL_PATH"
+	envTTL       = "UNPUB_TTL"
+	envToken     = "UNPUB_TOKEN"
 )
 
 func warnDefaultEnv(env string, defaultVal interface{}) {
@@ -40,6 +42,11 @@ type Launcher struct {
 	Branch     string
 	ServerHost string
 	ServerPort string
+	// TTL is the time-to-live of the uploaded versions, e.g. 72h. Versions are
+	// kept forever if it is empty.
+	TTL string
+	// Token is the publish token to upload with, when the server needs one.
+	Token string
 }
 
 func NewLaunchFromEnv(warn bool) *Launcher {
@@ -74,6 +81,8 @@ func NewLaunchFromEnv(warn bool) *Launcher {
 		Branch:     gitRef,
 		ServerHost: host,
 		ServerPort: port,
+		TTL:        os.Getenv(envTTL),
+		Token:      os.Getenv(envToken),
 	}
 }
 
@@ -110,7 +119,7 @@ func (l *Launcher) Run() error {
 		return fmt.Errorf("no packages found in git repo")
 	}
 
-	err = uploadPackages(packageDirs, dir, l.ServerURL())
+	err = uploadPackages(packageDirs, dir, l.ServerURL(), l.TTL, l.Token)
 	if err != nil {
 		return err
 	}
@@ -269,8 +278,9 @@ func gatherPackages(dir string) ([]string, error) {
 	return packageDirs, nil
 }
 
-// uploadPackages compresses and uploads packages to running unpub server.
-func uploadPackages(packageDirs []string, tempDir, url string) error {
+// uploadPackages compresses and uploads packages to running unpub server,
+// authenticated with token unless it is empty.
+func uploadPackages(packageDirs []string, tempDir, url, ttl, token string) error {
 	for _, packageDir := range packageDirs {
 		tarball, err := createTarball(tempDir, packageDir)
 		if err != nil {
@@ -278,7 +288,7 @@ func uploadPackages(packageDirs []string, tempDir, url string) error {
 		}
 		defer tarball.Close()
 
-		err = uploadTarball(tarball, url)
+		err = uploadTarball(tarball, url, ttl, token)
 		if err != nil {
 			return errors.Wrapf(err, "error uploading %s", filepath.Base(packageDir))
 		}
@@ -373,8 +383,9 @@ func createTarball(tempDir, packageDir string) (*os.File, error) {
 	return os.Open(filepath.Join(tempDir, gzipfile))
 }
 
-// uploadTarball pushes a tarball to a running unpub server.
-func uploadTarball(tarball *os.File, url string) error {
+// uploadTarball pushes a tarball to a running unpub server, expiring after
+// ttl unless it is empty, and authenticated with token unless it is empty.
+func uploadTarball(tarball *os.File, url, ttl, token string) error {
 	endpoint := fmt.Sprintf("%s/api/packages/versions/newUpload", url)
 
 	var bb bytes.Buffer
@@ -387,15 +398,23 @@ func uploadTarball(tarball *os.File, url string) error {
 	if _, err := io.Copy(field, tarball); err != nil {
 		return errors.Wrap(err, "could not read tarball")
 	}
+	if ttl != "" {
+		if err := mw.WriteField("ttl", ttl); err != nil {
+			return errors.Wrap(err, "could not create field")
+		}
+	}
 	if err := mw.Close(); err != nil {
 		return err
 	}
 
 	req, err := http.NewRequest(http.MethodPost, endpoint, &bb)
-	req.Header.Add("Content-Type", mw.FormDataContentType())
 	if err != nil {
 		return errors.Wrap(err, "could not create request")
 	}
+	req.Header.Add("Content-Type", mw.FormDataContentType())
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return errors.Wrap(err, "http error")
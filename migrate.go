@@ -0,0 +1,293 @@
+package unpub
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// schemaVersionKey holds the schema version of a badger DB as a big-endian
+// uint64. Databases written before it was introduced are version 0.
+var schemaVersionKey = []byte("schema_version")
+
+// Migration upgrades a badger DB from schema version Version-1 to Version.
+//
+// Migrate is called once for every key starting with Prefix, each in its own
+// transaction, so a migration never has to fit the whole DB in memory. The
+// schema version is only bumped once every key has been migrated, which means
+// an interrupted migration runs again from the start: Migrate must therefore
+// be idempotent, and accept keys which have already been migrated.
+type Migration struct {
+	Version int
+	Name    string
+	Prefix  string
+	Migrate func(txn *badger.Txn, key []byte) error
+}
+
+// migrations is the ordered list of schema changes. The last entry is the
+// current schema version.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "index packages for queries and search",
+		Prefix:  packagePrefix,
+		Migrate: migrateIndexPackage,
+	},
+	{
+		Version: 2,
+		Name:    "split versions out of package records",
+		Prefix:  packagePrefix,
+		Migrate: migrateSplitVersions,
+	},
+	{
+		Version: 3,
+		Name:    "index listed package names",
+		Prefix:  packagePrefix,
+		Migrate: migrateIndexPackage,
+	},
+	{
+		Version: 4,
+		Name:    "choose latest versions by pub's rules",
+		Prefix:  packagePrefix,
+		Migrate: migrateLatest,
+	},
+	{
+		Version: 5,
+		Name:    "index private packages",
+		Prefix:  packagePrefix,
+		Migrate: migrateIndexPrivate,
+	},
+}
+
+// schemaVersion is the schema version written by this version of unpub.
+func schemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// getLegacyPackage returns the package stored at key if it is a single record
+// holding every version, as written before schema version 2.
+func getLegacyPackage(txn *badger.Txn, key []byte) (pkg UnpubPackage, legacy bool, err error) {
+	item, err := txn.Get(key)
+	if err != nil {
+		return
+	}
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &pkg)
+	})
+	return pkg, pkg.Versions != nil, err
+}
+
+// migrateIndexPackage rebuilds the secondary and search indexes of a package.
+func migrateIndexPackage(txn *badger.Txn, key []byte) error {
+	pkg, legacy, err := getLegacyPackage(txn, key)
+	if err != nil {
+		return err
+	}
+	if !legacy {
+		if pkg, err = getPackage(txn, string(key[len(packagePrefix):])); err != nil {
+			return err
+		}
+	}
+	return savePackage(txn, pkg)
+}
+
+// migrateSplitVersions moves the versions, READMEs and changelogs of a legacy
+// package record to their own keys.
+func migrateSplitVersions(txn *badger.Txn, key []byte) error {
+	pkg, legacy, err := getLegacyPackage(txn, key)
+	if err != nil || !legacy {
+		return err
+	}
+	return savePackage(txn, pkg)
+}
+
+// migrateLatest chooses the latest version of a package again, since it used
+// to be the last version uploaded even when that was a prerelease.
+func migrateLatest(txn *badger.Txn, key []byte) error {
+	pkg, err := getPackage(txn, string(key[len(packagePrefix):]))
+	if err != nil {
+		return err
+	}
+	latest := pkg.Latest
+	if pkg.updateLatest(); pkg.Latest == latest {
+		return nil
+	}
+	return savePackage(txn, pkg)
+}
+
+// migrateIndexPrivate indexes a private package, which used to be listed by
+// name like any other.
+func migrateIndexPrivate(txn *badger.Txn, key []byte) error {
+	name := string(key[len(packagePrefix):])
+	pkg, err := getPackage(txn, name)
+	if err != nil || !pkg.Private {
+		return err
+	}
+	if err := txn.Delete(makeNameIndexKey(name)); err != nil {
+		return err
+	}
+	return savePackage(txn, pkg)
+}
+
+// SchemaVersion returns the schema version of the DB.
+func (db *UnpubLocalDb) SchemaVersion() (version int, err error) {
+	err = db.db.View(func(txn *badger.Txn) error {
+		version, err = getSchemaVersion(txn)
+		return err
+	})
+	return
+}
+
+func getSchemaVersion(txn *badger.Txn) (int, error) {
+	item, err := txn.Get(schemaVersionKey)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var version uint64
+	err = item.Value(func(val []byte) error {
+		version = binary.BigEndian.Uint64(val)
+		return nil
+	})
+	return int(version), err
+}
+
+func setSchemaVersion(txn *badger.Txn, version int) error {
+	val := make([]byte, 8)
+	binary.BigEndian.PutUint64(val, uint64(version))
+	return txn.Set(schemaVersionKey, val)
+}
+
+// Migrate runs every pending migration. With dryRun, the migrations run
+// against an in-memory copy of the DB, reporting what would change and any
+// errors while leaving the DB itself untouched.
+func (db *UnpubLocalDb) Migrate(dryRun bool) error {
+	target := db.db
+	if dryRun {
+		dbCopy, err := copyToMemory(db.db)
+		if err != nil {
+			return fmt.Errorf("copying DB for dry run: %v", err)
+		}
+		defer dbCopy.Close()
+		target = dbCopy
+	}
+	return migrate(target, dryRun)
+}
+
+func migrate(db *badger.DB, dryRun bool) error {
+	logPrefix := ""
+	if dryRun {
+		logPrefix = "[dry run] "
+	}
+
+	var current int
+	var empty bool
+	err := db.View(func(txn *badger.Txn) error {
+		var err error
+		current, err = getSchemaVersion(txn)
+		if err != nil {
+			return err
+		}
+		it := txn.NewIterator(badger.IteratorOptions{})
+		defer it.Close()
+		it.Rewind()
+		empty = !it.Valid()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	latest := schemaVersion()
+	switch {
+	case empty:
+		// Nothing to migrate in a new DB.
+		return db.Update(func(txn *badger.Txn) error {
+			return setSchemaVersion(txn, latest)
+		})
+	case current > latest:
+		return fmt.Errorf("DB schema version %d is newer than supported version %d", current, latest)
+	case current == latest:
+		return nil
+	}
+
+	log.Printf("%sMigrating DB from schema version %d to %d", logPrefix, current, latest)
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		log.Printf("%sRunning migration %d: %s", logPrefix, m.Version, m.Name)
+		n, err := runMigration(db, m)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %v", m.Version, m.Name, err)
+		}
+		err = db.Update(func(txn *badger.Txn) error {
+			return setSchemaVersion(txn, m.Version)
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("%sMigration %d migrated %d keys", logPrefix, m.Version, n)
+	}
+	return nil
+}
+
+// runMigration applies m to every key matching its prefix and returns the
+// number of keys migrated.
+func runMigration(db *badger.DB, m Migration) (int, error) {
+	var keys [][]byte
+	err := db.View(func(txn *badger.Txn) error {
+		iterateKeys(txn, []byte(m.Prefix), func(key string) {
+			keys = append(keys, []byte(m.Prefix+key))
+		})
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		for {
+			err = db.Update(func(txn *badger.Txn) error {
+				return m.Migrate(txn, key)
+			})
+			if !errors.Is(err, badger.ErrConflict) {
+				break
+			}
+		}
+		if err != nil {
+			return 0, fmt.Errorf("key %q: %v", key, err)
+		}
+	}
+	return len(keys), nil
+}
+
+// copyToMemory returns an in-memory copy of db.
+func copyToMemory(db *badger.DB) (*badger.DB, error) {
+	dbCopy, err := badger.Open(
+		badger.
+			DefaultOptions("").
+			WithInMemory(true).
+			WithLogger(nil),
+	)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := db.Backup(pw, 0)
+		pw.CloseWithError(err)
+	}()
+	if err := dbCopy.Load(pr, 256); err != nil {
+		pr.CloseWithError(err)
+		dbCopy.Close()
+		return nil, err
+	}
+	return dbCopy, nil
+}
@@ -0,0 +1,180 @@
+package unpub
+
+import (
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/require"
+)
+
+// writeLegacyDb writes a package to a DB under path the way unpub did before
+// it had secondary indexes or a schema version.
+func writeLegacyDb(t *testing.T, path string, pkg UnpubPackage) {
+	db, err := badger.Open(badger.DefaultOptions(filepath.Join(path, "db")).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close()
+	b, err := json.Marshal(pkg)
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(txn *badger.Txn) error {
+		return txn.Set(makePackageKey(pkg.Name), b)
+	}))
+}
+
+func TestMigrate(t *testing.T) {
+	require := require.New(t)
+	path := t.TempDir()
+
+	readme := "Written before versions were split out"
+	pkg := NewPackage(packageName, false, []string{uploader})
+	_, err := pkg.CreateVersion("1.0.0", "name: my_pkg\nversion: 1.0.0\ndescription: A legacy package", nil, &readme, nil)
+	require.NoError(err)
+	writeLegacyDb(t, path, pkg)
+
+	// A dry run reports but does not apply the migrations.
+	require.NoError(MigrateUnpubLocalDb(path, nil, true))
+	db, err := openUnpubLocalDb(false, path, nil)
+	require.NoError(err)
+	version, err := db.SchemaVersion()
+	require.NoError(err)
+	require.Equal(0, version)
+	result, err := db.QueryPackages(UnpubDbQuery{Uploader: uploader})
+	require.NoError(err)
+	require.Empty(result.Packages)
+	require.NoError(db.Close())
+
+	db, err = NewUnpubLocalDb(false, path)
+	require.NoError(err)
+	defer db.Close()
+	version, err = db.SchemaVersion()
+	require.NoError(err)
+	require.Equal(schemaVersion(), version)
+
+	result, err = db.QueryPackages(UnpubDbQuery{Uploader: uploader})
+	require.NoError(err)
+	require.Equal([]string{packageName}, packageNames(result))
+	result, err = db.QueryPackages(UnpubDbQuery{Keyword: "legacy"})
+	require.NoError(err)
+	require.Equal([]string{packageName}, packageNames(result))
+	names, err := db.QueryPackageNames()
+	require.NoError(err)
+	require.Equal([]string{packageName}, names)
+
+	got, err := db.QueryPackage(packageName)
+	require.NoError(err)
+	require.Equal(pkg.Uploaders, got.Uploaders)
+	require.Contains(got.Versions, "1.0.0")
+	v, err := db.QueryVersion(packageName, "1.0.0")
+	require.NoError(err)
+	require.Equal(&readme, v.Readme)
+
+	// Migrating an up-to-date DB is a no-op.
+	require.NoError(db.Migrate(false))
+}
+
+func TestMigrateNewDb(t *testing.T) {
+	require := require.New(t)
+	db, err := NewUnpubLocalDb(true, "")
+	require.NoError(err)
+	defer db.Close()
+	version, err := db.SchemaVersion()
+	require.NoError(err)
+	require.Equal(schemaVersion(), version)
+}
+
+// stalePackage returns a package whose latest version is the last one
+// uploaded, as chosen before pub's rules were followed.
+func stalePackage(t *testing.T) UnpubPackage {
+	pkg := NewPackage(packageName, false, []string{uploader})
+	for _, version := range []string{"1.0.0", "2.0.0-dev.1"} {
+		_, err := pkg.CreateVersion(version, "name: my_pkg\nversion: "+version, nil, nil, nil)
+		require.NoError(t, err)
+	}
+	pkg.Latest = "2.0.0-dev.1"
+	return pkg
+}
+
+func TestMigrateLatest(t *testing.T) {
+	require := require.New(t)
+	db, err := NewUnpubLocalDb(true, "")
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.SavePackage(stalePackage(t)))
+	require.NoError(db.db.Update(func(txn *badger.Txn) error {
+		return setSchemaVersion(txn, 3)
+	}))
+
+	require.NoError(db.Migrate(false))
+	pkg, err := db.QueryPackage(packageName)
+	require.NoError(err)
+	require.Equal("1.0.0", pkg.Latest)
+}
+
+func TestMigrateIndexPrivate(t *testing.T) {
+	require := require.New(t)
+	db, err := NewUnpubLocalDb(true, "")
+	require.NoError(err)
+	defer db.Close()
+	pkg := NewPackage(packageName, true, []string{uploader})
+	_, err = pkg.CreateVersion("1.0.0", "name: my_pkg\nversion: 1.0.0", nil, nil, nil)
+	require.NoError(err)
+	require.NoError(db.SavePackage(pkg))
+	// Private packages used to be indexed like any other.
+	require.NoError(db.db.Update(func(txn *badger.Txn) error {
+		if err := txn.Delete(makePrivateIndexKey(packageName)); err != nil {
+			return err
+		}
+		if err := txn.Set(makeNameIndexKey(packageName), nil); err != nil {
+			return err
+		}
+		return setSchemaVersion(txn, 4)
+	}))
+
+	require.NoError(db.Migrate(false))
+	names, err := db.QueryPackageNames()
+	require.NoError(err)
+	require.Empty(names)
+	result, err := db.QueryPackages(UnpubDbQuery{})
+	require.NoError(err)
+	require.Empty(result.Packages)
+}
+
+func TestMigrateSQL(t *testing.T) {
+	require := require.New(t)
+	path := t.TempDir()
+
+	// A database created before migrations has the initial schema and no
+	// user_version.
+	legacy, err := sql.Open("sqlite", "file:"+filepath.Join(path, "unpub.db"))
+	require.NoError(err)
+	_, err = legacy.Exec(sqlSchema)
+	require.NoError(err)
+	require.NoError(legacy.Close())
+
+	db, err := NewUnpubSQLDb(false, path)
+	require.NoError(err)
+	var version int
+	require.NoError(db.db.QueryRow(`PRAGMA user_version`).Scan(&version))
+	require.Equal(len(sqlMigrations), version)
+	saveTestPackage(t, db, packageName, "1.0.0", []string{uploader}, "")
+	require.NoError(db.Close())
+
+	// Reopening runs no migrations.
+	db, err = NewUnpubSQLDb(false, path)
+	require.NoError(err)
+	_, err = db.QueryPackage(packageName)
+	require.NoError(err)
+
+	// Latest versions are chosen again by pub's rules.
+	require.NoError(db.SavePackage(stalePackage(t)))
+	tx, err := db.db.Begin()
+	require.NoError(err)
+	require.NoError(migrateLatestSQL(tx))
+	require.NoError(tx.Commit())
+	defer db.Close()
+	pkg, err := db.QueryPackage(packageName)
+	require.NoError(err)
+	require.Equal("1.0.0", pkg.Latest)
+}
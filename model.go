@@ -1,8 +1,8 @@
 package unpub
 
 import (
-	"errors"
-	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"golang.org/x/mod/semver"
@@ -20,26 +20,65 @@ type ListApiPackage struct {
 	Tags        []string  `json:"tags"`
 	Latest      string    `json:"latest"`
 	UpdatedAt   time.Time `json:"updatedAt"`
+	Snippet     string    `json:"snippet,omitempty"`
 }
 
 type DetailViewVersion struct {
 	Version   string    `json:"version"`
 	CreatedAt time.Time `json:"createdAt"`
+	Retracted bool      `json:"retracted"`
 }
 
 type WebAPIDetailView struct {
-	Name         string              `json:"name"`
-	Version      string              `json:"version"`
-	Description  string              `json:"description"`
-	Homepage     string              `json:"homepage"`
-	Uploaders    []string            `json:"uploaders"`
-	CreatedAt    time.Time           `json:"createdAt"`
-	Readme       *string             `json:"readme"`
-	Changelog    *string             `json:"changelog"`
-	Versions     []DetailViewVersion `json:"versions"`
-	Authors      []string            `json:"authors"`
-	Dependencies []string            `json:"dependencies"`
-	Tags         []string            `json:"tags"`
+	Name         string               `json:"name"`
+	Version      string               `json:"version"`
+	Description  string               `json:"description"`
+	Homepage     string               `json:"homepage"`
+	Uploaders    []string             `json:"uploaders"`
+	CreatedAt    time.Time            `json:"createdAt"`
+	Readme       *string              `json:"readme"`
+	Changelog    *string              `json:"changelog"`
+	Versions     []DetailViewVersion  `json:"versions"`
+	Authors      []string             `json:"authors"`
+	Dependencies []string             `json:"dependencies"`
+	Tags         []string             `json:"tags"`
+	Retracted    bool                 `json:"retracted"`
+	Advisories   []DetailViewAdvisory `json:"advisories"`
+}
+
+// DetailViewAdvisory is an advisory of a package which has not been
+// withdrawn. Affected reports whether it affects the version shown.
+type DetailViewAdvisory struct {
+	ID       string   `json:"id"`
+	Summary  string   `json:"summary"`
+	Severity string   `json:"severity"`
+	Aliases  []string `json:"aliases"`
+	Affected bool     `json:"affected"`
+}
+
+// WebAPIStatsView is the download statistics of a package. Recent counts the
+// downloads in the last Days days.
+type WebAPIStatsView struct {
+	Name     string             `json:"name"`
+	Days     int                `json:"days"`
+	Total    int                `json:"total"`
+	Recent   int                `json:"recent"`
+	Versions []StatsViewVersion `json:"versions"`
+	Daily    []StatsViewDay     `json:"daily"`
+}
+
+// StatsViewVersion holds the all-time downloads of a version, and those in
+// the last WebAPIStatsView.Days days.
+type StatsViewVersion struct {
+	Version string `json:"version"`
+	Total   int    `json:"total"`
+	Recent  int    `json:"recent"`
+}
+
+type StatsViewDay struct {
+	Date      string         `json:"date"`
+	Downloads int            `json:"downloads"`
+	Versions  map[string]int `json:"versions"`
 }
 
 type UnpubVersion struct {
@@ -50,6 +89,23 @@ type UnpubVersion struct {
 	Changelog   *string   `json:"changelog,omitempty"`
 	CreatedAt   time.Time `json:"createdAt"`
 	UpdatedAt   time.Time `json:"updatedAt"`
+
+	// ArchiveSHA256 is the hex-encoded SHA-256 digest of the archive, which is
+	// also the key it is stored under.
+	ArchiveSHA256 string `json:"archiveSha256,omitempty"`
+
+	// ExpiresAt is when a preview version published with a time-to-live is
+	// removed, or nil if it is kept forever.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+
+	// Retracted versions are only resolved by pub when nothing else satisfies
+	// a constraint, and are never the latest version unless all are.
+	Retracted bool `json:"retracted,omitempty"`
+}
+
+// Expired reports whether the version has expired at now.
+func (v UnpubVersion) Expired(now time.Time) bool {
+	return v.ExpiresAt != nil && !v.ExpiresAt.After(now)
 }
 
 func (v UnpubVersion) Pubspec() (*Pubspec, error) {
@@ -74,20 +130,177 @@ type UnpubPackage struct {
 	Downloads int                     `json:"download"`
 	CreatedAt time.Time               `json:"createdAt"`
 	UpdatedAt time.Time               `json:"updatedAt"`
+
+	// IsDiscontinued makes pub warn the users of a package, suggesting
+	// ReplacedBy instead if it is set.
+	IsDiscontinued bool   `json:"isDiscontinued,omitempty"`
+	ReplacedBy     string `json:"replacedBy,omitempty"`
+	// IsUnlisted hides a package from listings and search, while it can still
+	// be resolved by name.
+	IsUnlisted bool `json:"isUnlisted,omitempty"`
+	// TrustPolicies let identity tokens from CI publish the package.
+	TrustPolicies []TrustPolicy `json:"trustPolicies,omitempty"`
+	// Readers may read the package while it is private, as may its uploaders.
+	Readers []string `json:"readers,omitempty"`
+}
+
+// ReadableBy reports whether identity may read the package, which anyone may
+// unless it is private.
+func (pkg *UnpubPackage) ReadableBy(identity string) bool {
+	if !pkg.Private {
+		return true
+	}
+	if identity == "" {
+		return false
+	}
+	for _, email := range append(pkg.Uploaders, pkg.Readers...) {
+		if email == identity {
+			return true
+		}
+	}
+	return false
 }
 
+// AddVersion adds a version which does not exist yet, such as a backport
+// older than the latest version, and chooses the latest version again.
 func (pkg *UnpubPackage) AddVersion(version UnpubVersion) error {
 	if _, ok := pkg.Versions[version.Version]; ok {
-		return errors.New("version already exists")
-	}
-	if pkg.Latest != "" && semver.Compare("v"+pkg.Latest, "v"+version.Version) != -1 {
-		return fmt.Errorf("version must be > %s", pkg.Latest)
+		return NewError(ErrConflict, "version %s already exists", version.Version)
 	}
 	pkg.Versions[version.Version] = version
-	pkg.Latest = version.Version
+	pkg.updateLatest()
+	pkg.UpdatedAt = version.CreatedAt
+	return nil
+}
+
+// RemoveVersion deletes a version, choosing the latest version again. The
+// only version of a package cannot be removed.
+func (pkg *UnpubPackage) RemoveVersion(version string) error {
+	if _, ok := pkg.Versions[version]; !ok {
+		return ErrNotFound
+	}
+	if len(pkg.Versions) == 1 {
+		return NewError(ErrConflict, "cannot remove the only version of a package")
+	}
+	delete(pkg.Versions, version)
+	pkg.updateLatest()
+	pkg.UpdatedAt = time.Now().Truncate(time.Millisecond)
+	return nil
+}
+
+// RemoveExpired deletes the versions which have expired at now, and returns
+// them. It may remove every version, in which case the package should be
+// deleted.
+func (pkg *UnpubPackage) RemoveExpired(now time.Time) []UnpubVersion {
+	var expired []UnpubVersion
+	for version, v := range pkg.Versions {
+		if v.Expired(now) {
+			expired = append(expired, v)
+			delete(pkg.Versions, version)
+		}
+	}
+	if len(expired) > 0 {
+		pkg.updateLatest()
+	}
+	return expired
+}
+
+// RetractionWindow is how long after publication a version can be retracted
+// or restored, as on pub.dev.
+const RetractionWindow = 7 * 24 * time.Hour
+
+// ErrRetractionWindow is returned when retracting or restoring a version
+// published more than RetractionWindow ago.
+var ErrRetractionWindow = &Error{
+	Kind:    ErrForbidden,
+	Message: "versions can only be retracted or restored within 7 days of publication",
+}
+
+// SetRetracted retracts or restores a version, choosing the latest version
+// again.
+func (pkg *UnpubPackage) SetRetracted(version string, retracted bool, now time.Time) error {
+	v, ok := pkg.Versions[version]
+	if !ok {
+		return ErrNotFound
+	}
+	if now.Sub(v.CreatedAt) > RetractionWindow {
+		return ErrRetractionWindow
+	}
+	if v.Retracted == retracted {
+		return nil
+	}
+	v.Retracted = retracted
+	v.UpdatedAt = now.Truncate(time.Millisecond)
+	pkg.Versions[version] = v
+	pkg.updateLatest()
+	pkg.UpdatedAt = v.UpdatedAt
 	return nil
 }
 
+// updateLatest chooses the latest version the way pub does: the highest
+// stable version which is not retracted, or failing that the highest
+// prerelease which is not retracted. If every version is retracted, the same
+// order applies to the retracted ones.
+func (pkg *UnpubPackage) updateLatest() {
+	var latest *UnpubVersion
+	for _, v := range pkg.Versions {
+		v := v
+		if latest == nil || preferAsLatest(v, *latest) {
+			latest = &v
+		}
+	}
+	pkg.Latest = ""
+	if latest != nil {
+		pkg.Latest = latest.Version
+	}
+}
+
+// preferAsLatest reports whether pub would rather choose a than b as the
+// latest version.
+func preferAsLatest(a, b UnpubVersion) bool {
+	if a.Retracted != b.Retracted {
+		return !a.Retracted
+	}
+	aStable := semver.Prerelease("v"+a.Version) == ""
+	bStable := semver.Prerelease("v"+b.Version) == ""
+	if aStable != bStable {
+		return aStable
+	}
+	return CompareVersions(a.Version, b.Version) > 0
+}
+
+// ValidVersion reports whether version is a full MAJOR.MINOR.PATCH version,
+// optionally followed by prerelease and build identifiers, as pub requires.
+// Short forms such as 1.0, which semver otherwise accepts, are not.
+func ValidVersion(version string) bool {
+	if !semver.IsValid("v" + version) {
+		return false
+	}
+	core, _, _ := strings.Cut(version, "+")
+	core, _, _ = strings.Cut(core, "-")
+	return strings.Count(core, ".") == 2
+}
+
+// CompareVersions orders versions the way pub does, returning -1, 0 or 1.
+// Unlike semver precedence, build metadata counts: a version with it comes
+// after the same version without, so 1.0.0 < 1.0.0+1 < 1.0.0+2 < 1.0.1.
+func CompareVersions(a, b string) int {
+	if c := semver.Compare("v"+a, "v"+b); c != 0 {
+		return c
+	}
+	buildA, buildB := semver.Build("v"+a), semver.Build("v"+b)
+	switch {
+	case buildA == buildB:
+		return 0
+	case buildA == "":
+		return -1
+	case buildB == "":
+		return 1
+	}
+	// Build identifiers are ordered like prerelease identifiers.
+	return semver.Compare("v0.0.0-"+buildA[1:], "v0.0.0-"+buildB[1:])
+}
+
 func (pkg *UnpubPackage) CreateVersion(
 	version,
 	pubspec string,
@@ -127,6 +340,21 @@ func (pkg *UnpubPackage) LatestVersion() UnpubVersion {
 	return pkg.Versions[pkg.Latest]
 }
 
+// DependencyNames returns the names of the regular dependencies of the latest
+// version of pkg, sorted by name.
+func (pkg *UnpubPackage) DependencyNames() []string {
+	pubspec, err := pkg.LatestVersion().Pubspec()
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for name := range pubspec.Dependencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (pkg *UnpubPackage) ToListApiPackage() ListApiPackage {
 	latest := pkg.LatestVersion()
 	pubspec, err := latest.Pubspec()
@@ -145,4 +373,76 @@ func (pkg *UnpubPackage) ToListApiPackage() ListApiPackage {
 type UnpubQueryResult struct {
 	Count    int             `json:"count"`
 	Packages []*UnpubPackage `json:"packages"`
+	// Snippets holds excerpts matching a keyword query, by package name.
+	Snippets map[string]string `json:"snippets,omitempty"`
+}
+
+// DownloadDay returns the UTC day of t in the form used for download counts.
+func DownloadDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// DownloadStats holds the download counts of a package.
+type DownloadStats struct {
+	// Versions holds the all-time downloads of each version.
+	Versions map[string]int
+	// Daily holds downloads per day and version, ordered by day.
+	Daily []DailyDownloads
+}
+
+// DailyDownloads is the number of downloads of a version on one day.
+type DailyDownloads struct {
+	Day     string
+	Version string
+	Count   int
+}
+
+// StatsView summarizes the downloads of pkg over the given number of days up
+// to and including today. Days without downloads are included in the series.
+func (pkg *UnpubPackage) StatsView(stats *DownloadStats, days int, today time.Time) WebAPIStatsView {
+	view := WebAPIStatsView{
+		Name:  pkg.Name,
+		Days:  days,
+		Total: pkg.Downloads,
+	}
+
+	dayIndex := make(map[string]int)
+	for i := days - 1; i >= 0; i-- {
+		date := DownloadDay(today.AddDate(0, 0, -i))
+		dayIndex[date] = len(view.Daily)
+		view.Daily = append(view.Daily, StatsViewDay{
+			Date:     date,
+			Versions: map[string]int{},
+		})
+	}
+	recent := make(map[string]int)
+	for _, d := range stats.Daily {
+		i, ok := dayIndex[d.Day]
+		if !ok {
+			continue
+		}
+		view.Daily[i].Downloads += d.Count
+		view.Daily[i].Versions[d.Version] += d.Count
+		view.Recent += d.Count
+		recent[d.Version] += d.Count
+	}
+
+	versions := make(map[string]bool)
+	for version := range pkg.Versions {
+		versions[version] = true
+	}
+	for version := range stats.Versions {
+		versions[version] = true
+	}
+	for version := range versions {
+		view.Versions = append(view.Versions, StatsViewVersion{
+			Version: version,
+			Total:   stats.Versions[version],
+			Recent:  recent[version],
+		})
+	}
+	sort.Slice(view.Versions, func(i, j int) bool {
+		return CompareVersions(view.Versions[i].Version, view.Versions[j].Version) == 1
+	})
+	return view
 }
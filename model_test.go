@@ -2,6 +2,7 @@ package unpub
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -19,34 +20,184 @@ func makePkg() *UnpubPackage {
 }
 
 func TestUnpubPackageAddVersion(t *testing.T) {
-	currVersion := UnpubVersion{
-		Version: "0.1.0",
+	require := require.New(t)
+	pkg := makePkg()
+	require.ErrorIs(pkg.AddVersion(UnpubVersion{Version: "0.1.0"}), ErrConflict)
+
+	// Older versions can be published, without becoming the latest.
+	for _, v := range []struct {
+		version, latest string
+	}{
+		{"0.0.9", "0.1.0"},
+		{"0.1.1", "0.1.1"},
+		{"2.0.0", "2.0.0"},
+		{"1.4.3", "2.0.0"},
+		{"3.0.0-dev.1", "2.0.0"},
+		{"2.0.0+1", "2.0.0+1"},
+	} {
+		require.NoError(pkg.AddVersion(UnpubVersion{Version: v.version}), v.version)
+		require.Equal(v.latest, pkg.Latest, v.version)
 	}
-	prevVersion := UnpubVersion{
-		Version: "0.0.9",
+}
+
+func TestUnpubPackageLatestPrerelease(t *testing.T) {
+	require := require.New(t)
+	pkg := NewPackage("example", false, nil)
+	require.NoError(pkg.AddVersion(UnpubVersion{Version: "1.0.0-dev.1"}))
+	require.NoError(pkg.AddVersion(UnpubVersion{Version: "1.0.0-dev.2"}))
+	require.Equal("1.0.0-dev.2", pkg.Latest)
+	require.NoError(pkg.AddVersion(UnpubVersion{Version: "0.9.0"}))
+	require.Equal("0.9.0", pkg.Latest)
+
+	// A prerelease is chosen over a retracted stable version.
+	v := pkg.Versions["0.9.0"]
+	v.Retracted = true
+	pkg.Versions["0.9.0"] = v
+	pkg.updateLatest()
+	require.Equal("1.0.0-dev.2", pkg.Latest)
+}
+
+func TestValidVersion(t *testing.T) {
+	for _, version := range []string{"0.0.1", "1.0.0", "1.0.0-dev.1", "1.0.0+1", "1.0.0-beta+build.2", "10.20.30"} {
+		require.True(t, ValidVersion(version), version)
 	}
-	patchVersion := UnpubVersion{
-		Version: "0.1.1",
+	for _, version := range []string{"", "1", "1.0", "1.0-dev", "1.0+1", "v1.0.0", "01.0.0", "1.0.0.0", "1.0.0-", "latest"} {
+		require.False(t, ValidVersion(version), version)
 	}
-	minorVersion := UnpubVersion{
-		Version: "0.2.0",
+}
+
+func TestCompareVersions(t *testing.T) {
+	ordered := []string{
+		"0.9.0",
+		"1.0.0-dev.1",
+		"1.0.0-dev.2",
+		"1.0.0-dev.10",
+		"1.0.0",
+		"1.0.0+1",
+		"1.0.0+2",
+		"1.0.0+10",
+		"1.0.0+hotfix",
+		"1.0.1",
+		"2.0.0",
 	}
-	majorVersion := UnpubVersion{
-		Version: "1.0.0",
+	for i, a := range ordered {
+		for j, b := range ordered {
+			want := 0
+			switch {
+			case i < j:
+				want = -1
+			case i > j:
+				want = 1
+			}
+			require.Equal(t, want, CompareVersions(a, b), "%s <=> %s", a, b)
+		}
 	}
+}
+
+func TestUnpubPackageStatsView(t *testing.T) {
+	pkg := makePkg()
+	pkg.Downloads = 12
+	today := time.Date(2023, 3, 2, 12, 0, 0, 0, time.UTC)
+	view := pkg.StatsView(&DownloadStats{
+		Versions: map[string]int{"0.0.9": 2, "0.1.0": 10},
+		Daily: []DailyDownloads{
+			{Day: "2023-02-27", Version: "0.1.0", Count: 4},
+			{Day: "2023-02-28", Version: "0.0.9", Count: 1},
+			{Day: "2023-02-28", Version: "0.1.0", Count: 2},
+			{Day: "2023-03-02", Version: "0.1.0", Count: 3},
+		},
+	}, 3, today)
 
-	err := makePkg().AddVersion(currVersion)
-	require.Error(t, err)
+	require.Equal(t, WebAPIStatsView{
+		Name:   "example",
+		Days:   3,
+		Total:  12,
+		Recent: 6,
+		Versions: []StatsViewVersion{
+			{Version: "0.1.0", Total: 10, Recent: 5},
+			{Version: "0.0.9", Total: 2, Recent: 1},
+		},
+		Daily: []StatsViewDay{
+			{Date: "2023-02-28", Downloads: 3, Versions: map[string]int{"0.0.9": 1, "0.1.0": 2}},
+			{Date: "2023-03-01", Downloads: 0, Versions: map[string]int{}},
+			{Date: "2023-03-02", Downloads: 3, Versions: map[string]int{"0.1.0": 3}},
+		},
+	}, view)
+}
 
-	err = makePkg().AddVersion(prevVersion)
-	require.Error(t, err)
+func TestUnpubPackageRemoveVersion(t *testing.T) {
+	require := require.New(t)
+	pkg := makePkg()
+	require.NoError(pkg.AddVersion(UnpubVersion{Version: "0.2.0"}))
+	require.NoError(pkg.AddVersion(UnpubVersion{Version: "1.0.0"}))
 
-	err = makePkg().AddVersion(patchVersion)
-	require.NoError(t, err)
+	require.ErrorIs(pkg.RemoveVersion("2.0.0"), ErrNotFound)
+
+	require.NoError(pkg.RemoveVersion("1.0.0"))
+	require.Equal("0.2.0", pkg.Latest)
+	require.NoError(pkg.RemoveVersion("0.1.0"))
+	require.Equal("0.2.0", pkg.Latest)
+
+	require.Error(pkg.RemoveVersion("0.2.0"))
+	require.Len(pkg.Versions, 1)
+}
+
+func TestUnpubPackageRemoveExpired(t *testing.T) {
+	require := require.New(t)
+	now := time.Now()
+	expired, later := now.Add(-time.Minute), now.Add(time.Hour)
+
+	pkg := makePkg()
+	require.NoError(pkg.AddVersion(UnpubVersion{Version: "0.2.0+pr.1", ExpiresAt: &later}))
+	require.NoError(pkg.AddVersion(UnpubVersion{Version: "0.2.0+pr.2", ExpiresAt: &expired}))
+	require.Empty(pkg.RemoveExpired(now.Add(-time.Hour)))
+
+	removed := pkg.RemoveExpired(now)
+	require.Len(removed, 1)
+	require.Equal("0.2.0+pr.2", removed[0].Version)
+	require.Equal("0.2.0+pr.1", pkg.Latest)
+
+	removed = pkg.RemoveExpired(later)
+	require.Len(removed, 1)
+	require.Equal("0.1.0", pkg.Latest)
+	require.Len(pkg.Versions, 1)
+}
+
+func TestUnpubPackageSetRetracted(t *testing.T) {
+	require := require.New(t)
+	now := time.Now()
+	pkg := makePkg()
+	require.NoError(pkg.AddVersion(UnpubVersion{Version: "0.2.0", CreatedAt: now}))
+	require.NoError(pkg.AddVersion(UnpubVersion{Version: "0.3.0", CreatedAt: now}))
+
+	require.NoError(pkg.SetRetracted("0.3.0", true, now))
+	require.True(pkg.Versions["0.3.0"].Retracted)
+	require.Equal("0.2.0", pkg.Latest)
+	require.NoError(pkg.SetRetracted("0.2.0", true, now))
+	require.Equal("0.1.0", pkg.Latest)
+	require.NoError(pkg.SetRetracted("0.3.0", false, now))
+	require.Equal("0.3.0", pkg.Latest)
+
+	// The latest version stays retracted if all of them are.
+	require.NoError(pkg.SetRetracted("0.3.0", true, now))
+	pkg.Versions["0.1.0"] = UnpubVersion{Version: "0.1.0", Retracted: true}
+	pkg.updateLatest()
+	require.Equal("0.3.0", pkg.Latest)
+
+	require.ErrorIs(pkg.SetRetracted("0.2.0", false, now.Add(RetractionWindow+time.Minute)), ErrRetractionWindow)
+	require.ErrorIs(pkg.SetRetracted("1.0.0", true, now), ErrNotFound)
+}
 
-	err = makePkg().AddVersion(minorVersion)
-	require.NoError(t, err)
+func TestUnpubPackageReadableBy(t *testing.T) {
+	require := require.New(t)
+	pkg := NewPackage(packageName, false, []string{uploader})
+	require.True(pkg.ReadableBy(""))
+	require.True(pkg.ReadableBy("other@example.com"))
 
-	err = makePkg().AddVersion(majorVersion)
-	require.NoError(t, err)
+	pkg.Private = true
+	pkg.Readers = []string{"reader@example.com"}
+	require.False(pkg.ReadableBy(""))
+	require.False(pkg.ReadableBy("other@example.com"))
+	require.True(pkg.ReadableBy(uploader))
+	require.True(pkg.ReadableBy("reader@example.com"))
 }
@@ -0,0 +1,426 @@
+package unpub
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDCIssuer is an issuer of OIDC identity tokens, such as a CI provider,
+// whose tokens can publish packages which trust them. Its signing keys are
+// read from JWKSFile, fetched from JWKSURL, or else found through the
+// issuer's discovery document.
+type OIDCIssuer struct {
+	Issuer string `json:"issuer"`
+	// Audience must be named by the aud claim of the tokens, so tokens meant
+	// for other services cannot be replayed here.
+	Audience string `json:"audience"`
+	JWKSURL  string `json:"jwksUrl,omitempty"`
+	JWKSFile string `json:"jwksFile,omitempty"`
+}
+
+// IdentityClaims are the claims of a verified identity token.
+type IdentityClaims struct {
+	Issuer  string
+	Subject string
+	Claims  map[string]interface{}
+}
+
+// TrustPolicy lets identity tokens from Issuer publish a package when each of
+// Claims matches the claim of the same name, such as
+// {"repository": "acme/packages", "ref": "refs/tags/v*"}. Claims are matched
+// with path.Match, so * does not match a slash.
+type TrustPolicy struct {
+	Issuer string            `json:"issuer"`
+	Claims map[string]string `json:"claims"`
+}
+
+// Validate returns an ErrInvalidInput error if the policy could match tokens
+// it was not meant to.
+func (p TrustPolicy) Validate() error {
+	if p.Issuer == "" {
+		return NewError(ErrInvalidInput, "trust policy issuer is required")
+	}
+	if len(p.Claims) == 0 {
+		return NewError(ErrInvalidInput, "trust policy for %s needs at least one claim, or it would trust every token of the issuer", p.Issuer)
+	}
+	for claim, pattern := range p.Claims {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return NewError(ErrInvalidInput, "bad pattern %q for claim %s", pattern, claim)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether the policy trusts a token with the given claims.
+func (p TrustPolicy) Matches(c IdentityClaims) bool {
+	if p.Issuer != c.Issuer || len(p.Claims) == 0 {
+		return false
+	}
+	for claim, pattern := range p.Claims {
+		value, ok := c.Claims[claim].(string)
+		if !ok {
+			return false
+		}
+		if matched, _ := path.Match(pattern, value); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// String summarizes the policy for the audit log.
+func (p TrustPolicy) String() string {
+	claims := []string{}
+	for claim, pattern := range p.Claims {
+		claims = append(claims, claim+"="+pattern)
+	}
+	sort.Strings(claims)
+	return fmt.Sprintf("%s[%s]", p.Issuer, strings.Join(claims, ","))
+}
+
+// Trusts reports whether any trust policy of the package matches c.
+func (pkg *UnpubPackage) Trusts(c IdentityClaims) bool {
+	for _, p := range pkg.TrustPolicies {
+		if p.Matches(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsJWT reports whether token looks like a JWT rather than an unpub token.
+func IsJWT(token string) bool {
+	return strings.HasPrefix(token, "eyJ") && strings.Count(token, ".") == 2
+}
+
+const (
+	// jwksRefreshInterval is how long fetched keys are used before fetching
+	// them again, to pick up rotated keys.
+	jwksRefreshInterval = time.Hour
+	// jwksMinRefreshInterval limits the fetches caused by tokens signed with
+	// unknown keys.
+	jwksMinRefreshInterval = time.Minute
+	// clockSkew is how far the clocks of issuers may be off.
+	clockSkew = time.Minute
+)
+
+// OIDCVerifier verifies identity tokens from a set of issuers.
+type OIDCVerifier struct {
+	issuers map[string]*oidcKeys
+	client  *http.Client
+}
+
+// oidcKeys are the signing keys of an issuer, by key ID.
+type oidcKeys struct {
+	OIDCIssuer
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// NewOIDCVerifier returns a verifier which trusts the given issuers, reading
+// the keys of those with a JWKSFile right away.
+func NewOIDCVerifier(issuers []OIDCIssuer) (*OIDCVerifier, error) {
+	v := &OIDCVerifier{
+		issuers: make(map[string]*oidcKeys),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, issuer := range issuers {
+		if issuer.Issuer == "" || issuer.Audience == "" {
+			return nil, fmt.Errorf("issuer %q needs an issuer and an audience", issuer.Issuer)
+		}
+		if _, ok := v.issuers[issuer.Issuer]; ok {
+			return nil, fmt.Errorf("issuer %s is listed twice", issuer.Issuer)
+		}
+		keys := &oidcKeys{OIDCIssuer: issuer}
+		if issuer.JWKSFile != "" {
+			b, err := os.ReadFile(issuer.JWKSFile)
+			if err != nil {
+				return nil, err
+			}
+			if keys.keys, err = parseJWKS(b); err != nil {
+				return nil, fmt.Errorf("reading keys of %s: %w", issuer.Issuer, err)
+			}
+		}
+		v.issuers[issuer.Issuer] = keys
+	}
+	return v, nil
+}
+
+// HasIssuer reports whether tokens of issuer are verified. A nil verifier
+// has no issuers.
+func (v *OIDCVerifier) HasIssuer(issuer string) bool {
+	if v == nil {
+		return false
+	}
+	_, ok := v.issuers[issuer]
+	return ok
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Verify checks the signature, issuer, audience and lifetime of token at now,
+// and returns its claims.
+func (v *OIDCVerifier) Verify(token string, now time.Time) (IdentityClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return IdentityClaims{}, NewError(ErrUnauthorized, "malformed identity token")
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return IdentityClaims{}, err
+	}
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return IdentityClaims{}, err
+	}
+	iss, _ := claims["iss"].(string)
+	issuer, ok := v.issuers[iss]
+	if !ok {
+		return IdentityClaims{}, NewError(ErrUnauthorized, "identity tokens of issuer %q are not trusted", iss)
+	}
+	key, err := v.key(issuer, header.Kid, now)
+	if err != nil {
+		return IdentityClaims{}, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return IdentityClaims{}, NewError(ErrUnauthorized, "malformed identity token signature")
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return IdentityClaims{}, err
+	}
+
+	if !hasAudience(claims["aud"], issuer.Audience) {
+		return IdentityClaims{}, NewError(ErrUnauthorized, "identity token is not meant for audience %s", issuer.Audience)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || !now.Before(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return IdentityClaims{}, NewError(ErrUnauthorized, "identity token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return IdentityClaims{}, NewError(ErrUnauthorized, "identity token is not valid yet")
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return IdentityClaims{}, NewError(ErrUnauthorized, "identity token has no subject")
+	}
+	return IdentityClaims{
+		Issuer:  iss,
+		Subject: sub,
+		Claims:  claims,
+	}, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err == nil {
+		err = json.Unmarshal(b, v)
+	}
+	if err != nil {
+		return NewError(ErrUnauthorized, "malformed identity token: %v", err)
+	}
+	return nil
+}
+
+// hasAudience reports whether the aud claim, a string or a list of them,
+// names audience.
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if alg == "ES256" && len(sig) == 64 {
+			r := new(big.Int).SetBytes(sig[:32])
+			s := new(big.Int).SetBytes(sig[32:])
+			if ecdsa.Verify(key, digest[:], r, s) {
+				return nil
+			}
+		}
+	}
+	return NewError(ErrUnauthorized, "identity token signature is invalid")
+}
+
+// key returns the key of issuer with the given ID, fetching the keys again if
+// they are stale or do not include it. Stale keys are still used while the
+// issuer cannot be reached.
+func (v *OIDCVerifier) key(issuer *oidcKeys, kid string, now time.Time) (crypto.PublicKey, error) {
+	issuer.mu.Lock()
+	defer issuer.mu.Unlock()
+	key, ok := issuer.keys[kid]
+	if issuer.JWKSFile == "" {
+		stale := now.Sub(issuer.fetchedAt) > jwksRefreshInterval
+		if stale || (!ok && now.Sub(issuer.fetchedAt) > jwksMinRefreshInterval) {
+			keys, err := v.fetchJWKS(issuer.OIDCIssuer)
+			if err != nil && !ok {
+				return nil, fmt.Errorf("fetching keys of %s: %w", issuer.Issuer, err)
+			}
+			if err == nil {
+				issuer.keys = keys
+				issuer.fetchedAt = now
+				key, ok = issuer.keys[kid]
+			}
+		}
+	}
+	if !ok {
+		return nil, NewError(ErrUnauthorized, "identity token is signed with unknown key %q", kid)
+	}
+	return key, nil
+}
+
+func (v *OIDCVerifier) fetchJWKS(issuer OIDCIssuer) (map[string]crypto.PublicKey, error) {
+	jwksURL := issuer.JWKSURL
+	if jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		b, err := v.get(strings.TrimSuffix(issuer.Issuer, "/") + "/.well-known/openid-configuration")
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &discovery); err != nil {
+			return nil, err
+		}
+		if discovery.JWKSURI == "" {
+			return nil, fmt.Errorf("discovery document has no jwks_uri")
+		}
+		jwksURL = discovery.JWKSURI
+	}
+	b, err := v.get(jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(b)
+}
+
+func (v *OIDCVerifier) get(url string) ([]byte, error) {
+	resp, err := v.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: status %d", url, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// jwk is a JSON Web Key, of which RSA and P-256 signing keys are supported.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS returns the signing keys of a JSON Web Key Set by key ID,
+// skipping keys of other types.
+func parseJWKS(b []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		var err error
+		switch {
+		case k.Kty == "RSA":
+			key, err = k.rsaKey()
+		case k.Kty == "EC" && k.Crv == "P-256":
+			key, err = k.ecKey()
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jwk) rsaKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	exponent := new(big.Int).SetBytes(e)
+	if len(n) < 256 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("unsupported RSA key")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
+
+func (k jwk) ecKey() (*ecdsa.PublicKey, error) {
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	if len(x) != 32 || len(y) != 32 {
+		return nil, fmt.Errorf("bad P-256 coordinates")
+	}
+	// Parsing the uncompressed point checks that it is on the curve.
+	point := append(append([]byte{4}, x...), y...)
+	if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+		return nil, err
+	}
+	return &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}, nil
+}
@@ -0,0 +1,211 @@
+package unpub
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testAudience = "https://unpub.example.com"
+
+// testIssuer is a stand-in OIDC issuer which signs tokens with either an RSA
+// or a P-256 key.
+type testIssuer struct {
+	url string
+	kid string
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func newTestIssuer(t *testing.T, url, kid string, ec bool) *testIssuer {
+	issuer := &testIssuer{url: url, kid: kid}
+	var err error
+	if ec {
+		issuer.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	} else {
+		issuer.rsa, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	require.NoError(t, err)
+	return issuer
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (i *testIssuer) jwks() []byte {
+	key := map[string]string{"kid": i.kid, "use": "sig"}
+	if i.ec != nil {
+		key["kty"], key["crv"] = "EC", "P-256"
+		key["x"], key["y"] = b64(i.ec.X.FillBytes(make([]byte, 32))), b64(i.ec.Y.FillBytes(make([]byte, 32)))
+	} else {
+		key["kty"] = "RSA"
+		key["n"], key["e"] = b64(i.rsa.N.Bytes()), b64([]byte{1, 0, 1})
+	}
+	b, _ := json.Marshal(map[string]interface{}{"keys": []interface{}{key}})
+	return b
+}
+
+// token signs a token for testAudience expiring in an hour, with claims
+// added to or replacing the standard ones.
+func (i *testIssuer) token(t *testing.T, claims map[string]interface{}) string {
+	payload := map[string]interface{}{
+		"iss":        i.url,
+		"aud":        testAudience,
+		"sub":        "repo:acme/packages:ref:refs/tags/v1.0.0",
+		"repository": "acme/packages",
+		"ref":        "refs/tags/v1.0.0",
+		"exp":        time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		payload[k] = v
+	}
+	alg := "RS256"
+	if i.ec != nil {
+		alg = "ES256"
+	}
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": i.kid, "typ": "JWT"})
+	require.NoError(t, err)
+	body, err := json.Marshal(payload)
+	require.NoError(t, err)
+	signed := b64(header) + "." + b64(body)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	if i.ec != nil {
+		r, s, err := ecdsa.Sign(rand.Reader, i.ec, digest[:])
+		require.NoError(t, err)
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	} else {
+		sig, err = rsa.SignPKCS1v15(rand.Reader, i.rsa, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+	}
+	return signed + "." + b64(sig)
+}
+
+func TestOIDCVerifierJWKSFile(t *testing.T) {
+	require := require.New(t)
+	issuer := newTestIssuer(t, "https://ci.example.com", "key-1", false)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(os.WriteFile(jwksFile, issuer.jwks(), 0o644))
+	v, err := NewOIDCVerifier([]OIDCIssuer{{Issuer: issuer.url, Audience: testAudience, JWKSFile: jwksFile}})
+	require.NoError(err)
+	require.True(v.HasIssuer(issuer.url))
+	require.False(v.HasIssuer("https://other.example.com"))
+
+	token := issuer.token(t, nil)
+	require.True(IsJWT(token))
+	claims, err := v.Verify(token, time.Now())
+	require.NoError(err)
+	require.Equal(issuer.url, claims.Issuer)
+	require.Equal("repo:acme/packages:ref:refs/tags/v1.0.0", claims.Subject)
+	require.Equal("acme/packages", claims.Claims["repository"])
+
+	_, err = v.Verify(issuer.token(t, map[string]interface{}{"aud": []string{"other", testAudience}}), time.Now())
+	require.NoError(err)
+
+	impostor := newTestIssuer(t, issuer.url, "key-1", false)
+	other := newTestIssuer(t, "https://other.example.com", "key-1", false)
+	for name, token := range map[string]string{
+		"audience":  issuer.token(t, map[string]interface{}{"aud": "https://pub.dev"}),
+		"expired":   issuer.token(t, map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}),
+		"not yet":   issuer.token(t, map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()}),
+		"subject":   issuer.token(t, map[string]interface{}{"sub": ""}),
+		"signature": impostor.token(t, nil),
+		"issuer":    other.token(t, nil),
+		"malformed": "eyJhbGciOiJub25lIn0.e30.",
+	} {
+		_, err := v.Verify(token, time.Now())
+		require.ErrorIs(err, ErrUnauthorized, name)
+	}
+
+	_, err = NewOIDCVerifier([]OIDCIssuer{{Issuer: issuer.url, JWKSFile: jwksFile}})
+	require.Error(err)
+}
+
+func TestOIDCVerifierDiscovery(t *testing.T) {
+	require := require.New(t)
+	var issuer atomic.Pointer[testIssuer]
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"jwks_uri": issuer.Load().url + "/keys"})
+		case "/keys":
+			fetches.Add(1)
+			w.Write(issuer.Load().jwks())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	issuer.Store(newTestIssuer(t, srv.URL, "key-1", true))
+	v, err := NewOIDCVerifier([]OIDCIssuer{{Issuer: srv.URL, Audience: testAudience}})
+	require.NoError(err)
+
+	now := time.Now()
+	_, err = v.Verify(issuer.Load().token(t, nil), now)
+	require.NoError(err)
+	_, err = v.Verify(issuer.Load().token(t, nil), now)
+	require.NoError(err)
+	require.Equal(int32(1), fetches.Load())
+
+	// Rotated keys are fetched, but not more than once a minute.
+	issuer.Store(newTestIssuer(t, srv.URL, "key-2", true))
+	_, err = v.Verify(issuer.Load().token(t, nil), now)
+	require.ErrorIs(err, ErrUnauthorized)
+	_, err = v.Verify(issuer.Load().token(t, nil), now.Add(2*time.Minute))
+	require.NoError(err)
+	require.Equal(int32(2), fetches.Load())
+}
+
+func TestTrustPolicy(t *testing.T) {
+	require := require.New(t)
+	policy := TrustPolicy{
+		Issuer: "https://ci.example.com",
+		Claims: map[string]string{"repository": "acme/packages", "ref": "refs/tags/v*"},
+	}
+	require.NoError(policy.Validate())
+	require.Equal("https://ci.example.com[ref=refs/tags/v*,repository=acme/packages]", policy.String())
+
+	claims := func(issuer, repository, ref string) IdentityClaims {
+		return IdentityClaims{
+			Issuer:  issuer,
+			Subject: "repo:" + repository,
+			Claims:  map[string]interface{}{"repository": repository, "ref": ref},
+		}
+	}
+	require.True(policy.Matches(claims("https://ci.example.com", "acme/packages", "refs/tags/v1.0.0")))
+	require.False(policy.Matches(claims("https://ci.example.com", "acme/packages", "refs/heads/main")))
+	require.False(policy.Matches(claims("https://ci.example.com", "acme/packages", "refs/tags/v1/evil")))
+	require.False(policy.Matches(claims("https://ci.example.com", "acme/other", "refs/tags/v1.0.0")))
+	require.False(policy.Matches(claims("https://other.example.com", "acme/packages", "refs/tags/v1.0.0")))
+	require.False(policy.Matches(IdentityClaims{Issuer: "https://ci.example.com"}))
+
+	pkg := NewPackage(packageName, false, []string{uploader})
+	require.False(pkg.Trusts(claims("https://ci.example.com", "acme/packages", "refs/tags/v1.0.0")))
+	pkg.TrustPolicies = []TrustPolicy{policy}
+	require.True(pkg.Trusts(claims("https://ci.example.com", "acme/packages", "refs/tags/v1.0.0")))
+
+	for name, invalid := range map[string]TrustPolicy{
+		"issuer":  {Claims: policy.Claims},
+		"claims":  {Issuer: policy.Issuer},
+		"pattern": {Issuer: policy.Issuer, Claims: map[string]string{"ref": "refs/["}},
+		"empty":   {Issuer: policy.Issuer, Claims: map[string]string{"ref": ""}},
+	} {
+		require.ErrorIs(invalid.Validate(), ErrInvalidInput, name)
+	}
+}
@@ -0,0 +1,341 @@
+package unpub
+
+import (
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Field weights used when indexing a package for search.
+const (
+	searchWeightName        = 5.0
+	searchWeightDescription = 3.0
+	searchWeightURL         = 1.0
+	searchWeightReadme      = 1.0
+)
+
+// searchNameBonus is added to the score of packages whose name contains the
+// raw query, so exact and prefix name matches rank above text matches.
+var searchNameBonus = map[int]float64{0: 20, 1: 10, 2: 5}
+
+var searchStopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "by": true, "for": true, "from": true, "in": true, "into": true,
+	"is": true, "it": true, "of": true, "on": true, "or": true, "that": true,
+	"the": true, "this": true, "to": true, "with": true, "you": true, "your": true,
+}
+
+// searchDocument is the indexed form of a package's latest version.
+type searchDocument struct {
+	Version     string             `json:"version"`
+	Description string             `json:"description"`
+	Readme      string             `json:"readme"`
+	Terms       map[string]float64 `json:"terms"`
+}
+
+// newSearchDocument indexes the name of a package and the description,
+// homepage, repository and README of its latest version.
+func newSearchDocument(name string, latest UnpubVersion) searchDocument {
+	doc := searchDocument{
+		Version: latest.Version,
+		Terms:   make(map[string]float64),
+	}
+	add := func(text string, weight float64) {
+		for _, term := range searchTerms(text) {
+			doc.Terms[term] += weight
+		}
+	}
+	add(name, searchWeightName)
+	if pubspec, err := latest.Pubspec(); err == nil {
+		doc.Description = pubspec.Description
+		add(pubspec.Description, searchWeightDescription)
+		add(urlSearchText(pubspec.Homepage), searchWeightURL)
+		add(urlSearchText(pubspec.Repository), searchWeightURL)
+	}
+	if latest.Readme != nil {
+		doc.Readme = plainText(*latest.Readme)
+		add(doc.Readme, searchWeightReadme)
+	}
+	return doc
+}
+
+// urlSearchText returns the host and path of a URL, since the scheme carries
+// no meaning for search.
+func urlSearchText(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	return u.Host + " " + u.Path
+}
+
+var (
+	markdownLinkRegexp   = regexp.MustCompile(`!?\[([^\]]*)\]\([^)]*\)`)
+	markdownSyntaxRegexp = regexp.MustCompile("[#*>`|~]+")
+)
+
+// plainText strips common markdown syntax and collapses whitespace.
+func plainText(markdown string) string {
+	text := markdownLinkRegexp.ReplaceAllString(markdown, "$1")
+	text = markdownSyntaxRegexp.ReplaceAllString(text, " ")
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// searchWords splits text into lowercase words. Underscores separate words so
+// that package names like http_parser match "parser".
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// searchTerms tokenizes and stems text, dropping stop words.
+func searchTerms(text string) []string {
+	var terms []string
+	for _, word := range searchWords(text) {
+		if len(word) < 2 || searchStopWords[word] {
+			continue
+		}
+		terms = append(terms, stem(word))
+	}
+	return terms
+}
+
+// queryTerms returns the distinct search terms of a query.
+func queryTerms(query string) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, term := range searchTerms(query) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+func isVowel(word string, i int) bool {
+	switch word[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return true
+	case 'y':
+		return i > 0 && !isVowel(word, i-1)
+	}
+	return false
+}
+
+func hasVowel(word string) bool {
+	for i := range word {
+		if isVowel(word, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// stemSuffixes are replaced in order by the first matching entry, provided
+// enough of the word is left.
+var stemSuffixes = []struct{ suffix, replacement string }{
+	{"ational", "ate"},
+	{"ization", "ize"},
+	{"fulness", "ful"},
+	{"iveness", "ive"},
+	{"ation", "ate"},
+	{"ness", ""},
+	{"ment", ""},
+	{"izer", "ize"},
+	{"ator", "ate"},
+	{"ably", "able"},
+	{"ibly", "ible"},
+	{"ally", "al"},
+	{"ful", ""},
+}
+
+// stem reduces an English word to a common root, following the plural and
+// -ed/-ing rules of the Porter stemmer plus its most common derivational
+// suffixes. Words which are not plain ASCII letters are returned unchanged.
+func stem(word string) string {
+	for _, r := range word {
+		if r < 'a' || r > 'z' {
+			return word
+		}
+	}
+	if len(word) <= 3 {
+		return word
+	}
+
+	// Plurals
+	switch {
+	case strings.HasSuffix(word, "sses"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "ies"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "ss"), strings.HasSuffix(word, "us"), strings.HasSuffix(word, "is"):
+	case strings.HasSuffix(word, "s"):
+		word = word[:len(word)-1]
+	}
+
+	// Past tense and gerunds
+	for _, suffix := range []string{"ing", "ed"} {
+		if !strings.HasSuffix(word, suffix) {
+			continue
+		}
+		base := word[:len(word)-len(suffix)]
+		if len(base) < 3 || !hasVowel(base) {
+			break
+		}
+		word = base
+		n := len(word)
+		switch {
+		case strings.HasSuffix(word, "at"), strings.HasSuffix(word, "bl"), strings.HasSuffix(word, "iz"):
+			word += "e"
+		case word[n-1] == word[n-2] && !isVowel(word, n-1) && !strings.ContainsRune("lsz", rune(word[n-1])):
+			word = word[:n-1]
+		}
+		break
+	}
+
+	if strings.HasSuffix(word, "y") && len(word) > 3 && hasVowel(word[:len(word)-1]) {
+		word = word[:len(word)-1] + "i"
+	}
+
+	for _, s := range stemSuffixes {
+		if strings.HasSuffix(word, s.suffix) {
+			base := word[:len(word)-len(s.suffix)]
+			if len(base) >= 3 && hasVowel(base) {
+				word = base + s.replacement
+			}
+			break
+		}
+	}
+	return word
+}
+
+// searchPosting records the weight of a term in a package's document.
+type searchPosting struct {
+	Package string
+	Weight  float64
+}
+
+// searchHit is a package matching a search query.
+type searchHit struct {
+	Package string
+	Score   float64
+}
+
+// rankSearch scores packages against a query using TF-IDF over the postings
+// of each query term. A package matches if it contains every query term or if
+// its name contains the raw keyword. names holds every package name. Hits are
+// returned best first.
+func rankSearch(keyword string, terms []string, postings map[string][]searchPosting, names []string) []searchHit {
+	scores := make(map[string]float64)
+	matched := make(map[string]int)
+	for _, term := range terms {
+		list := postings[term]
+		if len(list) == 0 {
+			continue
+		}
+		idf := math.Log(1 + float64(len(names))/float64(len(list)))
+		for _, p := range list {
+			scores[p.Package] += (1 + math.Log(p.Weight)) * idf
+			matched[p.Package]++
+		}
+	}
+
+	var hits []searchHit
+	for _, name := range names {
+		rank := nameRank(name, keyword)
+		if rank < 0 && (len(terms) == 0 || matched[name] < len(terms)) {
+			continue
+		}
+		score := scores[name]
+		if rank >= 0 {
+			score += searchNameBonus[rank]
+		}
+		hits = append(hits, searchHit{Package: name, Score: score})
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		return hits[i].Score > hits[j].Score
+	})
+	return hits
+}
+
+// nameRank reports how closely a package name matches keyword: 0 for an exact
+// match, 1 for a prefix, 2 for a substring and -1 otherwise.
+func nameRank(name, keyword string) int {
+	switch {
+	case keyword == "":
+		return -1
+	case name == keyword:
+		return 0
+	case strings.HasPrefix(name, keyword):
+		return 1
+	case strings.Contains(name, keyword):
+		return 2
+	default:
+		return -1
+	}
+}
+
+// snippetRadius is the number of bytes of context shown around a match.
+const snippetRadius = 80
+
+// snippet returns an excerpt of the description or README around the first
+// word matching one of terms, or an empty string if neither matches.
+func (doc searchDocument) snippet(terms []string) string {
+	want := make(map[string]bool)
+	for _, term := range terms {
+		want[term] = true
+	}
+	for _, text := range []string{doc.Description, doc.Readme} {
+		lower := strings.ToLower(text)
+		if len(lower) != len(text) {
+			text = lower
+		}
+		offset := 0
+		for _, word := range searchWords(text) {
+			i := strings.Index(lower[offset:], word)
+			if i < 0 {
+				break
+			}
+			start := offset + i
+			offset = start + len(word)
+			if want[stem(word)] {
+				return excerpt(text, start, offset)
+			}
+		}
+	}
+	return ""
+}
+
+// excerpt returns text[start:end] with up to snippetRadius bytes of context on
+// either side, trimmed to word boundaries.
+func excerpt(text string, start, end int) string {
+	from := start - snippetRadius
+	prefix := "…"
+	if from <= 0 {
+		from, prefix = 0, ""
+	} else if i := strings.IndexByte(text[from:start], ' '); i >= 0 {
+		from += i + 1
+	} else {
+		for !utf8.RuneStart(text[from]) {
+			from++
+		}
+	}
+	to := end + snippetRadius
+	suffix := "…"
+	if to >= len(text) {
+		to, suffix = len(text), ""
+	} else if i := strings.LastIndexByte(text[end:to], ' '); i >= 0 {
+		to = end + i
+	} else {
+		for !utf8.RuneStart(text[to]) {
+			to--
+		}
+	}
+	return prefix + text[from:to] + suffix
+}
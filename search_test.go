@@ -0,0 +1,50 @@
+package unpub
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStem(t *testing.T) {
+	for word, want := range map[string]string{
+		"logging":    "log",
+		"logs":       "log",
+		"caresses":   "caress",
+		"libraries":  "librari",
+		"library":    "librari",
+		"hopping":    "hop",
+		"serialized": "serialize",
+		"connection": "connection",
+		"authorized": "authorize",
+		"generation": "generate",
+		"http":       "http",
+		"status":     "status",
+		"oauth2":     "oauth2",
+	} {
+		require.Equal(t, want, stem(word), word)
+	}
+}
+
+func TestSearchTerms(t *testing.T) {
+	require.Equal(t,
+		[]string{"http", "parser", "parse", "request", "and", "response"},
+		searchTerms("http_parser: Parses the requests & ANDs responses"),
+	)
+	require.Equal(t, []string{"log", "logger"}, queryTerms("logging logger logs"))
+}
+
+func TestSearchDocumentSnippet(t *testing.T) {
+	doc := searchDocument{
+		Description: "A short description.",
+		Readme:      strings.Repeat("filler ", 30) + "Supports OAuth logins. " + strings.Repeat("more ", 30),
+	}
+	snippet := doc.snippet([]string{"login"})
+	require.True(t, strings.HasPrefix(snippet, "…filler"), snippet)
+	require.True(t, strings.HasSuffix(snippet, "more…"), snippet)
+	require.Contains(t, snippet, "Supports OAuth logins.")
+
+	require.Equal(t, "A short description.", doc.snippet([]string{"short"}))
+	require.Equal(t, "", doc.snippet([]string{"missing"}))
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dnys1/unpub"
+	"github.com/gorilla/mux"
+)
+
+// GetAdvisories serves the security advisories of a package in the OSV format,
+// including withdrawn ones so pub can stop warning about them.
+func (s *UnpubServiceImpl) GetAdvisories(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.authorizeRead(w, r)
+	if !ok {
+		return
+	}
+	pkgName := mux.Vars(r)["name"]
+	pkg, err := s.DB.QueryPackage(pkgName)
+	if err != nil {
+		if errors.Is(err, unpub.ErrNotFound) {
+			http.Redirect(w, r, fmt.Sprintf("https://pub.dev%s", r.URL.Path), http.StatusFound)
+			return
+		}
+		writeInternalErr(w, err)
+		return
+	}
+	if !c.canRead(&pkg) {
+		s.writeHidden(w, c, pkgName)
+		return
+	}
+	advisories, err := s.DB.QueryAdvisories(pkgName)
+	if err != nil {
+		writeInternalErr(w, err)
+		return
+	}
+
+	osv := []unpub.OSVAdvisory{}
+	for _, advisory := range advisories {
+		osv = append(osv, advisory.OSV())
+	}
+	writeJSON(w, struct {
+		Advisories        []unpub.OSVAdvisory `json:"advisories"`
+		AdvisoriesUpdated *time.Time          `json:"advisoriesUpdated"`
+	}{
+		Advisories:        osv,
+		AdvisoriesUpdated: unpub.AdvisoriesUpdated(advisories),
+	})
+}
+
+// CreateAdvisory publishes a new advisory for a package from the request body.
+func (s *UnpubServiceImpl) CreateAdvisory(w http.ResponseWriter, r *http.Request) {
+	identity, ok := s.authorize(w, r, unpub.ScopeAdmin)
+	if !ok {
+		return
+	}
+	pkgName := mux.Vars(r)["name"]
+	var advisory unpub.Advisory
+	if err := json.NewDecoder(r.Body).Decode(&advisory); err != nil {
+		writeBadRequest(w, fmt.Errorf("bad advisory: %v", err))
+		return
+	}
+	now := time.Now().UTC()
+	advisory.Package = pkgName
+	advisory.Published = now
+	advisory.Modified = now
+	advisory.Withdrawn = nil
+	if err := advisory.Validate(); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	if _, err := s.DB.QueryPackage(pkgName); err != nil {
+		if errors.Is(err, unpub.ErrNotFound) {
+			writeNotFound(w, "package %s not found", pkgName)
+			return
+		}
+		writeInternalErr(w, err)
+		return
+	}
+	existing, err := s.findAdvisory(pkgName, advisory.ID)
+	if err == nil {
+		writeBadRequest(w, unpub.NewError(unpub.ErrConflict, "advisory %s already exists", existing.ID))
+		return
+	}
+	if !errors.Is(err, unpub.ErrNotFound) {
+		writeInternalErr(w, err)
+		return
+	}
+	if err := s.DB.SaveAdvisory(advisory); err != nil {
+		writeInternalErr(w, err)
+		return
+	}
+	s.audit(r, unpub.AuditEvent{
+		Action:  unpub.AuditAdvisory,
+		Actor:   identity,
+		Package: pkgName,
+		After:   advisory.ID,
+	})
+
+	writeJSON(w, advisory)
+}
+
+// WithdrawAdvisory marks an advisory as withdrawn. It is still served, so
+// clients which have cached it learn that it no longer applies.
+func (s *UnpubServiceImpl) WithdrawAdvisory(w http.ResponseWriter, r *http.Request) {
+	identity, ok := s.authorize(w, r, unpub.ScopeAdmin)
+	if !ok {
+		return
+	}
+	vars := mux.Vars(r)
+	pkgName, id := vars["name"], vars["id"]
+	advisory, err := s.findAdvisory(pkgName, id)
+	if err != nil {
+		if errors.Is(err, unpub.ErrNotFound) {
+			writeNotFound(w, "advisory %s of %s not found", id, pkgName)
+			return
+		}
+		writeInternalErr(w, err)
+		return
+	}
+	if advisory.Withdrawn == nil {
+		now := time.Now().UTC()
+		advisory.Withdrawn = &now
+		advisory.Modified = now
+		if err := s.DB.SaveAdvisory(*advisory); err != nil {
+			writeInternalErr(w, err)
+			return
+		}
+		s.audit(r, unpub.AuditEvent{
+			Action:  unpub.AuditWithdrawAdvisory,
+			Actor:   identity,
+			Package: pkgName,
+			Before:  advisory.ID,
+		})
+	}
+
+	writeJSON(w, advisory)
+}
+
+func (s *UnpubServiceImpl) findAdvisory(pkgName, id string) (*unpub.Advisory, error) {
+	advisories, err := s.DB.QueryAdvisories(pkgName)
+	if err != nil {
+		return nil, err
+	}
+	for i := range advisories {
+		if advisories[i].ID == id {
+			return &advisories[i], nil
+		}
+	}
+	return nil, unpub.ErrNotFound
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dnys1/unpub"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdvisories(t *testing.T) {
+	require := require.New(t)
+	s := newDiskService(t)
+	s.UploaderEmail = "test@example.com"
+	r := mux.NewRouter()
+	SetupRoutes(r, s)
+	require.NoError(s.DB.SavePackage(newTestPackage(t, "my_pkg", "1.0.0")))
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+	type advisoriesResponse struct {
+		Advisories        []unpub.OSVAdvisory `json:"advisories"`
+		AdvisoriesUpdated *string             `json:"advisoriesUpdated"`
+	}
+	advisories := func() advisoriesResponse {
+		w := do(http.MethodGet, "/api/packages/my_pkg/advisories", "")
+		require.Equal(http.StatusOK, w.Code, w.Body.String())
+		var resp advisoriesResponse
+		require.NoError(json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+
+	resp := advisories()
+	require.Empty(resp.Advisories)
+	require.Nil(resp.AdvisoriesUpdated)
+	w := do(http.MethodGet, "/api/packages/my_pkg", "")
+	require.NotContains(w.Body.String(), "advisoriesUpdated")
+	w = do(http.MethodGet, "/api/packages/other_pkg/advisories", "")
+	require.Equal(http.StatusFound, w.Code)
+
+	advisory := `{
+		"id": "UNPUB-2024-1",
+		"summary": "Path traversal",
+		"severity": "HIGH",
+		"aliases": ["CVE-2024-0001"],
+		"affected": [{"fixed": "1.0.1"}],
+		"references": [{"type": "ADVISORY", "url": "https://example.com/UNPUB-2024-1"}]
+	}`
+	w = do(http.MethodPost, "/admin/packages/my_pkg/advisories", advisory)
+	require.Equal(http.StatusOK, w.Code, w.Body.String())
+	w = do(http.MethodPost, "/admin/packages/my_pkg/advisories", advisory)
+	require.Equal(http.StatusConflict, w.Code)
+	w = do(http.MethodPost, "/admin/packages/my_pkg/advisories", `{"id": "UNPUB-2024-2", "summary": "Bad", "severity": "HIGH"}`)
+	require.Equal(http.StatusBadRequest, w.Code)
+	w = do(http.MethodPost, "/admin/packages/other_pkg/advisories", advisory)
+	require.Equal(http.StatusNotFound, w.Code)
+
+	resp = advisories()
+	require.Len(resp.Advisories, 1)
+	require.Equal("UNPUB-2024-1", resp.Advisories[0].ID)
+	require.Equal("my_pkg", resp.Advisories[0].Affected[0].Package.Name)
+	require.Nil(resp.Advisories[0].Withdrawn)
+	require.NotNil(resp.AdvisoriesUpdated)
+	w = do(http.MethodGet, "/api/packages/my_pkg", "")
+	require.Contains(w.Body.String(), `"advisoriesUpdated":"`+*resp.AdvisoriesUpdated+`"`)
+
+	var details struct {
+		Data unpub.WebAPIDetailView `json:"data"`
+	}
+	w = do(http.MethodGet, "/webapi/package/my_pkg/1.0.0", "")
+	require.Equal(http.StatusOK, w.Code)
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &details))
+	require.Equal([]unpub.DetailViewAdvisory{{
+		ID:       "UNPUB-2024-1",
+		Summary:  "Path traversal",
+		Severity: unpub.SeverityHigh,
+		Aliases:  []string{"CVE-2024-0001"},
+		Affected: true,
+	}}, details.Data.Advisories)
+
+	w = do(http.MethodDelete, "/admin/packages/my_pkg/advisories/UNPUB-2024-1", "")
+	require.Equal(http.StatusOK, w.Code, w.Body.String())
+	w = do(http.MethodDelete, "/admin/packages/my_pkg/advisories/UNPUB-2024-2", "")
+	require.Equal(http.StatusNotFound, w.Code)
+
+	// Withdrawn advisories are still served, but no longer shown.
+	resp = advisories()
+	require.Len(resp.Advisories, 1)
+	require.NotNil(resp.Advisories[0].Withdrawn)
+	w = do(http.MethodGet, "/webapi/package/my_pkg/1.0.0", "")
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &details))
+	require.Empty(details.Data.Advisories)
+
+	audit, err := s.DB.QueryAudit(unpub.AuditQuery{Package: "my_pkg"})
+	require.NoError(err)
+	require.Len(audit.Events, 2)
+	require.Equal(unpub.AuditWithdrawAdvisory, audit.Events[0].Action)
+	require.Equal(unpub.AuditAdvisory, audit.Events[1].Action)
+}
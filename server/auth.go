@@ -0,0 +1,308 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dnys1/unpub"
+	"github.com/gorilla/mux"
+)
+
+// Authentication modes, which choose the requests that need a bearer token.
+const (
+	// AuthNone lets anyone do anything as UploaderEmail.
+	AuthNone = "none"
+	// AuthWrite requires a token to publish or administer the registry.
+	AuthWrite = "write"
+	// AuthAll also requires a token to read packages.
+	AuthAll = "all"
+)
+
+// ValidAuth reports whether mode is one of the authentication modes.
+func ValidAuth(mode string) bool {
+	return mode == "" || mode == AuthNone || mode == AuthWrite || mode == AuthAll
+}
+
+// requiresToken reports whether requests needing scope must present a token.
+func (s *UnpubServiceImpl) requiresToken(scope string) bool {
+	switch s.Auth {
+	case AuthWrite:
+		return scope != unpub.ScopeRead
+	case AuthAll:
+		return true
+	default:
+		return false
+	}
+}
+
+// caller is who makes a request.
+type caller struct {
+	identity string
+	// claims are those of an identity token, which can only act on packages
+	// whose trust policies match them.
+	claims *unpub.IdentityClaims
+	// admin callers can read every package.
+	admin bool
+}
+
+func (c caller) anonymous() bool {
+	return c.identity == "" && c.claims == nil && !c.admin
+}
+
+// canRead reports whether the caller may read pkg. Private packages can be
+// read by admins, by the uploaders and readers of the package, and by the
+// identity tokens it trusts.
+func (c caller) canRead(pkg *unpub.UnpubPackage) bool {
+	switch {
+	case c.admin || !pkg.Private:
+		return true
+	case c.claims != nil:
+		return pkg.Trusts(*c.claims)
+	default:
+		return pkg.ReadableBy(c.identity)
+	}
+}
+
+// authorize returns the identity making r if it may act within scope.
+// Otherwise it writes a challenge, which pub shows to the user, and returns
+// false. Without authentication every request is made as UploaderEmail.
+// Identity tokens are only accepted for reading; uploads authenticate to check
+// them against the trust policies of the package instead.
+func (s *UnpubServiceImpl) authorize(w http.ResponseWriter, r *http.Request, scope string) (string, bool) {
+	c, ok := s.authenticate(w, r, scope)
+	if ok && c.claims != nil && scope != unpub.ScopeRead {
+		writeAuthError(w, unpub.NewError(unpub.ErrForbidden,
+			"Identity tokens can only publish versions of packages which trust them."))
+		return "", false
+	}
+	return c.identity, ok
+}
+
+// authenticate is authorize, but also accepts identity tokens, returning
+// their claims.
+func (s *UnpubServiceImpl) authenticate(w http.ResponseWriter, r *http.Request, scope string) (caller, bool) {
+	if !s.requiresToken(scope) {
+		return caller{identity: s.UploaderEmail, admin: true}, true
+	}
+	return s.verifyBearer(w, r, scope)
+}
+
+// authorizeRead returns the caller reading packages, which can only read the
+// private ones it canRead. A token is verified if one is presented, even when
+// reading needs none, and callers without one may only read public packages.
+// Without authentication anyone may read every package.
+func (s *UnpubServiceImpl) authorizeRead(w http.ResponseWriter, r *http.Request) (caller, bool) {
+	if s.Auth == "" || s.Auth == AuthNone {
+		return caller{identity: s.UploaderEmail, admin: true}, true
+	}
+	if _, ok := bearerToken(r); !ok && !s.requiresToken(unpub.ScopeRead) {
+		return caller{}, true
+	}
+	return s.verifyBearer(w, r, unpub.ScopeRead)
+}
+
+// writeHidden responds to a caller which cannot read the private package
+// pkgName as if it did not exist, unless the caller could authenticate to
+// read it.
+func (s *UnpubServiceImpl) writeHidden(w http.ResponseWriter, c caller, pkgName string) {
+	if c.anonymous() {
+		writeAuthError(w, unpub.NewError(unpub.ErrUnauthorized,
+			"Authentication is required to read %s. Create a token with your registry admin, then run `dart pub token add %s`.", pkgName, s.Addr))
+		return
+	}
+	writeNotFound(w, "package %s not found", pkgName)
+}
+
+// checkRead writes an error and returns false unless c can read the package
+// pkgName, or it does not exist.
+func (s *UnpubServiceImpl) checkRead(w http.ResponseWriter, c caller, pkgName string) bool {
+	if c.admin {
+		return true
+	}
+	pkg, err := s.DB.QueryPackage(pkgName)
+	if errors.Is(err, unpub.ErrNotFound) {
+		return true
+	}
+	if err != nil {
+		writeInternalErr(w, err)
+		return false
+	}
+	if !c.canRead(&pkg) {
+		s.writeHidden(w, c, pkgName)
+		return false
+	}
+	return true
+}
+
+// verifyBearer returns the caller identified by the bearer token of r, if it
+// may act within scope.
+func (s *UnpubServiceImpl) verifyBearer(w http.ResponseWriter, r *http.Request, scope string) (caller, bool) {
+	secret, ok := bearerToken(r)
+	if !ok {
+		writeAuthError(w, unpub.NewError(unpub.ErrUnauthorized,
+			"Authentication is required. Create a token with your registry admin, then run `dart pub token add %s`.", s.Addr))
+		return caller{}, false
+	}
+	if s.OIDC != nil && unpub.IsJWT(secret) {
+		claims, err := s.OIDC.Verify(secret, time.Now())
+		if errors.Is(err, unpub.ErrUnauthorized) {
+			writeAuthError(w, err)
+			return caller{}, false
+		}
+		if err != nil {
+			writeInternalErr(w, err)
+			return caller{}, false
+		}
+		return caller{identity: claims.Subject, claims: &claims}, true
+	}
+	token, err := s.DB.QueryToken(unpub.TokenID(secret))
+	if errors.Is(err, unpub.ErrNotFound) || (err == nil && !token.Matches(secret)) {
+		writeAuthError(w, unpub.NewError(unpub.ErrUnauthorized,
+			"The token is invalid or has been revoked. Replace it with `dart pub token add %s`.", s.Addr))
+		return caller{}, false
+	}
+	if err != nil {
+		writeInternalErr(w, err)
+		return caller{}, false
+	}
+	if token.Expired(time.Now()) {
+		writeAuthError(w, unpub.NewError(unpub.ErrUnauthorized,
+			"The token has expired. Replace it with `dart pub token add %s`.", s.Addr))
+		return caller{}, false
+	}
+	if !token.HasScope(scope) {
+		writeAuthError(w, unpub.NewError(unpub.ErrForbidden,
+			"The token of %s does not have the %s scope.", token.Identity, scope))
+		return caller{}, false
+	}
+	return caller{identity: token.Identity, admin: token.HasScope(unpub.ScopeAdmin)}, true
+}
+
+// bearerToken returns the token in the Authorization header of r.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// writeAuthError writes an authentication error with the WWW-Authenticate
+// challenge of the pub repository spec, whose message pub prints.
+func writeAuthError(w http.ResponseWriter, err error) {
+	message := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(err.Error())
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="pub", message="%s"`, message))
+	writeError(w, http.StatusUnauthorized, err)
+}
+
+// tokenRequest creates a token. TTL is a duration such as 720h, and empty for
+// a token which never expires.
+type tokenRequest struct {
+	Identity    string   `json:"identity"`
+	Scopes      []string `json:"scopes"`
+	Description string   `json:"description"`
+	TTL         string   `json:"ttl"`
+}
+
+// CreateToken creates a token, responding with its secret. The secret is not
+// stored, so it cannot be shown again.
+func (s *UnpubServiceImpl) CreateToken(w http.ResponseWriter, r *http.Request) {
+	identity, ok := s.authorize(w, r, unpub.ScopeAdmin)
+	if !ok {
+		return
+	}
+	var req tokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBadRequest(w, fmt.Errorf("bad token request: %v", err))
+		return
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			writeBadRequest(w, fmt.Errorf("ttl must be a positive duration such as 720h, got %q", req.TTL))
+			return
+		}
+	}
+	token, secret, err := unpub.NewToken(req.Identity, req.Scopes, ttl, time.Now())
+	if err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+	token.Description = req.Description
+	if err := s.DB.SaveToken(token); err != nil {
+		writeInternalErr(w, err)
+		return
+	}
+	s.audit(r, unpub.AuditEvent{
+		Action: unpub.AuditCreateToken,
+		Actor:  identity,
+		After:  fmt.Sprintf("%s %s %s", token.ID, token.Identity, strings.Join(token.Scopes, ",")),
+	})
+
+	token.Hash = ""
+	writeJSON(w, struct {
+		unpub.Token
+		Secret string `json:"token"`
+	}{
+		Token:  token,
+		Secret: secret,
+	})
+}
+
+// GetTokens lists every token, without their hashes.
+func (s *UnpubServiceImpl) GetTokens(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authorize(w, r, unpub.ScopeAdmin); !ok {
+		return
+	}
+	tokens, err := s.DB.QueryTokens()
+	if err != nil {
+		writeInternalErr(w, err)
+		return
+	}
+	for i := range tokens {
+		tokens[i].Hash = ""
+	}
+	writeJSON(w, struct {
+		Data []unpub.Token `json:"data"`
+	}{
+		Data: tokens,
+	})
+}
+
+// RevokeToken deletes a token, which takes effect on the next request using it.
+func (s *UnpubServiceImpl) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	identity, ok := s.authorize(w, r, unpub.ScopeAdmin)
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if err := s.DB.DeleteToken(id); err != nil {
+		if errors.Is(err, unpub.ErrNotFound) {
+			writeNotFound(w, "token %s not found", id)
+			return
+		}
+		writeInternalErr(w, err)
+		return
+	}
+	s.audit(r, unpub.AuditEvent{
+		Action: unpub.AuditRevokeToken,
+		Actor:  identity,
+		Before: id,
+	})
+
+	writeJSON(w, struct {
+		Success interface{} `json:"success"`
+	}{
+		Success: struct {
+			Message string `json:"message"`
+		}{
+			Message: fmt.Sprintf("Revoked token %s", id),
+		},
+	})
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dnys1/unpub"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+// withToken authenticates every request to h with the given secret.
+func withToken(h http.Handler, secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+secret)
+		h.ServeHTTP(w, r)
+	})
+}
+
+func saveToken(t *testing.T, s *UnpubServiceImpl, identity string, scopes ...string) string {
+	token, secret, err := unpub.NewToken(identity, scopes, 0, time.Now())
+	require.NoError(t, err)
+	require.NoError(t, s.DB.SaveToken(token))
+	return secret
+}
+
+func TestAuthWrite(t *testing.T) {
+	require := require.New(t)
+	s := newDiskService(t)
+	s.UploaderEmail = "test@example.com"
+	s.Auth = AuthWrite
+	r := mux.NewRouter()
+	SetupRoutes(r, s)
+
+	// Reading needs no token, but publishing does.
+	w := upload(t, r, testArchive(t, "my_pkg", "1.0.0"), "")
+	require.Equal(http.StatusUnauthorized, w.Code)
+	require.Contains(w.Header().Get("WWW-Authenticate"), `Bearer realm="pub", message="Authentication is required.`)
+	w = upload(t, withToken(r, "unpub_invalid"), testArchive(t, "my_pkg", "1.0.0"), "")
+	require.Equal(http.StatusUnauthorized, w.Code)
+	require.Contains(w.Header().Get("WWW-Authenticate"), "invalid or has been revoked")
+
+	read := saveToken(t, s, "reader@example.com", unpub.ScopeRead)
+	w = upload(t, withToken(r, read), testArchive(t, "my_pkg", "1.0.0"), "")
+	require.Equal(http.StatusForbidden, w.Code)
+
+	publish := saveToken(t, s, "alice@example.com", unpub.ScopePublish)
+	w = upload(t, withToken(r, publish), testArchive(t, "my_pkg", "1.0.0"), "")
+	require.Equal(http.StatusFound, w.Code, w.Body.String())
+	pkg, err := s.DB.QueryPackage("my_pkg")
+	require.NoError(err)
+	require.Equal([]string{"alice@example.com"}, pkg.Uploaders)
+	require.Equal("alice@example.com", *pkg.Versions["1.0.0"].Uploader)
+
+	// Only uploaders may publish new versions.
+	other := saveToken(t, s, "bob@example.com", unpub.ScopePublish)
+	w = upload(t, withToken(r, other), testArchive(t, "my_pkg", "1.1.0"), "")
+	require.Equal(http.StatusForbidden, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/packages/my_pkg", nil))
+	require.Equal(http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	withToken(r, publish).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/audit", nil))
+	require.Equal(http.StatusForbidden, w.Code)
+
+	audit, err := s.DB.QueryAudit(unpub.AuditQuery{Package: "my_pkg"})
+	require.NoError(err)
+	require.Len(audit.Events, 1)
+	require.Equal("alice@example.com", audit.Events[0].Actor)
+}
+
+func TestAuthAll(t *testing.T) {
+	require := require.New(t)
+	s := newDiskService(t)
+	s.Auth = AuthAll
+	r := mux.NewRouter()
+	SetupRoutes(r, s)
+	require.NoError(s.DB.SavePackage(newTestPackage(t, "my_pkg", "1.0.0")))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/packages/my_pkg", nil))
+	require.Equal(http.StatusUnauthorized, w.Code)
+
+	read := saveToken(t, s, "reader@example.com", unpub.ScopeRead)
+	w = httptest.NewRecorder()
+	withToken(r, read).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/packages/my_pkg", nil))
+	require.Equal(http.StatusOK, w.Code, w.Body.String())
+
+	expired, secret, err := unpub.NewToken("reader@example.com", []string{unpub.ScopeRead}, time.Millisecond, time.Now().Add(-time.Hour))
+	require.NoError(err)
+	require.NoError(s.DB.SaveToken(expired))
+	w = httptest.NewRecorder()
+	withToken(r, secret).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/packages/my_pkg", nil))
+	require.Equal(http.StatusUnauthorized, w.Code)
+	require.Contains(w.Header().Get("WWW-Authenticate"), "expired")
+}
+
+func TestTokens(t *testing.T) {
+	require := require.New(t)
+	s := newDiskService(t)
+	s.Auth = AuthWrite
+	r := mux.NewRouter()
+	SetupRoutes(r, s)
+	admin := withToken(r, saveToken(t, s, "admin@example.com", unpub.ScopeAdmin))
+
+	do := func(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	w := do(r, http.MethodPost, "/admin/tokens", `{"identity": "ci@example.com", "scopes": ["publish"]}`)
+	require.Equal(http.StatusUnauthorized, w.Code)
+	w = do(admin, http.MethodPost, "/admin/tokens", `{"identity": "ci@example.com", "scopes": ["write"]}`)
+	require.Equal(http.StatusBadRequest, w.Code)
+	w = do(admin, http.MethodPost, "/admin/tokens", `{"identity": "ci@example.com", "scopes": ["publish"], "ttl": "soon"}`)
+	require.Equal(http.StatusBadRequest, w.Code)
+
+	w = do(admin, http.MethodPost, "/admin/tokens", `{"identity": "ci@example.com", "scopes": ["publish"], "description": "CI", "ttl": "720h"}`)
+	require.Equal(http.StatusOK, w.Code, w.Body.String())
+	var created struct {
+		unpub.Token
+		Secret string `json:"token"`
+	}
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &created))
+	require.NotEmpty(created.Secret)
+	require.Empty(created.Hash)
+	require.Equal(unpub.TokenID(created.Secret), created.ID)
+	require.NotNil(created.ExpiresAt)
+
+	w = do(withToken(r, created.Secret), http.MethodGet, "/admin/tokens", "")
+	require.Equal(http.StatusForbidden, w.Code)
+	w = do(admin, http.MethodGet, "/admin/tokens", "")
+	require.Equal(http.StatusOK, w.Code)
+	require.NotContains(w.Body.String(), `"hash"`)
+	var tokens struct {
+		Data []unpub.Token `json:"data"`
+	}
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &tokens))
+	require.Len(tokens.Data, 2)
+
+	w = do(admin, http.MethodDelete, "/admin/tokens/"+created.ID, "")
+	require.Equal(http.StatusOK, w.Code, w.Body.String())
+	w = do(admin, http.MethodDelete, "/admin/tokens/"+created.ID, "")
+	require.Equal(http.StatusNotFound, w.Code)
+	w = upload(t, withToken(r, created.Secret), testArchive(t, "my_pkg", "1.0.0"), "")
+	require.Equal(http.StatusUnauthorized, w.Code)
+
+	audit, err := s.DB.QueryAudit(unpub.AuditQuery{})
+	require.NoError(err)
+	require.Len(audit.Events, 2)
+	require.Equal(unpub.AuditRevokeToken, audit.Events[0].Action)
+	require.Equal(unpub.AuditCreateToken, audit.Events[1].Action)
+	require.Equal("admin@example.com", audit.Events[1].Actor)
+}
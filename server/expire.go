@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/dnys1/unpub"
+)
+
+// SweepExpired calls ExpireVersions every interval until ctx is done.
+func (s *UnpubServiceImpl) SweepExpired(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.ExpireVersions(time.Now()); err != nil {
+			log.Printf("Error removing expired versions: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ExpireVersions removes the versions which have expired at now, along with
+// their archives unless they have been published again meanwhile. A package
+// whose versions have all expired is deleted.
+func (s *UnpubServiceImpl) ExpireVersions(now time.Time) error {
+	names, err := s.DB.QueryExpiredPackages(now)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		var expired []unpub.UnpubVersion
+		var before, after string
+		err := s.DB.UpdatePackage(name, func(pkg *unpub.UnpubPackage, exists bool) error {
+			if !exists {
+				return unpub.ErrNotFound
+			}
+			before = pkg.Latest
+			expired = pkg.RemoveExpired(now)
+			after = pkg.Latest
+			return nil
+		})
+		if errors.Is(err, unpub.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, v := range expired {
+			log.Printf("Removed expired version %s %s\n", name, v.Version)
+			event := unpub.AuditEvent{
+				Action:  unpub.AuditExpire,
+				Package: name,
+				Version: v.Version,
+				Before:  before,
+				After:   after,
+			}
+			if err := s.DB.RecordAudit(event); err != nil {
+				log.Printf("Error recording audit event %s %s: %v\n", event.Action, event.Package, err)
+			}
+			if v.ArchiveSHA256 == "" {
+				continue
+			}
+			if err := s.deleteArchive(name, v.ArchiveSHA256); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dnys1/unpub"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+// testArchive returns a package archive holding only a pubspec.
+func testArchive(t *testing.T, name, version string) []byte {
+	pubspec := "name: " + name + "\nversion: " + version + "\n"
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{
+		Name: "pubspec.yaml",
+		Mode: 0o644,
+		Size: int64(len(pubspec)),
+	}))
+	_, err := tw.Write([]byte(pubspec))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+// upload publishes archive through the upload form, with a time-to-live
+// unless ttl is empty.
+func upload(t *testing.T, r http.Handler, archive []byte, ttl string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if ttl != "" {
+		require.NoError(t, mw.WriteField("ttl", ttl))
+	}
+	field, err := mw.CreateFormFile("file", "package.tar.gz")
+	require.NoError(t, err)
+	_, err = field.Write(archive)
+	require.NoError(t, err)
+	require.NoError(t, mw.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/api/packages/versions/newUpload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestExpireVersions(t *testing.T) {
+	require := require.New(t)
+	s := newDiskService(t)
+	s.UploaderEmail = "test@example.com"
+	r := mux.NewRouter()
+	SetupRoutes(r, s)
+
+	w := upload(t, r, testArchive(t, "my_pkg", "1.0.0"), "")
+	require.Equal(http.StatusFound, w.Code, w.Body.String())
+	w = upload(t, r, testArchive(t, "my_pkg", "1.1.0-pr.1"), "1h")
+	require.Equal(http.StatusFound, w.Code, w.Body.String())
+	w = upload(t, r, testArchive(t, "preview_pkg", "0.1.0-pr.1"), "1h")
+	require.Equal(http.StatusFound, w.Code, w.Body.String())
+	w = upload(t, r, testArchive(t, "my_pkg", "1.1.0-pr.2"), "forever")
+	require.Equal(http.StatusBadRequest, w.Code)
+
+	pkg, err := s.DB.QueryPackage("my_pkg")
+	require.NoError(err)
+	require.Nil(pkg.Versions["1.0.0"].ExpiresAt)
+	preview := pkg.Versions["1.1.0-pr.1"]
+	require.NotNil(preview.ExpiresAt)
+	require.WithinDuration(time.Now().Add(time.Hour), *preview.ExpiresAt, time.Minute)
+
+	// Nothing has expired yet.
+	require.NoError(s.ExpireVersions(time.Now()))
+	pkg, err = s.DB.QueryPackage("my_pkg")
+	require.NoError(err)
+	require.Len(pkg.Versions, 2)
+
+	// Expired versions are hidden before they are swept.
+	require.NoError(s.DB.UpdatePackage("my_pkg", func(pkg *unpub.UnpubPackage, exists bool) error {
+		v := pkg.Versions["1.1.0-pr.1"]
+		expiresAt := time.Now().Add(-time.Second)
+		v.ExpiresAt = &expiresAt
+		pkg.Versions[v.Version] = v
+		return nil
+	}))
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+	w = get("/api/packages/my_pkg")
+	require.Equal(http.StatusOK, w.Code)
+	require.NotContains(w.Body.String(), "1.1.0-pr.1")
+	w = get("/api/packages/my_pkg/versions/1.1.0-pr.1")
+	require.Equal(http.StatusNotFound, w.Code)
+	w = get("/packages/my_pkg/versions/1.1.0-pr.1.tar.gz")
+	require.Equal(http.StatusFound, w.Code)
+
+	require.NoError(s.ExpireVersions(time.Now()))
+	pkg, err = s.DB.QueryPackage("my_pkg")
+	require.NoError(err)
+	require.Equal("1.0.0", pkg.Latest)
+	require.Len(pkg.Versions, 1)
+	_, err = getBlob(t, s, preview.ArchiveSHA256)
+	require.ErrorIs(err, unpub.ErrNotFound)
+	_, err = getBlob(t, s, pkg.Versions["1.0.0"].ArchiveSHA256)
+	require.NoError(err)
+
+	// A package whose versions have all expired is deleted.
+	require.NoError(s.ExpireVersions(time.Now().Add(2 * time.Hour)))
+	_, err = s.DB.QueryPackage("preview_pkg")
+	require.ErrorIs(err, unpub.ErrNotFound)
+
+	audit, err := s.DB.QueryAudit(unpub.AuditQuery{Action: unpub.AuditExpire})
+	require.NoError(err)
+	require.Len(audit.Events, 2)
+	require.Equal("preview_pkg", audit.Events[0].Package)
+	require.Equal("0.1.0-pr.1", audit.Events[0].Version)
+	require.Equal("my_pkg", audit.Events[1].Package)
+	require.Equal("1.1.0-pr.1", audit.Events[1].Version)
+	require.Equal("1.0.0", audit.Events[1].After)
+}
+
+// hookedDb calls afterUpdate once each UpdatePackage has committed.
+type hookedDb struct {
+	unpub.UnpubDb
+	afterUpdate func(name string)
+}
+
+func (db hookedDb) UpdatePackage(name string, fn unpub.PackageUpdate) error {
+	if err := db.UnpubDb.UpdatePackage(name, fn); err != nil {
+		return err
+	}
+	db.afterUpdate(name)
+	return nil
+}
+
+func TestExpireVersionsRepublished(t *testing.T) {
+	require := require.New(t)
+	s := newDiskService(t)
+	s.UploaderEmail = "test@example.com"
+	r := mux.NewRouter()
+	SetupRoutes(r, s)
+
+	archive := testArchive(t, "my_pkg", "1.0.0-pr.1")
+	w := upload(t, r, archive, "1h")
+	require.Equal(http.StatusFound, w.Code, w.Body.String())
+	pkg, err := s.DB.QueryPackage("my_pkg")
+	require.NoError(err)
+	digest := pkg.Versions["1.0.0-pr.1"].ArchiveSHA256
+
+	// The preview is published again, without a time-to-live, after the
+	// sweeper removes it but before it deletes the archive.
+	republished := false
+	s.DB = hookedDb{UnpubDb: s.DB, afterUpdate: func(name string) {
+		if republished {
+			return
+		}
+		republished = true
+		w := upload(t, r, archive, "")
+		require.Equal(http.StatusFound, w.Code, w.Body.String())
+	}}
+	require.NoError(s.ExpireVersions(time.Now().Add(2 * time.Hour)))
+	require.True(republished)
+
+	pkg, err = s.DB.QueryPackage("my_pkg")
+	require.NoError(err)
+	require.Nil(pkg.Versions["1.0.0-pr.1"].ExpiresAt)
+	data, err := getBlob(t, s, digest)
+	require.NoError(err)
+	require.Equal(string(archive), data)
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dnys1/unpub"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+const testIssuer = "https://ci.example.com"
+
+// newTestOIDC returns a verifier trusting testIssuer, whose keys are read from
+// a JWKS file, and a function signing identity tokens with the given claims.
+func newTestOIDC(t *testing.T, audience string) (*unpub.OIDCVerifier, func(claims map[string]interface{}) string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks, err := json.Marshal(map[string]interface{}{
+		"keys": []interface{}{map[string]string{
+			"kty": "RSA",
+			"kid": "key-1",
+			"n":   b64(key.N.Bytes()),
+			"e":   b64([]byte{1, 0, 1}),
+		}},
+	})
+	require.NoError(t, err)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(jwksFile, jwks, 0o644))
+	oidc, err := unpub.NewOIDCVerifier([]unpub.OIDCIssuer{{Issuer: testIssuer, Audience: audience, JWKSFile: jwksFile}})
+	require.NoError(t, err)
+
+	return oidc, func(claims map[string]interface{}) string {
+		payload := map[string]interface{}{
+			"iss": testIssuer,
+			"aud": audience,
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range claims {
+			payload[k] = v
+		}
+		header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": "key-1"})
+		require.NoError(t, err)
+		body, err := json.Marshal(payload)
+		require.NoError(t, err)
+		signed := b64(header) + "." + b64(body)
+		digest := sha256.Sum256([]byte(signed))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+		return signed + "." + b64(sig)
+	}
+}
+
+func TestIdentityTokens(t *testing.T) {
+	require := require.New(t)
+	s := newDiskService(t)
+	s.Addr = "https://unpub.example.com"
+	s.Auth = AuthWrite
+	oidc, sign := newTestOIDC(t, s.Addr)
+	s.OIDC = oidc
+	r := mux.NewRouter()
+	SetupRoutes(r, s)
+
+	alice := saveToken(t, s, "alice@example.com", unpub.ScopePublish)
+	w := upload(t, withToken(r, alice), testArchive(t, "my_pkg", "1.0.0"), "")
+	require.Equal(http.StatusFound, w.Code, w.Body.String())
+
+	release := sign(map[string]interface{}{
+		"sub":        "repo:acme/packages:ref:refs/tags/v1.1.0",
+		"repository": "acme/packages",
+		"ref":        "refs/tags/v1.1.0",
+	})
+	branch := sign(map[string]interface{}{
+		"sub":        "repo:acme/packages:ref:refs/heads/main",
+		"repository": "acme/packages",
+		"ref":        "refs/heads/main",
+	})
+
+	// Packages trust no identity tokens until a policy is set.
+	w = upload(t, withToken(r, release), testArchive(t, "my_pkg", "1.1.0"), "")
+	require.Equal(http.StatusForbidden, w.Code, w.Body.String())
+	w = upload(t, withToken(r, release), testArchive(t, "new_pkg", "1.0.0"), "")
+	require.Equal(http.StatusForbidden, w.Code, w.Body.String())
+
+	do := func(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+	policies := `{"trustPolicies": [{"issuer": "` + testIssuer + `", "claims": {"repository": "acme/packages", "ref": "refs/tags/v*"}}]}`
+	w = do(withToken(r, release), http.MethodPut, "/api/packages/my_pkg/trust-policies", policies)
+	require.Equal(http.StatusForbidden, w.Code)
+	w = do(withToken(r, alice), http.MethodPut, "/api/packages/my_pkg/trust-policies",
+		`{"trustPolicies": [{"issuer": "https://other.example.com", "claims": {"repository": "acme/packages"}}]}`)
+	require.Equal(http.StatusBadRequest, w.Code)
+	w = do(withToken(r, alice), http.MethodPut, "/api/packages/my_pkg/trust-policies",
+		`{"trustPolicies": [{"issuer": "`+testIssuer+`", "claims": {}}]}`)
+	require.Equal(http.StatusBadRequest, w.Code)
+	w = do(withToken(r, alice), http.MethodPut, "/api/packages/my_pkg/trust-policies", policies)
+	require.Equal(http.StatusOK, w.Code, w.Body.String())
+	w = do(r, http.MethodGet, "/api/packages/my_pkg/trust-policies", "")
+	require.Equal(http.StatusOK, w.Code)
+	require.JSONEq(policies, w.Body.String())
+
+	w = upload(t, withToken(r, branch), testArchive(t, "my_pkg", "1.1.0"), "")
+	require.Equal(http.StatusForbidden, w.Code, w.Body.String())
+	w = do(withToken(r, release), http.MethodGet, "/api/packages/versions/new", "")
+	require.Equal(http.StatusOK, w.Code)
+	w = upload(t, withToken(r, release), testArchive(t, "my_pkg", "1.1.0"), "")
+	require.Equal(http.StatusFound, w.Code, w.Body.String())
+	pkg, err := s.DB.QueryPackage("my_pkg")
+	require.NoError(err)
+	require.Equal("1.1.0", pkg.Latest)
+	require.Equal("repo:acme/packages:ref:refs/tags/v1.1.0", *pkg.Versions["1.1.0"].Uploader)
+
+	// Identity tokens cannot do anything else, and must be meant for us.
+	w = do(withToken(r, release), http.MethodPost, "/api/packages/my_pkg/uploaders", "email=mallory@example.com")
+	require.Equal(http.StatusForbidden, w.Code)
+	w = do(withToken(r, release), http.MethodGet, "/admin/audit", "")
+	require.Equal(http.StatusForbidden, w.Code)
+	expired := sign(map[string]interface{}{"sub": "repo:acme/packages", "exp": time.Now().Add(-time.Hour).Unix()})
+	w = upload(t, withToken(r, expired), testArchive(t, "my_pkg", "1.2.0"), "")
+	require.Equal(http.StatusUnauthorized, w.Code)
+	require.Contains(w.Header().Get("WWW-Authenticate"), "identity token has expired")
+	pubDev := sign(map[string]interface{}{"sub": "repo:acme/packages", "aud": "https://pub.dev"})
+	w = upload(t, withToken(r, pubDev), testArchive(t, "my_pkg", "1.2.0"), "")
+	require.Equal(http.StatusUnauthorized, w.Code)
+
+	audit, err := s.DB.QueryAudit(unpub.AuditQuery{Package: "my_pkg"})
+	require.NoError(err)
+	require.Len(audit.Events, 3)
+	require.Equal(unpub.AuditPublish, audit.Events[0].Action)
+	require.Equal("repo:acme/packages:ref:refs/tags/v1.1.0", audit.Events[0].Actor)
+	require.Equal(unpub.AuditTrust, audit.Events[1].Action)
+	require.Equal("alice@example.com", audit.Events[1].Actor)
+	require.Equal(testIssuer+"[ref=refs/tags/v*,repository=acme/packages]", audit.Events[1].After)
+}
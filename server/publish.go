@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/dnys1/unpub"
+)
+
+// publish stores archive under digest and applies update to the named package.
+//
+// The archive is stored first, and only then is the metadata committed. Since
+// archives are content-addressed, re-uploading an identical archive reuses the
+// stored one. A crash between these steps leaves an unreferenced archive
+// behind for RecoverPublishes to delete.
+//
+// Publishes of the same archive are serialized, so that one which fails does
+// not delete the archive another has just committed a version of.
+func (s *UnpubServiceImpl) publish(name, digest string, archive io.Reader, update unpub.PackageUpdate) error {
+	unlock := s.lockDigest(digest)
+	defer unlock()
+
+	created, err := s.Blobs.Put(digest, archive)
+	if err != nil {
+		return err
+	}
+	if err := s.DB.UpdatePackage(name, update); err != nil {
+		if created && !s.isReferenced(name, digest) {
+			if rmErr := s.Blobs.Delete(digest); rmErr != nil {
+				log.Printf("Error removing archive %s: %v\n", digest, rmErr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// deleteArchive deletes the archive with the given digest of a version of the
+// named package which has been removed, unless the same archive has been
+// published again since.
+func (s *UnpubServiceImpl) deleteArchive(name, digest string) error {
+	unlock := s.lockDigest(digest)
+	defer unlock()
+	if s.isReferenced(name, digest) {
+		return nil
+	}
+	return s.Blobs.Delete(digest)
+}
+
+// digestLock is held while publishing an archive. refs counts the publishes
+// holding or waiting for it.
+type digestLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockDigest locks the archive with the given digest against other publishes,
+// returning the function unlocking it.
+func (s *UnpubServiceImpl) lockDigest(digest string) (unlock func()) {
+	s.publishingMu.Lock()
+	if s.publishing == nil {
+		s.publishing = make(map[string]*digestLock)
+	}
+	l := s.publishing[digest]
+	if l == nil {
+		l = &digestLock{}
+		s.publishing[digest] = l
+	}
+	l.refs++
+	s.publishingMu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		s.publishingMu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(s.publishing, digest)
+		}
+		s.publishingMu.Unlock()
+	}
+}
+
+// isReferenced reports whether a version of the named package has the
+// archive with the given digest. Since archives contain the pubspec, no other
+// package can have it. Errors are taken to mean it is, so the archive is kept
+// for RecoverPublishes to check.
+func (s *UnpubServiceImpl) isReferenced(name, digest string) bool {
+	pkg, err := s.DB.QueryPackage(name)
+	if errors.Is(err, unpub.ErrNotFound) {
+		return false
+	}
+	if err != nil {
+		log.Printf("Error checking references to archive %s: %v\n", digest, err)
+		return true
+	}
+	for _, v := range pkg.Versions {
+		if v.ArchiveSHA256 == digest {
+			return true
+		}
+	}
+	return false
+}
+
+// RecoverPublishes cleans up after publishes interrupted by a crash, deleting
+// archives which no version refers to. Archives stored by name and version
+// under Path before they were content-addressed are moved to the blob store
+// first. It should run at startup, before serving requests.
+func (s *UnpubServiceImpl) RecoverPublishes() error {
+	if s.Path != "" {
+		if err := s.migrateLegacyArchives(); err != nil {
+			return err
+		}
+	}
+
+	all, err := s.DB.QueryPackages(unpub.UnpubDbQuery{IncludeUnlisted: true, IncludePrivate: true})
+	if err != nil {
+		return err
+	}
+	referenced := make(map[string]bool)
+	for _, pkg := range all.Packages {
+		for _, v := range pkg.Versions {
+			referenced[v.ArchiveSHA256] = true
+		}
+	}
+	return s.Blobs.List(func(digest string) error {
+		if referenced[digest] {
+			return nil
+		}
+		log.Printf("Removing unreferenced archive: %s\n", digest)
+		return s.Blobs.Delete(digest)
+	})
+}
+
+// migrateLegacyArchives moves archives stored as <name>_<version>.tar.gz to
+// the blob store, recording their digest on the version. The legacy file is
+// only deleted once both are done, so an interrupted migration is finished
+// next time.
+func (s *UnpubServiceImpl) migrateLegacyArchives() error {
+	entries, err := os.ReadDir(s.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		pkgVersion, ok := parseArchiveFilename(entry.Name())
+		if !ok {
+			continue
+		}
+		legacyPath := filepath.Join(s.Path, entry.Name())
+		data, err := os.ReadFile(legacyPath)
+		if err != nil {
+			return err
+		}
+		digest, err := unpub.BlobDigest(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if _, err := s.Blobs.Put(digest, bytes.NewReader(data)); err != nil {
+			return err
+		}
+		err = s.DB.UpdatePackage(pkgVersion.Package, func(pkg *unpub.UnpubPackage, exists bool) error {
+			v, ok := pkg.Versions[pkgVersion.Version]
+			if !exists || !ok {
+				return unpub.ErrNotFound
+			}
+			if v.ArchiveSHA256 != "" && v.ArchiveSHA256 != digest {
+				return fmt.Errorf("digest %s is already recorded", v.ArchiveSHA256)
+			}
+			v.ArchiveSHA256 = digest
+			pkg.Versions[v.Version] = v
+			return nil
+		})
+		if err != nil {
+			log.Printf("Skipping archive %s: %v\n", entry.Name(), err)
+			continue
+		}
+		log.Printf("Moved archive %s to %s\n", entry.Name(), digest)
+		if err := os.Remove(legacyPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseArchiveFilename parses the name of an archive stored by PkgVersion.
+func parseArchiveFilename(name string) (PkgVersion, bool) {
+	base, ok := strings.CutSuffix(name, ".tar.gz")
+	if !ok {
+		return PkgVersion{}, false
+	}
+	// Package names may contain underscores but versions may not.
+	i := strings.LastIndexByte(base, '_')
+	if i <= 0 || i == len(base)-1 {
+		return PkgVersion{}, false
+	}
+	return PkgVersion{Package: base[:i], Version: base[i+1:]}, true
+}
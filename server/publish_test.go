@@ -0,0 +1,183 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dnys1/unpub"
+	"github.com/stretchr/testify/require"
+)
+
+// failingSaveDb fails every UpdatePackage call.
+type failingSaveDb struct {
+	unpub.UnpubDb
+}
+
+func (failingSaveDb) UpdatePackage(string, unpub.PackageUpdate) error {
+	return errors.New("disk full")
+}
+
+func newTestPackage(t *testing.T, name, version string) unpub.UnpubPackage {
+	pkg := unpub.NewPackage(name, false, []string{"test@example.com"})
+	_, err := pkg.CreateVersion(version, "name: "+name+"\nversion: "+version, nil, nil, nil)
+	require.NoError(t, err)
+	return pkg
+}
+
+// createPackage returns an update which saves pkg as a new package.
+func createPackage(pkg unpub.UnpubPackage) unpub.PackageUpdate {
+	return func(p *unpub.UnpubPackage, exists bool) error {
+		if exists {
+			return errors.New("package exists")
+		}
+		*p = pkg
+		return nil
+	}
+}
+
+func newDiskService(t *testing.T) *UnpubServiceImpl {
+	db, err := unpub.NewUnpubLocalDb(true, "")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	path := t.TempDir()
+	blobs, err := unpub.NewFileBlobStore(filepath.Join(path, "archives"))
+	require.NoError(t, err)
+	return &UnpubServiceImpl{
+		Path:  path,
+		DB:    db,
+		Blobs: blobs,
+	}
+}
+
+func digestOf(t *testing.T, data string) string {
+	digest, err := unpub.BlobDigest(strings.NewReader(data))
+	require.NoError(t, err)
+	return digest
+}
+
+// getBlob returns the contents of a blob, or ErrNotFound.
+func getBlob(t *testing.T, s *UnpubServiceImpl, digest string) (string, error) {
+	r, err := s.Blobs.Get(digest)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(data), nil
+}
+
+func TestPublish(t *testing.T) {
+	require := require.New(t)
+	s := newDiskService(t)
+
+	digest := digestOf(t, "archive")
+	pkg := newTestPackage(t, "my_pkg", "1.0.0")
+	require.NoError(s.publish("my_pkg", digest, strings.NewReader("archive"), createPackage(pkg)))
+
+	data, err := getBlob(t, s, digest)
+	require.NoError(err)
+	require.Equal("archive", data)
+
+	// An archive which does not match its digest is rejected.
+	pkg = newTestPackage(t, "bad_pkg", "1.0.0")
+	err = s.publish("bad_pkg", digestOf(t, "other"), strings.NewReader("archive"), createPackage(pkg))
+	require.ErrorIs(err, unpub.ErrDigestMismatch)
+
+	// A failed commit leaves neither metadata nor archive behind.
+	db := s.DB
+	s.DB = failingSaveDb{db}
+	otherDigest := digestOf(t, "other archive")
+	pkg = newTestPackage(t, "other_pkg", "1.0.0")
+	require.Error(s.publish("other_pkg", otherDigest, strings.NewReader("other archive"), createPackage(pkg)))
+	_, err = getBlob(t, s, otherDigest)
+	require.ErrorIs(err, unpub.ErrNotFound)
+	_, err = db.QueryPackage("other_pkg")
+	require.ErrorIs(err, unpub.ErrNotFound)
+
+	// ...unless an identical archive was already stored.
+	pkg = newTestPackage(t, "other_pkg", "1.0.0")
+	require.Error(s.publish("other_pkg", digest, strings.NewReader("archive"), createPackage(pkg)))
+	_, err = getBlob(t, s, digest)
+	require.NoError(err)
+}
+
+func TestPublishConcurrent(t *testing.T) {
+	require := require.New(t)
+	s := newDiskService(t)
+
+	// A double submit: the first upload fails after storing the archive,
+	// while the second reuses it. The second must not be left with a version
+	// whose archive the first deleted.
+	digest := digestOf(t, "archive")
+	started, failed := make(chan struct{}), make(chan error)
+	go func() {
+		failed <- s.publish("my_pkg", digest, strings.NewReader("archive"), func(pkg *unpub.UnpubPackage, exists bool) error {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+			return unpub.NewError(unpub.ErrConflict, "version already exists")
+		})
+	}()
+	<-started
+	var err error
+	require.NoError(s.publish("my_pkg", digest, strings.NewReader("archive"), func(pkg *unpub.UnpubPackage, exists bool) error {
+		if err == nil {
+			err = <-failed
+		}
+		*pkg = unpub.NewPackage("my_pkg", false, []string{"test@example.com"})
+		return pkg.AddVersion(unpub.UnpubVersion{
+			Version:       "1.0.0",
+			PubspecYAML:   "name: my_pkg\nversion: 1.0.0",
+			ArchiveSHA256: digest,
+			CreatedAt:     time.Now(),
+		})
+	}))
+	require.ErrorIs(err, unpub.ErrConflict)
+
+	data, err := getBlob(t, s, digest)
+	require.NoError(err)
+	require.Equal("archive", data)
+	require.Empty(s.publishing)
+}
+
+func TestRecoverPublishes(t *testing.T) {
+	require := require.New(t)
+	s := newDiskService(t)
+
+	// Committed before the crash: kept.
+	committed := digestOf(t, "committed")
+	pkg := newTestPackage(t, "my_pkg", "1.0.0")
+	v := pkg.Versions["1.0.0"]
+	v.ArchiveSHA256 = committed
+	pkg.Versions["1.0.0"] = v
+	require.NoError(s.publish("my_pkg", committed, strings.NewReader("committed"), createPackage(pkg)))
+	// Never committed: deleted.
+	orphan := digestOf(t, "orphan")
+	_, err := s.Blobs.Put(orphan, strings.NewReader("orphan"))
+	require.NoError(err)
+
+	// Stored by name and version: moved to the blob store.
+	legacy := digestOf(t, "legacy")
+	require.NoError(s.DB.SavePackage(newTestPackage(t, "legacy_pkg", "1.0.0")))
+	require.NoError(os.WriteFile(filepath.Join(s.Path, "legacy_pkg_1.0.0.tar.gz"), []byte("legacy"), 0o644))
+
+	require.NoError(s.RecoverPublishes())
+
+	_, err = getBlob(t, s, committed)
+	require.NoError(err)
+	_, err = getBlob(t, s, orphan)
+	require.ErrorIs(err, unpub.ErrNotFound)
+
+	require.NoFileExists(filepath.Join(s.Path, "legacy_pkg_1.0.0.tar.gz"))
+	data, err := getBlob(t, s, legacy)
+	require.NoError(err)
+	require.Equal("legacy", data)
+	v, err = s.DB.QueryVersion("legacy_pkg", "1.0.0")
+	require.NoError(err)
+	require.Equal(legacy, v.ArchiveSHA256)
+}
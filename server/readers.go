@@ -0,0 +1,120 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/dnys1/unpub"
+	"github.com/gorilla/mux"
+)
+
+// readers is the body of the readers endpoints.
+type readers struct {
+	Readers []string `json:"readers"`
+}
+
+// GetReaders lists the identities which may read a private package besides
+// its uploaders.
+func (s *UnpubServiceImpl) GetReaders(w http.ResponseWriter, r *http.Request) {
+	identity, ok := s.authorize(w, r, unpub.ScopePublish)
+	if !ok {
+		return
+	}
+	pkgName := mux.Vars(r)["name"]
+	pkg, err := s.DB.QueryPackage(pkgName)
+	if err != nil {
+		if errors.Is(err, unpub.ErrNotFound) {
+			writeNotFound(w, "package %s not found", pkgName)
+			return
+		}
+		writeInternalErr(w, err)
+		return
+	}
+	if !isUploader(&pkg, identity) {
+		writeBadRequest(w, unpub.NewError(unpub.ErrForbidden, "no permission"))
+		return
+	}
+	writeJSON(w, readers{Readers: append([]string{}, pkg.Readers...)})
+}
+
+// AddReader grants the identity in the email form field read access to a
+// private package.
+func (s *UnpubServiceImpl) AddReader(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	if email == "" {
+		writeBadRequest(w, errors.New("email is required"))
+		return
+	}
+	s.updateReaders(w, r, unpub.AuditAddReader, func(pkg *unpub.UnpubPackage) error {
+		for _, reader := range pkg.Readers {
+			if reader == email {
+				return unpub.NewError(unpub.ErrConflict, "reader already exists")
+			}
+		}
+		pkg.Readers = append(pkg.Readers, email)
+		return nil
+	})
+}
+
+// RemoveReader revokes the read access of an identity to a private package.
+func (s *UnpubServiceImpl) RemoveReader(w http.ResponseWriter, r *http.Request) {
+	email := mux.Vars(r)["email"]
+	s.updateReaders(w, r, unpub.AuditRemoveReader, func(pkg *unpub.UnpubPackage) error {
+		for i, reader := range pkg.Readers {
+			if reader == email {
+				pkg.Readers = append(pkg.Readers[:i:i], pkg.Readers[i+1:]...)
+				return nil
+			}
+		}
+		return unpub.NewError(unpub.ErrInvalidInput, "%s is not a reader", email)
+	})
+}
+
+// updateReaders changes the readers of a package with update on behalf of one
+// of its uploaders, and records action in the audit log.
+func (s *UnpubServiceImpl) updateReaders(w http.ResponseWriter, r *http.Request, action string, update func(pkg *unpub.UnpubPackage) error) {
+	identity, ok := s.authorize(w, r, unpub.ScopePublish)
+	if !ok {
+		return
+	}
+	pkgName := mux.Vars(r)["name"]
+	var before, after []string
+	var readersErr error
+	err := s.DB.UpdatePackage(pkgName, func(pkg *unpub.UnpubPackage, exists bool) error {
+		if !exists {
+			return unpub.ErrNotFound
+		}
+		if !isUploader(pkg, identity) {
+			readersErr = unpub.NewError(unpub.ErrForbidden, "no permission")
+			return readersErr
+		}
+		before = pkg.Readers
+		if readersErr = update(pkg); readersErr != nil {
+			return readersErr
+		}
+		after = pkg.Readers
+		return nil
+	})
+	if errors.Is(err, unpub.ErrNotFound) {
+		writeNotFound(w, "package %s not found", pkgName)
+		return
+	}
+	if readersErr != nil {
+		writeBadRequest(w, readersErr)
+		return
+	}
+	if err != nil {
+		writeInternalErr(w, err)
+		return
+	}
+	s.audit(r, unpub.AuditEvent{
+		Action:  action,
+		Actor:   identity,
+		Package: pkgName,
+		Before:  strings.Join(before, ","),
+		After:   strings.Join(after, ","),
+	})
+
+	writeJSON(w, readers{Readers: append([]string{}, after...)})
+}
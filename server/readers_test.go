@@ -0,0 +1,180 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dnys1/unpub"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+// listPackages returns the count and names of the packages listed by
+// /webapi/packages with the given query.
+func listPackages(t *testing.T, h http.Handler, query string) (int, []string) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/webapi/packages?"+query, nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var body struct {
+		Data struct {
+			Count    int `json:"count"`
+			Packages []struct {
+				Name string `json:"name"`
+			} `json:"packages"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	names := []string{}
+	for _, pkg := range body.Data.Packages {
+		names = append(names, pkg.Name)
+	}
+	return body.Data.Count, names
+}
+
+func TestPrivatePackages(t *testing.T) {
+	require := require.New(t)
+	s := newDiskService(t)
+	s.Auth = AuthWrite
+	r := mux.NewRouter()
+	SetupRoutes(r, s)
+
+	alice := saveToken(t, s, "alice@example.com", unpub.ScopePublish)
+	w := upload(t, withToken(r, alice), testArchive(t, "my_pkg", "1.0.0"), "")
+	require.Equal(http.StatusFound, w.Code, w.Body.String())
+	w = upload(t, withToken(r, alice), testArchive(t, "secret_pkg", "1.0.0"), "")
+	require.Equal(http.StatusFound, w.Code, w.Body.String())
+	require.NoError(s.DB.UpdatePackage("secret_pkg", func(pkg *unpub.UnpubPackage, exists bool) error {
+		pkg.Private = true
+		return nil
+	}))
+
+	do := func(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	listed := func(h http.Handler) []string {
+		_, names := listPackages(t, h, "size=10&page=0")
+		return names
+	}
+
+	// Anyone may read public packages, but private ones are hidden.
+	w = do(r, http.MethodGet, "/api/packages/my_pkg", "")
+	require.Equal(http.StatusOK, w.Code)
+	w = do(r, http.MethodGet, "/api/packages/secret_pkg", "")
+	require.Equal(http.StatusUnauthorized, w.Code)
+	require.Contains(w.Header().Get("WWW-Authenticate"), `Bearer realm="pub"`)
+	bob := saveToken(t, s, "bob@example.com", unpub.ScopeRead)
+	for _, target := range []string{
+		"/api/packages/secret_pkg",
+		"/api/packages/secret_pkg/versions/1.0.0",
+		"/packages/secret_pkg/versions/1.0.0.tar.gz",
+		"/webapi/package/secret_pkg/stats",
+	} {
+		w = do(withToken(r, bob), http.MethodGet, target, "")
+		require.Equal(http.StatusNotFound, w.Code, target)
+	}
+	require.Equal([]string{"my_pkg"}, listed(r))
+	require.Equal([]string{"my_pkg"}, listed(withToken(r, bob)))
+	require.ElementsMatch([]string{"my_pkg", "secret_pkg"}, listed(withToken(r, alice)))
+	admin := saveToken(t, s, "admin@example.com", unpub.ScopeAdmin)
+	require.ElementsMatch([]string{"my_pkg", "secret_pkg"}, listed(withToken(r, admin)))
+	w = do(r, http.MethodGet, "/api/package-names", "")
+	require.Equal(http.StatusOK, w.Code)
+	require.NotContains(w.Body.String(), "secret_pkg")
+
+	// Only uploaders manage readers.
+	w = do(withToken(r, bob), http.MethodPost, "/api/packages/secret_pkg/readers", "email=bob@example.com")
+	require.Equal(http.StatusForbidden, w.Code)
+	w = do(withToken(r, alice), http.MethodPost, "/api/packages/secret_pkg/readers", "email=bob@example.com")
+	require.Equal(http.StatusOK, w.Code, w.Body.String())
+	require.JSONEq(`{"readers": ["bob@example.com"]}`, w.Body.String())
+	w = do(withToken(r, alice), http.MethodPost, "/api/packages/secret_pkg/readers", "email=bob@example.com")
+	require.Equal(http.StatusConflict, w.Code)
+	w = do(withToken(r, alice), http.MethodGet, "/api/packages/secret_pkg/readers", "")
+	require.Equal(http.StatusOK, w.Code)
+	require.JSONEq(`{"readers": ["bob@example.com"]}`, w.Body.String())
+
+	w = do(withToken(r, bob), http.MethodGet, "/api/packages/secret_pkg", "")
+	require.Equal(http.StatusOK, w.Code)
+	w = do(withToken(r, bob), http.MethodGet, "/packages/secret_pkg/versions/1.0.0.tar.gz", "")
+	require.Equal(http.StatusOK, w.Code)
+	require.ElementsMatch([]string{"my_pkg", "secret_pkg"}, listed(withToken(r, bob)))
+
+	w = do(withToken(r, alice), http.MethodDelete, "/api/packages/secret_pkg/readers/bob@example.com", "")
+	require.Equal(http.StatusOK, w.Code, w.Body.String())
+	require.JSONEq(`{"readers": []}`, w.Body.String())
+	w = do(withToken(r, alice), http.MethodDelete, "/api/packages/secret_pkg/readers/bob@example.com", "")
+	require.Equal(http.StatusBadRequest, w.Code)
+	w = do(withToken(r, bob), http.MethodGet, "/api/packages/secret_pkg", "")
+	require.Equal(http.StatusNotFound, w.Code)
+
+	audit, err := s.DB.QueryAudit(unpub.AuditQuery{Package: "secret_pkg"})
+	require.NoError(err)
+	require.Len(audit.Events, 3)
+	require.Equal(unpub.AuditRemoveReader, audit.Events[0].Action)
+	require.Equal("bob@example.com", audit.Events[0].Before)
+	require.Equal(unpub.AuditAddReader, audit.Events[1].Action)
+	require.Equal("alice@example.com", audit.Events[1].Actor)
+	require.Equal("bob@example.com", audit.Events[1].After)
+
+	// Without authentication everyone reads everything.
+	s.Auth = AuthNone
+	w = do(r, http.MethodGet, "/api/packages/secret_pkg", "")
+	require.Equal(http.StatusOK, w.Code)
+}
+
+func TestPrivatePackagesIdentityTokens(t *testing.T) {
+	require := require.New(t)
+	s := newDiskService(t)
+	s.Addr = "https://unpub.example.com"
+	s.Auth = AuthWrite
+	oidc, sign := newTestOIDC(t, s.Addr)
+	s.OIDC = oidc
+	r := mux.NewRouter()
+	SetupRoutes(r, s)
+
+	alice := saveToken(t, s, "alice@example.com", unpub.ScopePublish)
+	for _, name := range []string{"a_pkg", "secret_pkg", "z_pkg"} {
+		w := upload(t, withToken(r, alice), testArchive(t, name, "1.0.0"), "")
+		require.Equal(http.StatusFound, w.Code, w.Body.String())
+	}
+	require.NoError(s.DB.UpdatePackage("secret_pkg", func(pkg *unpub.UnpubPackage, exists bool) error {
+		pkg.Private = true
+		pkg.TrustPolicies = []unpub.TrustPolicy{{
+			Issuer: testIssuer,
+			Claims: map[string]string{"repository": "acme/packages"},
+		}}
+		return nil
+	}))
+	trusted := sign(map[string]interface{}{"sub": "repo:acme/packages", "repository": "acme/packages"})
+	other := sign(map[string]interface{}{"sub": "repo:acme/other", "repository": "acme/other"})
+
+	// Identity tokens list the private packages they can read, and no others.
+	count, names := listPackages(t, withToken(r, trusted), "size=10&page=0&sort=name")
+	require.Equal(3, count)
+	require.Equal([]string{"a_pkg", "secret_pkg", "z_pkg"}, names)
+	count, names = listPackages(t, withToken(r, trusted), "size=2&page=1&sort=name")
+	require.Equal(3, count)
+	require.Equal([]string{"z_pkg"}, names)
+	count, names = listPackages(t, withToken(r, trusted), "size=10&page=0&q=secret")
+	require.Equal(1, count)
+	require.Equal([]string{"secret_pkg"}, names)
+	w := httptest.NewRecorder()
+	withToken(r, trusted).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/packages/secret_pkg", nil))
+	require.Equal(http.StatusOK, w.Code)
+
+	count, names = listPackages(t, withToken(r, other), "size=10&page=0&sort=name")
+	require.Equal(2, count)
+	require.Equal([]string{"a_pkg", "z_pkg"}, names)
+	w = httptest.NewRecorder()
+	withToken(r, other).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/packages/secret_pkg", nil))
+	require.Equal(http.StatusNotFound, w.Code)
+}
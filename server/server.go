@@ -2,27 +2,28 @@ package server
 
 import (
 	"archive/tar"
-	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/dgraph-io/badger/v3"
 	"github.com/dnys1/unpub"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-	"golang.org/x/mod/semver"
 	"gopkg.in/yaml.v3"
 )
 
@@ -37,15 +38,36 @@ func (pv PkgVersion) Filename() string {
 
 func SetupRoutes(r *mux.Router, s UnpubService) {
 	r.Path("/api/packages/{name}").Methods(http.MethodOptions, http.MethodGet).HandlerFunc(s.GetVersions)
+	r.Path("/api/packages/{name}/options").Methods(http.MethodOptions, http.MethodGet).HandlerFunc(s.GetPackageOptions)
+	r.Path("/api/packages/{name}/options").Methods(http.MethodPut).HandlerFunc(s.SetPackageOptions)
+	r.Path("/api/packages/{name}/trust-policies").Methods(http.MethodOptions, http.MethodGet).HandlerFunc(s.GetTrustPolicies)
+	r.Path("/api/packages/{name}/trust-policies").Methods(http.MethodPut).HandlerFunc(s.SetTrustPolicies)
+	r.Path("/api/packages/{name}/advisories").Methods(http.MethodOptions, http.MethodGet).HandlerFunc(s.GetAdvisories)
 	r.Path("/api/packages/{name}/versions/{version}").Methods(http.MethodOptions, http.MethodGet).HandlerFunc(s.GetVersion)
+	r.Path("/api/packages/{name}/versions/{version}/options").Methods(http.MethodOptions, http.MethodPost, http.MethodPut).HandlerFunc(s.SetVersionOptions)
 	r.Path("/packages/{name}/versions/{version}.tar.gz").Methods(http.MethodOptions, http.MethodGet).HandlerFunc(s.Download)
+	r.Path("/api/package-names").Methods(http.MethodOptions, http.MethodGet).HandlerFunc(s.GetPackageNames)
 	r.Path("/api/packages/versions/new").Methods(http.MethodOptions, http.MethodGet).HandlerFunc(s.GetUploadUrl)
 	r.Path("/api/packages/versions/newUpload").Methods(http.MethodOptions, http.MethodPost).HandlerFunc(s.Upload)
 	r.Path("/api/packages/versions/newUploadFinish").Methods(http.MethodOptions, http.MethodGet).HandlerFunc(s.UploadFinish)
 	r.Path("/api/packages/{name}/uploaders").Methods(http.MethodOptions, http.MethodPost).HandlerFunc(s.AddUploader)
 	r.Path("/api/packages/{name}/uploaders/{email}").Methods(http.MethodOptions, http.MethodDelete).HandlerFunc(s.RemoveUploader)
+	r.Path("/api/packages/{name}/readers").Methods(http.MethodOptions, http.MethodGet).HandlerFunc(s.GetReaders)
+	r.Path("/api/packages/{name}/readers").Methods(http.MethodPost).HandlerFunc(s.AddReader)
+	r.Path("/api/packages/{name}/readers/{email}").Methods(http.MethodOptions, http.MethodDelete).HandlerFunc(s.RemoveReader)
 	r.Path("/webapi/packages").Methods(http.MethodOptions, http.MethodGet).HandlerFunc(s.GetPackages)
+	r.Path("/webapi/package/{name}/stats").Methods(http.MethodOptions, http.MethodGet).HandlerFunc(s.GetPackageStats)
 	r.Path("/webapi/package/{name}/{version}").Methods(http.MethodOptions, http.MethodGet).HandlerFunc(s.GetPackageDetails)
+	r.Path("/admin/backup").Methods(http.MethodOptions, http.MethodGet).HandlerFunc(s.Backup)
+	r.Path("/admin/restore").Methods(http.MethodOptions, http.MethodPost).HandlerFunc(s.Restore)
+	r.Path("/admin/packages/{name}").Methods(http.MethodOptions, http.MethodDelete).HandlerFunc(s.DeletePackage)
+	r.Path("/admin/packages/{name}/versions/{version}").Methods(http.MethodOptions, http.MethodDelete).HandlerFunc(s.DeleteVersion)
+	r.Path("/admin/packages/{name}/advisories").Methods(http.MethodOptions, http.MethodPost).HandlerFunc(s.CreateAdvisory)
+	r.Path("/admin/packages/{name}/advisories/{id}").Methods(http.MethodOptions, http.MethodDelete).HandlerFunc(s.WithdrawAdvisory)
+	r.Path("/admin/tokens").Methods(http.MethodOptions, http.MethodGet).HandlerFunc(s.GetTokens)
+	r.Path("/admin/tokens").Methods(http.MethodPost).HandlerFunc(s.CreateToken)
+	r.Path("/admin/tokens/{id}").Methods(http.MethodOptions, http.MethodDelete).HandlerFunc(s.RevokeToken)
+	r.Path("/admin/audit").Methods(http.MethodOptions, http.MethodGet).HandlerFunc(s.GetAudit)
 
 	r.Use(func(next http.Handler) http.Handler {
 		return handlers.LoggingHandler(os.Stdout, next)
@@ -57,69 +79,134 @@ func SetupRoutes(r *mux.Router, s UnpubService) {
 		})
 	})
 	r.Use(mux.CORSMethodMiddleware(r))
+	r.Use(checkAccept)
+}
+
+// checkAccept rejects requests to the pub repository API which only accept
+// versions of it other than v2. Requests not naming any version, such as
+// those from browsers, are served as v2.
+func checkAccept(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var versions []string
+		for _, header := range r.Header.Values("Accept") {
+			for _, accept := range strings.Split(header, ",") {
+				mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+				if err != nil {
+					continue
+				}
+				if strings.HasPrefix(mediaType, "application/vnd.pub.") {
+					versions = append(versions, mediaType)
+				}
+			}
+		}
+		for _, v := range versions {
+			if v == "application/vnd.pub.v2+json" {
+				versions = nil
+				break
+			}
+		}
+		if len(versions) > 0 {
+			writeError(w, http.StatusNotAcceptable, fmt.Errorf("%w: unsupported API version %s, only application/vnd.pub.v2+json is served", errNotAcceptable, strings.Join(versions, ", ")))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 type UnpubService interface {
 	GetVersions(w http.ResponseWriter, r *http.Request)
+	GetPackageOptions(w http.ResponseWriter, r *http.Request)
+	SetPackageOptions(w http.ResponseWriter, r *http.Request)
+	GetTrustPolicies(w http.ResponseWriter, r *http.Request)
+	SetTrustPolicies(w http.ResponseWriter, r *http.Request)
 	GetVersion(w http.ResponseWriter, r *http.Request)
+	SetVersionOptions(w http.ResponseWriter, r *http.Request)
 	Download(w http.ResponseWriter, r *http.Request)
 	GetUploadUrl(w http.ResponseWriter, r *http.Request)
 	Upload(w http.ResponseWriter, r *http.Request)
 	UploadFinish(w http.ResponseWriter, r *http.Request)
 	AddUploader(w http.ResponseWriter, r *http.Request)
 	RemoveUploader(w http.ResponseWriter, r *http.Request)
+	GetReaders(w http.ResponseWriter, r *http.Request)
+	AddReader(w http.ResponseWriter, r *http.Request)
+	RemoveReader(w http.ResponseWriter, r *http.Request)
 	GetPackages(w http.ResponseWriter, r *http.Request)
+	GetPackageNames(w http.ResponseWriter, r *http.Request)
 	GetPackageDetails(w http.ResponseWriter, r *http.Request)
+	GetPackageStats(w http.ResponseWriter, r *http.Request)
+	Backup(w http.ResponseWriter, r *http.Request)
+	Restore(w http.ResponseWriter, r *http.Request)
+	DeletePackage(w http.ResponseWriter, r *http.Request)
+	DeleteVersion(w http.ResponseWriter, r *http.Request)
+	GetAudit(w http.ResponseWriter, r *http.Request)
+	GetAdvisories(w http.ResponseWriter, r *http.Request)
+	CreateAdvisory(w http.ResponseWriter, r *http.Request)
+	WithdrawAdvisory(w http.ResponseWriter, r *http.Request)
+	CreateToken(w http.ResponseWriter, r *http.Request)
+	GetTokens(w http.ResponseWriter, r *http.Request)
+	RevokeToken(w http.ResponseWriter, r *http.Request)
 }
 
 type UnpubServiceImpl struct {
-	InMemory      bool
-	Path          string
-	DB            unpub.UnpubDb
+	// Path is where archives were stored before they moved to Blobs.
+	Path  string
+	DB    unpub.UnpubDb
+	Blobs unpub.BlobStore
+	// UploaderEmail is the identity of requests which need no token under
+	// Auth.
 	UploaderEmail string
 	Addr          string
+	// Auth is one of the authentication modes, AuthNone if empty.
+	Auth string
+	// OIDC verifies identity tokens from CI, which can publish packages with
+	// a matching trust policy. They are not accepted if it is nil.
+	OIDC *unpub.OIDCVerifier
+
+	publishingMu sync.Mutex
+	// publishing locks the archives being published by digest.
+	publishing map[string]*digestLock
 }
 
 func (s *UnpubServiceImpl) GetVersions(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.authorizeRead(w, r)
+	if !ok {
+		return
+	}
 	pkgName, ok := mux.Vars(r)["name"]
 	if !ok {
 		writeBadRequest(w, nil)
 		return
 	}
 	pkg, err := s.DB.QueryPackage(pkgName)
+	if err == nil {
+		// Expired versions are hidden until the sweeper removes them.
+		if pkg.RemoveExpired(time.Now()); len(pkg.Versions) == 0 {
+			err = unpub.ErrNotFound
+		}
+	}
 	if err != nil {
-		if errors.Is(err, badger.ErrKeyNotFound) {
+		if errors.Is(err, unpub.ErrNotFound) {
 			http.Redirect(w, r, fmt.Sprintf("https://pub.dev%s", r.URL.Path), http.StatusFound)
 			return
 		}
 		writeInternalErr(w, err)
 		return
 	}
+	if !c.canRead(&pkg) {
+		s.writeHidden(w, c, pkgName)
+		return
+	}
 
 	versions := unpub.UnpubVersions(pkg.Versions)
 	sort.Slice(versions, func(i, j int) bool {
-		return semver.Compare(versions[i].Version, versions[j].Version) == -1
+		return unpub.CompareVersions(versions[i].Version, versions[j].Version) == -1
 	})
 
-	type respVersion struct {
-		ArchiveURL string                 `json:"archive_url"`
-		Pubspec    map[string]interface{} `json:"pubspec"`
-		Version    string                 `json:"version"`
-	}
-	toJson := func(version unpub.UnpubVersion) (respVersion, error) {
-		var pubspecMap map[string]interface{}
-		err := yaml.Unmarshal([]byte(version.PubspecYAML), &pubspecMap)
-		if err != nil {
-			return respVersion{}, err
-		}
-		return respVersion{
-			ArchiveURL: fmt.Sprintf("%s/packages/%s/versions/%s.tar.gz", s.Addr, pkg.Name, version.Version),
-			Pubspec:    pubspecMap,
-			Version:    version.Version,
-		}, nil
-	}
-
-	latest, err := toJson(pkg.LatestVersion())
+	latest, err := s.versionResponse(pkg.Name, pkg.LatestVersion())
 	if err != nil {
 		writeBadRequest(w, err)
 		return
@@ -127,7 +214,7 @@ func (s *UnpubServiceImpl) GetVersions(w http.ResponseWriter, r *http.Request) {
 
 	respVersions := []respVersion{}
 	for _, version := range versions {
-		v, err := toJson(version)
+		v, err := s.versionResponse(pkg.Name, version)
 		if err != nil {
 			writeBadRequest(w, err)
 			return
@@ -135,19 +222,249 @@ func (s *UnpubServiceImpl) GetVersions(w http.ResponseWriter, r *http.Request) {
 		respVersions = append(respVersions, v)
 	}
 
+	// pub only fetches the advisories of packages which announce them.
+	advisories, err := s.DB.QueryAdvisories(pkg.Name)
+	if err != nil {
+		writeInternalErr(w, err)
+		return
+	}
+
 	resp := struct {
-		Name     string        `json:"name"`
-		Latest   respVersion   `json:"latest"`
-		Versions []respVersion `json:"versions"`
+		Name              string        `json:"name"`
+		IsDiscontinued    bool          `json:"isDiscontinued,omitempty"`
+		ReplacedBy        string        `json:"replacedBy,omitempty"`
+		AdvisoriesUpdated *time.Time    `json:"advisoriesUpdated,omitempty"`
+		Latest            respVersion   `json:"latest"`
+		Versions          []respVersion `json:"versions"`
 	}{
-		Name:     pkg.Name,
-		Latest:   latest,
-		Versions: respVersions,
+		Name:              pkg.Name,
+		IsDiscontinued:    pkg.IsDiscontinued,
+		ReplacedBy:        pkg.ReplacedBy,
+		AdvisoriesUpdated: unpub.AdvisoriesUpdated(advisories),
+		Latest:            latest,
+		Versions:          respVersions,
 	}
 	writeJSON(w, resp)
 }
 
+// GetPackageNames lists the names of every listed package, for IDEs to
+// complete dependencies with. The ETag is a digest of the list, so clients
+// polling with If-None-Match only download it when it changes.
+func (s *UnpubServiceImpl) GetPackageNames(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authorize(w, r, unpub.ScopeRead); !ok {
+		return
+	}
+	names, err := s.DB.QueryPackageNames()
+	if err != nil {
+		writeInternalErr(w, err)
+		return
+	}
+	if names == nil {
+		names = []string{}
+	}
+	b, err := json.Marshal(struct {
+		Packages []string `json:"packages"`
+	}{
+		Packages: names,
+	})
+	if err != nil {
+		writeInternalErr(w, err)
+		return
+	}
+	digest := sha256.Sum256(b)
+	etag := fmt.Sprintf(`"%x"`, digest[:16])
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.pub.v2+json")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(b)))
+	w.Write(b)
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, ignoring
+// weak validator prefixes as RFC 9110 requires.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// packageOptions are the options of a package which its uploaders can
+// change. Options left out of an update keep their value.
+type packageOptions struct {
+	IsDiscontinued *bool   `json:"isDiscontinued,omitempty"`
+	ReplacedBy     *string `json:"replacedBy,omitempty"`
+	IsUnlisted     *bool   `json:"isUnlisted,omitempty"`
+}
+
+func optionsOf(pkg unpub.UnpubPackage) packageOptions {
+	options := packageOptions{
+		IsDiscontinued: &pkg.IsDiscontinued,
+		IsUnlisted:     &pkg.IsUnlisted,
+	}
+	if pkg.ReplacedBy != "" {
+		options.ReplacedBy = &pkg.ReplacedBy
+	}
+	return options
+}
+
+// summary describes the options for the audit log.
+func (o packageOptions) summary() string {
+	var options []string
+	if *o.IsDiscontinued {
+		options = append(options, "discontinued")
+	}
+	if o.ReplacedBy != nil {
+		options = append(options, "replacedBy="+*o.ReplacedBy)
+	}
+	if *o.IsUnlisted {
+		options = append(options, "unlisted")
+	}
+	return strings.Join(options, ",")
+}
+
+func (s *UnpubServiceImpl) GetPackageOptions(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.authorizeRead(w, r)
+	if !ok {
+		return
+	}
+	pkgName := mux.Vars(r)["name"]
+	pkg, err := s.DB.QueryPackage(pkgName)
+	if err != nil {
+		if errors.Is(err, unpub.ErrNotFound) {
+			writeNotFound(w, "package %s not found", pkgName)
+			return
+		}
+		writeInternalErr(w, err)
+		return
+	}
+	if !c.canRead(&pkg) {
+		s.writeHidden(w, c, pkgName)
+		return
+	}
+	writeJSON(w, optionsOf(pkg))
+}
+
+// SetPackageOptions discontinues or unlists a package, or undoes either. A
+// package can only be replaced by another package in this registry, and
+// stops being replaced once it is no longer discontinued.
+func (s *UnpubServiceImpl) SetPackageOptions(w http.ResponseWriter, r *http.Request) {
+	identity, ok := s.authorize(w, r, unpub.ScopePublish)
+	if !ok {
+		return
+	}
+	pkgName := mux.Vars(r)["name"]
+	var options packageOptions
+	if err := json.NewDecoder(r.Body).Decode(&options); err != nil {
+		writeBadRequest(w, fmt.Errorf("bad options: %v", err))
+		return
+	}
+	if options.ReplacedBy != nil && *options.ReplacedBy != "" {
+		if *options.ReplacedBy == pkgName {
+			writeBadRequest(w, errors.New("a package cannot replace itself"))
+			return
+		}
+		if _, err := s.DB.QueryPackage(*options.ReplacedBy); err != nil {
+			if errors.Is(err, unpub.ErrNotFound) {
+				writeBadRequest(w, fmt.Errorf("replacing package %s does not exist", *options.ReplacedBy))
+				return
+			}
+			writeInternalErr(w, err)
+			return
+		}
+	}
+
+	var before, after packageOptions
+	var optionsErr error
+	err := s.DB.UpdatePackage(pkgName, func(pkg *unpub.UnpubPackage, exists bool) error {
+		if !exists {
+			return unpub.ErrNotFound
+		}
+		if !isUploader(pkg, identity) {
+			optionsErr = unpub.NewError(unpub.ErrForbidden, "no permission")
+			return optionsErr
+		}
+		before = optionsOf(*pkg)
+		if options.IsDiscontinued != nil {
+			pkg.IsDiscontinued = *options.IsDiscontinued
+		}
+		if options.ReplacedBy != nil {
+			pkg.ReplacedBy = *options.ReplacedBy
+		}
+		if !pkg.IsDiscontinued {
+			if options.ReplacedBy != nil && *options.ReplacedBy != "" {
+				optionsErr = errors.New("only a discontinued package can be replaced")
+				return optionsErr
+			}
+			pkg.ReplacedBy = ""
+		}
+		if options.IsUnlisted != nil {
+			pkg.IsUnlisted = *options.IsUnlisted
+		}
+		after = optionsOf(*pkg)
+		return nil
+	})
+	if errors.Is(err, unpub.ErrNotFound) {
+		writeNotFound(w, "package %s not found", pkgName)
+		return
+	}
+	if optionsErr != nil {
+		writeBadRequest(w, optionsErr)
+		return
+	}
+	if err != nil {
+		writeInternalErr(w, err)
+		return
+	}
+	if before.summary() != after.summary() {
+		s.audit(r, unpub.AuditEvent{
+			Action:  unpub.AuditOptions,
+			Actor:   identity,
+			Package: pkgName,
+			Before:  before.summary(),
+			After:   after.summary(),
+		})
+	}
+
+	writeJSON(w, after)
+}
+
+// respVersion is a version in the format of the hosted pub repository API.
+type respVersion struct {
+	ArchiveURL    string                 `json:"archive_url"`
+	ArchiveSHA256 string                 `json:"archive_sha256,omitempty"`
+	Pubspec       map[string]interface{} `json:"pubspec"`
+	Version       string                 `json:"version"`
+	Retracted     bool                   `json:"retracted,omitempty"`
+}
+
+func (s *UnpubServiceImpl) versionResponse(name string, version unpub.UnpubVersion) (respVersion, error) {
+	var pubspecMap map[string]interface{}
+	err := yaml.Unmarshal([]byte(version.PubspecYAML), &pubspecMap)
+	if err != nil {
+		return respVersion{}, err
+	}
+	return respVersion{
+		ArchiveURL:    fmt.Sprintf("%s/packages/%s/versions/%s.tar.gz", s.Addr, name, version.Version),
+		ArchiveSHA256: version.ArchiveSHA256,
+		Pubspec:       pubspecMap,
+		Version:       version.Version,
+		Retracted:     version.Retracted,
+	}, nil
+}
+
 func (s *UnpubServiceImpl) GetVersion(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.authorizeRead(w, r)
+	if !ok {
+		return
+	}
 	vars := mux.Vars(r)
 	pkgName, ok := vars["name"]
 	if !ok {
@@ -159,30 +476,106 @@ func (s *UnpubServiceImpl) GetVersion(w http.ResponseWriter, r *http.Request) {
 		writeBadRequest(w, nil)
 		return
 	}
+	if !s.checkRead(w, c, pkgName) {
+		return
+	}
 
-	pkg, err := s.DB.QueryPackage(pkgName)
+	foundVersion, err := s.DB.QueryVersion(pkgName, version)
+	if err == nil && foundVersion.Expired(time.Now()) {
+		err = unpub.ErrNotFound
+	}
 	if err != nil {
-		if errors.Is(err, badger.ErrKeyNotFound) {
-			w.WriteHeader(http.StatusNotFound)
+		if errors.Is(err, unpub.ErrNotFound) {
+			writeNotFound(w, "%s %s not found", pkgName, version)
 			return
 		}
 		writeInternalErr(w, err)
 		return
 	}
-	var foundVersion *unpub.UnpubVersion
-	for _, v := range pkg.Versions {
-		if semver.Compare(version, v.Version) == 0 {
-			foundVersion = &v
+	resp, err := s.versionResponse(pkgName, foundVersion)
+	if err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+	writeJSON(w, resp)
+}
+
+// versionOptions are the options of a version which its uploaders can change.
+type versionOptions struct {
+	IsRetracted bool `json:"isRetracted"`
+}
+
+// SetVersionOptions retracts or restores a version, within
+// unpub.RetractionWindow of its publication.
+func (s *UnpubServiceImpl) SetVersionOptions(w http.ResponseWriter, r *http.Request) {
+	identity, ok := s.authorize(w, r, unpub.ScopePublish)
+	if !ok {
+		return
+	}
+	vars := mux.Vars(r)
+	pkgName, version := vars["name"], vars["version"]
+	var options versionOptions
+	if err := json.NewDecoder(r.Body).Decode(&options); err != nil {
+		writeBadRequest(w, fmt.Errorf("bad options: %v", err))
+		return
+	}
+
+	var before, after string
+	var changed bool
+	var optionsErr error
+	err := s.DB.UpdatePackage(pkgName, func(pkg *unpub.UnpubPackage, exists bool) error {
+		if !exists {
+			return unpub.ErrNotFound
+		}
+		if !isUploader(pkg, identity) {
+			optionsErr = unpub.NewError(unpub.ErrForbidden, "no permission")
+			return optionsErr
+		}
+		v, ok := pkg.Versions[version]
+		if !ok {
+			return unpub.ErrNotFound
 		}
+		changed = v.Retracted != options.IsRetracted
+		before = pkg.Latest
+		optionsErr = pkg.SetRetracted(version, options.IsRetracted, time.Now())
+		after = pkg.Latest
+		return optionsErr
+	})
+	if errors.Is(err, unpub.ErrNotFound) {
+		writeNotFound(w, "%s %s not found", pkgName, version)
+		return
+	}
+	if optionsErr != nil {
+		writeBadRequest(w, optionsErr)
+		return
 	}
-	if foundVersion == nil {
-		http.NotFound(w, r)
+	if err != nil {
+		writeInternalErr(w, err)
 		return
 	}
-	writeJSON(w, foundVersion)
+	if changed {
+		action := unpub.AuditRetract
+		if !options.IsRetracted {
+			action = unpub.AuditUnretract
+		}
+		s.audit(r, unpub.AuditEvent{
+			Action:  action,
+			Actor:   identity,
+			Package: pkgName,
+			Version: version,
+			Before:  before,
+			After:   after,
+		})
+	}
+
+	writeJSON(w, options)
 }
 
 func (s *UnpubServiceImpl) Download(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.authorizeRead(w, r)
+	if !ok {
+		return
+	}
 	vars := mux.Vars(r)
 	pkgName, ok := vars["name"]
 	if !ok {
@@ -194,55 +587,61 @@ func (s *UnpubServiceImpl) Download(w http.ResponseWriter, r *http.Request) {
 		writeBadRequest(w, nil)
 		return
 	}
+	if !s.checkRead(w, c, pkgName) {
+		return
+	}
 
 	redirect := func() {
 		http.Redirect(w, r, fmt.Sprintf("https://pub.dev%s", r.URL.Path), http.StatusFound)
 	}
 
-	var file io.Reader
-	var err error
-	if s.InMemory {
-		file, err = s.DB.GetFile(pkgName, version)
-		if err != nil {
-			if errors.Is(err, badger.ErrKeyNotFound) {
-				redirect()
-				return
-			} else {
-				writeInternalErr(w, err)
-				return
-			}
+	v, err := s.DB.QueryVersion(pkgName, version)
+	if err == nil && v.Expired(time.Now()) {
+		err = unpub.ErrNotFound
+	}
+	if err != nil {
+		if errors.Is(err, unpub.ErrNotFound) {
+			redirect()
+			return
 		}
-	} else {
-		pkgVersion := PkgVersion{Package: pkgName, Version: version}
-		osFile, err := os.Open(filepath.Join(s.Path, pkgVersion.Filename()))
-		if err != nil {
-			if errors.Is(err, os.ErrNotExist) {
-				redirect()
-				return
-			} else {
-				writeInternalErr(w, err)
-				return
-			}
+		writeInternalErr(w, err)
+		return
+	}
+	if v.ArchiveSHA256 == "" {
+		redirect()
+		return
+	}
+
+	blob, err := s.Blobs.Get(v.ArchiveSHA256)
+	if err != nil {
+		if errors.Is(err, unpub.ErrNotFound) {
+			redirect()
+			return
 		}
-		defer osFile.Close()
-		file = osFile
+		writeInternalErr(w, err)
+		return
 	}
+	defer blob.Close()
 
-	if isPubClient(r) {
+	// Resumed and conditional downloads are not counted again.
+	if isPubClient(r) && r.Header.Get("Range") == "" && r.Header.Get("If-Modified-Since") == "" {
 		err := s.DB.IncreaseDownloads(pkgName, version)
 		if err != nil {
 			writeInternalErr(w, err)
 			return
 		}
 	}
+	// ServeContent handles Range and If-Modified-Since, and sets
+	// Content-Length and Last-Modified.
 	w.Header().Set("Content-Type", "application/octet-stream")
-	_, err = io.Copy(w, file)
-	if err != nil {
-		log.Printf("Error sending download: %v\n", err)
-	}
+	name := PkgVersion{Package: pkgName, Version: version}.Filename()
+	http.ServeContent(w, r, name, blob.ModTime(), blob)
 }
 
 func (s *UnpubServiceImpl) GetUploadUrl(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authenticate(w, r, unpub.ScopePublish); !ok {
+		return
+	}
 	resp := struct {
 		URL    string                 `json:"url"`
 		Fields map[string]interface{} `json:"fields"`
@@ -254,7 +653,11 @@ func (s *UnpubServiceImpl) GetUploadUrl(w http.ResponseWriter, r *http.Request)
 }
 
 func (s *UnpubServiceImpl) Upload(w http.ResponseWriter, r *http.Request) {
-	email := s.UploaderEmail
+	c, ok := s.authenticate(w, r, unpub.ScopePublish)
+	if !ok {
+		return
+	}
+	identity, claims := c.identity, c.claims
 	reader, err := r.MultipartReader()
 	if err != nil {
 		writeInternalErr(w, err)
@@ -265,6 +668,16 @@ func (s *UnpubServiceImpl) Upload(w http.ResponseWriter, r *http.Request) {
 		writeBadRequest(w, err)
 		return
 	}
+	// A preview version can be published with a time-to-live, after which it
+	// is removed along with its archive.
+	var ttl time.Duration
+	if v := form.Value["ttl"]; len(v) > 0 && v[0] != "" {
+		ttl, err = time.ParseDuration(v[0])
+		if err != nil || ttl <= 0 {
+			writeBadRequest(w, fmt.Errorf("ttl must be a positive duration such as 72h, got %q", v[0]))
+			return
+		}
+	}
 	var file multipart.File
 	var found bool
 outer:
@@ -301,10 +714,14 @@ outer:
 	}
 
 	version := unpub.UnpubVersion{
-		Uploader:  &email,
+		Uploader:  &identity,
 		CreatedAt: time.Now().Truncate(time.Millisecond),
 		UpdatedAt: time.Now().Truncate(time.Millisecond),
 	}
+	if ttl > 0 {
+		expiresAt := version.CreatedAt.Add(ttl)
+		version.ExpiresAt = &expiresAt
+	}
 	for {
 		header, err := tr.Next()
 
@@ -333,7 +750,7 @@ outer:
 			version.PubspecYAML = str
 			pubspec, err := version.Pubspec()
 			if err != nil {
-				writeBadRequest(w, fmt.Errorf("bad pubspec: %v", err))
+				writeBadRequest(w, unpub.NewError(unpub.ErrInvalidPubspec, "bad pubspec: %v", err))
 				return
 			}
 			version.Version = pubspec.Version
@@ -355,76 +772,83 @@ outer:
 	}
 
 	if version.PubspecYAML == "" {
-		writeBadRequest(w, errors.New("no pubspec found"))
+		writeBadRequest(w, unpub.NewError(unpub.ErrInvalidPubspec, "no pubspec found"))
 		return
 	}
 
 	pubspec, err := version.Pubspec()
 	if err != nil {
-		writeBadRequest(w, err)
+		writeBadRequest(w, unpub.NewError(unpub.ErrInvalidPubspec, "bad pubspec: %v", err))
 		return
 	}
-	pkg, err := s.DB.QueryPackage(pubspec.Name)
-	if err != nil {
-		if errors.Is(err, badger.ErrKeyNotFound) {
-			pkg = unpub.NewPackage(
-				pubspec.Name,
-				pubspec.PublishTo == "none",
-				[]string{email},
-			)
-		} else {
-			writeInternalErr(w, err)
-			return
-		}
+	if !unpub.ValidVersion(pubspec.Version) {
+		writeBadRequest(w, unpub.NewError(unpub.ErrInvalidPubspec,
+			"invalid version %q in pubspec: versions must have the form MAJOR.MINOR.PATCH", pubspec.Version))
+		return
 	}
-	err = pkg.AddVersion(version)
-	if err != nil {
-		writeBadRequest(w, err)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		writeInternalErr(w, err)
 		return
 	}
-	err = s.DB.SavePackage(pkg)
+	version.ArchiveSHA256, err = unpub.BlobDigest(file)
 	if err != nil {
 		writeInternalErr(w, err)
 		return
 	}
-
-	// Add to filesystem
-	_, err = file.Seek(0, io.SeekStart)
-	if err != nil {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
 		writeInternalErr(w, err)
 		return
 	}
-
-	pkgVersion := PkgVersion{Package: pkg.Name, Version: version.Version}
-	if s.InMemory {
-		var data bytes.Buffer
-		_, err = io.Copy(&data, file)
-		if err != nil {
-			writeInternalErr(w, err)
-			return
-		}
-		err = s.DB.SaveFile(pkg.Name, version.Version, data.Bytes())
-		if err != nil {
-			writeInternalErr(w, err)
-			return
-		}
-	} else {
-		osFile, err := os.Create(filepath.Join(s.Path, pkgVersion.Filename()))
-		if err != nil {
-			writeInternalErr(w, err)
-			return
-		}
-		_, err = io.Copy(osFile, file)
-		if err != nil {
-			writeInternalErr(w, err)
-			return
+	var versionErr error
+	var previous string
+	err = s.publish(pubspec.Name, version.ArchiveSHA256, file, func(pkg *unpub.UnpubPackage, exists bool) error {
+		previous = pkg.Latest
+		if claims != nil {
+			// Identity tokens cannot create packages, which have no
+			// policy trusting them yet.
+			if !exists || !pkg.Trusts(*claims) {
+				versionErr = unpub.NewError(unpub.ErrForbidden, "no trust policy of %s matches the identity token of %s", pubspec.Name, identity)
+				return versionErr
+			}
+		} else if !exists {
+			*pkg = unpub.NewPackage(
+				pubspec.Name,
+				pubspec.PublishTo == "none",
+				[]string{identity},
+			)
+		} else if s.requiresToken(unpub.ScopePublish) && !isUploader(pkg, identity) {
+			// Without tokens everyone publishes as UploaderEmail, which
+			// packages restored from elsewhere may not list.
+			versionErr = unpub.NewError(unpub.ErrForbidden, "%s is not an uploader of %s", identity, pkg.Name)
+			return versionErr
 		}
+		versionErr = pkg.AddVersion(version)
+		return versionErr
+	})
+	if versionErr != nil {
+		writeBadRequest(w, versionErr)
+		return
 	}
+	if err != nil {
+		writeInternalErr(w, err)
+		return
+	}
+	s.audit(r, unpub.AuditEvent{
+		Action:  unpub.AuditPublish,
+		Actor:   identity,
+		Package: pubspec.Name,
+		Version: version.Version,
+		Before:  previous,
+		After:   "sha256:" + version.ArchiveSHA256,
+	})
 
 	http.Redirect(w, r, fmt.Sprintf("%s/api/packages/versions/newUploadFinish", s.Addr), http.StatusFound)
 }
 
 func (s *UnpubServiceImpl) UploadFinish(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authenticate(w, r, unpub.ScopePublish); !ok {
+		return
+	}
 	writeJSON(w, struct {
 		Success interface{} `json:"success"`
 	}{
@@ -437,98 +861,101 @@ func (s *UnpubServiceImpl) UploadFinish(w http.ResponseWriter, r *http.Request)
 }
 
 func (s *UnpubServiceImpl) AddUploader(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	pkgName, ok := vars["name"]
-	if !ok {
-		writeBadRequest(w, nil)
-		return
-	}
-
 	email := r.FormValue("email")
-	if email == "" {
-		writeBadRequest(w, nil)
-		return
-	}
-
-	uploaderEmail := s.UploaderEmail
-
-	pkg, err := s.DB.QueryPackage(pkgName)
-	if err != nil {
-		writeBadRequest(w, err)
-		return
-	}
-
-	var foundEmail bool
-	for _, uploader := range pkg.Uploaders {
-		if uploader == email {
-			writeBadRequest(w, errors.New("uploader already exists"))
-			return
+	ok := s.updateUploaders(w, r, unpub.AuditAddUploader, func(pkg *unpub.UnpubPackage) error {
+		if email == "" {
+			return unpub.NewError(unpub.ErrInvalidInput, "email is required")
 		}
-		if uploader == uploaderEmail {
-			foundEmail = true
+		if isUploader(pkg, email) {
+			return unpub.NewError(unpub.ErrConflict, "uploader already exists")
 		}
+		pkg.Uploaders = append(pkg.Uploaders, email)
+		return nil
+	})
+	if ok {
+		w.Write([]byte("uploader added"))
 	}
-	if !foundEmail {
-		writeBadRequest(w, errors.New("no permission"))
-		return
-	}
-
-	err = s.DB.AddUploader(pkgName, email)
-	if err != nil {
-		writeInternalErr(w, err)
-		return
-	}
-
-	w.Write([]byte("uploader added"))
 }
 
+// RemoveUploader removes the uploader named by the email path variable from a
+// package. The last uploader cannot be removed, as nobody could then manage
+// the package.
 func (s *UnpubServiceImpl) RemoveUploader(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	pkgName, ok := vars["name"]
-	if !ok {
-		writeBadRequest(w, nil)
-		return
-	}
-
-	email := r.FormValue("email")
-	if email == "" {
-		writeBadRequest(w, nil)
-		return
-	}
-
-	uploaderEmail := s.UploaderEmail
-
-	pkg, err := s.DB.QueryPackage(pkgName)
-	if err != nil {
-		writeBadRequest(w, err)
-		return
+	email := mux.Vars(r)["email"]
+	ok := s.updateUploaders(w, r, unpub.AuditRemoveUploader, func(pkg *unpub.UnpubPackage) error {
+		if !isUploader(pkg, email) {
+			return unpub.NewError(unpub.ErrInvalidInput, "%s is not an uploader", email)
+		}
+		if len(pkg.Uploaders) == 1 {
+			return unpub.NewError(unpub.ErrInvalidInput, "cannot remove the last uploader")
+		}
+		for i, uploader := range pkg.Uploaders {
+			if uploader == email {
+				pkg.Uploaders = append(pkg.Uploaders[:i:i], pkg.Uploaders[i+1:]...)
+				break
+			}
+		}
+		return nil
+	})
+	if ok {
+		w.Write([]byte("uploader removed"))
 	}
+}
 
-	var foundEmail bool
-	for _, uploader := range pkg.Uploaders {
-		if uploader == email {
-			writeBadRequest(w, errors.New("uploader already exists"))
-			return
+// updateUploaders changes the uploaders of a package with update on behalf of
+// one of them, and records action in the audit log. The checks of update run
+// in the same transaction as the change, so concurrent changes cannot both
+// pass them. It writes any error and reports whether the change was made.
+func (s *UnpubServiceImpl) updateUploaders(w http.ResponseWriter, r *http.Request, action string, update func(pkg *unpub.UnpubPackage) error) bool {
+	identity, ok := s.authorize(w, r, unpub.ScopePublish)
+	if !ok {
+		return false
+	}
+	pkgName := mux.Vars(r)["name"]
+	var before, after []string
+	var uploadersErr error
+	err := s.DB.UpdatePackage(pkgName, func(pkg *unpub.UnpubPackage, exists bool) error {
+		if !exists {
+			return unpub.ErrNotFound
+		}
+		if !isUploader(pkg, identity) {
+			uploadersErr = unpub.NewError(unpub.ErrForbidden, "no permission")
+			return uploadersErr
 		}
-		if uploader == uploaderEmail {
-			foundEmail = true
+		before = append([]string{}, pkg.Uploaders...)
+		if uploadersErr = update(pkg); uploadersErr != nil {
+			return uploadersErr
 		}
+		after = pkg.Uploaders
+		return nil
+	})
+	if errors.Is(err, unpub.ErrNotFound) {
+		writeNotFound(w, "package %s not found", pkgName)
+		return false
 	}
-	if !foundEmail {
-		writeBadRequest(w, errors.New("no permission"))
-		return
+	if uploadersErr != nil {
+		writeBadRequest(w, uploadersErr)
+		return false
 	}
-
-	err = s.DB.RemoveUploader(pkgName, email)
 	if err != nil {
 		writeInternalErr(w, err)
-		return
-	}
-
-	w.Write([]byte("uploader removed"))
+		return false
+	}
+	s.audit(r, unpub.AuditEvent{
+		Action:  action,
+		Actor:   identity,
+		Package: pkgName,
+		Before:  strings.Join(before, ","),
+		After:   strings.Join(after, ","),
+	})
+	return true
 }
 
 func (s *UnpubServiceImpl) GetPackages(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.authorizeRead(w, r)
+	if !ok {
+		return
+	}
 	params := r.URL.Query()
 	size, err := strconv.Atoi(params.Get("size"))
 	if err != nil {
@@ -540,16 +967,22 @@ func (s *UnpubServiceImpl) GetPackages(w http.ResponseWriter, r *http.Request) {
 		writeBadRequest(w, err)
 		return
 	}
-	sort := params.Get("sort")
-	if sort == "" {
-		sort = "download"
+	if size < 0 || page < 0 {
+		writeBadRequest(w, errors.New("size and page must not be negative"))
+		return
 	}
 	q := params.Get("q")
 
 	queryReq := unpub.UnpubDbQuery{
-		Size: size,
-		Page: page,
-		Sort: sort,
+		Size:           size,
+		Page:           page,
+		Sort:           params.Get("sort"),
+		IncludePrivate: c.admin,
+		Reader:         c.identity,
+	}
+	if c.claims != nil {
+		// Identity tokens read by trust policy alone, as in canRead.
+		queryReq.Reader, queryReq.Trusted = "", c.claims
 	}
 	if strings.HasPrefix(q, "email:") {
 		queryReq.Uploader = strings.TrimPrefix(q, "email:")
@@ -559,6 +992,19 @@ func (s *UnpubServiceImpl) GetPackages(w http.ResponseWriter, r *http.Request) {
 		queryReq.Keyword = q
 	}
 
+	switch queryReq.Sort {
+	case "":
+		// Keyword searches are ranked unless another order is requested.
+		queryReq.Sort = unpub.SortDownload
+		if queryReq.Keyword != "" {
+			queryReq.Sort = unpub.SortRelevance
+		}
+	case unpub.SortDownload, unpub.SortUpdated, unpub.SortCreated, unpub.SortName, unpub.SortRelevance:
+	default:
+		writeBadRequest(w, fmt.Errorf("unknown sort: %s", queryReq.Sort))
+		return
+	}
+
 	packages, err := s.DB.QueryPackages(queryReq)
 	if err != nil {
 		writeInternalErr(w, err)
@@ -566,7 +1012,9 @@ func (s *UnpubServiceImpl) GetPackages(w http.ResponseWriter, r *http.Request) {
 	}
 	var listApiPackages []unpub.ListApiPackage
 	for _, pkg := range packages.Packages {
-		listApiPackages = append(listApiPackages, pkg.ToListApiPackage())
+		listApiPackage := pkg.ToListApiPackage()
+		listApiPackage.Snippet = packages.Snippets[pkg.Name]
+		listApiPackages = append(listApiPackages, listApiPackage)
 	}
 	writeJSON(w, struct {
 		Data unpub.ListApi `json:"data"`
@@ -579,6 +1027,10 @@ func (s *UnpubServiceImpl) GetPackages(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *UnpubServiceImpl) GetPackageDetails(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.authorizeRead(w, r)
+	if !ok {
+		return
+	}
 	vars := mux.Vars(r)
 	pkgName, ok := vars["name"]
 	if !ok {
@@ -592,34 +1044,40 @@ func (s *UnpubServiceImpl) GetPackageDetails(w http.ResponseWriter, r *http.Requ
 	}
 
 	pkg, err := s.DB.QueryPackage(pkgName)
+	if err == nil {
+		if pkg.RemoveExpired(time.Now()); len(pkg.Versions) == 0 {
+			err = unpub.ErrNotFound
+		}
+	}
 	if err != nil {
-		if errors.Is(err, badger.ErrKeyNotFound) {
-			http.NotFound(w, r)
+		if errors.Is(err, unpub.ErrNotFound) {
+			writeNotFound(w, "package %s not found", pkgName)
 			return
 		}
 		writeInternalErr(w, err)
 		return
 	}
-	var v *unpub.UnpubVersion
+	if !c.canRead(&pkg) {
+		s.writeHidden(w, c, pkgName)
+		return
+	}
 	if version == "latest" {
-		latest := pkg.LatestVersion()
-		v = &latest
-	} else {
-		for _, _v := range pkg.Versions {
-			if semver.Compare(_v.Version, version) == 0 {
-				v = &_v
-			}
-		}
+		version = pkg.Latest
 	}
-	if v == nil {
-		http.NotFound(w, r)
+	if _, ok := pkg.Versions[version]; !ok {
+		writeNotFound(w, "%s %s not found", pkgName, version)
+		return
+	}
+	// The README and changelog are only loaded for the version shown.
+	v, err := s.DB.QueryVersion(pkgName, version)
+	if err != nil {
+		if errors.Is(err, unpub.ErrNotFound) {
+			writeNotFound(w, "%s %s not found", pkgName, version)
+			return
+		}
+		writeInternalErr(w, err)
 		return
 	}
-
-	versions := unpub.UnpubVersions(pkg.Versions)
-	sort.Slice(versions, func(i, j int) bool {
-		return semver.Compare(versions[i].Version, versions[j].Version) == -1
-	})
 
 	var detailViewVersions []unpub.DetailViewVersion
 
@@ -627,6 +1085,7 @@ func (s *UnpubServiceImpl) GetPackageDetails(w http.ResponseWriter, r *http.Requ
 		detailViewVersions = append(detailViewVersions, unpub.DetailViewVersion{
 			Version:   _v.Version,
 			CreatedAt: _v.CreatedAt,
+			Retracted: _v.Retracted,
 		})
 	}
 
@@ -645,6 +1104,24 @@ func (s *UnpubServiceImpl) GetPackageDetails(w http.ResponseWriter, r *http.Requ
 	for _, dep := range pubspec.Dependencies {
 		dependencies = append(dependencies, dep.Name)
 	}
+	advisories, err := s.DB.QueryAdvisories(pkg.Name)
+	if err != nil {
+		writeInternalErr(w, err)
+		return
+	}
+	detailViewAdvisories := []unpub.DetailViewAdvisory{}
+	for _, a := range advisories {
+		if a.Withdrawn != nil {
+			continue
+		}
+		detailViewAdvisories = append(detailViewAdvisories, unpub.DetailViewAdvisory{
+			ID:       a.ID,
+			Summary:  a.Summary,
+			Severity: a.Severity,
+			Aliases:  a.Aliases,
+			Affected: a.Affects(v.Version),
+		})
+	}
 	data := unpub.WebAPIDetailView{
 		Name:         pkg.Name,
 		Version:      v.Version,
@@ -658,6 +1135,8 @@ func (s *UnpubServiceImpl) GetPackageDetails(w http.ResponseWriter, r *http.Requ
 		Authors:      authors,
 		Dependencies: dependencies,
 		Tags:         []string{"flutter", "web", "other"},
+		Retracted:    v.Retracted,
+		Advisories:   detailViewAdvisories,
 	}
 
 	writeJSON(w, struct {
@@ -667,6 +1146,253 @@ func (s *UnpubServiceImpl) GetPackageDetails(w http.ResponseWriter, r *http.Requ
 	})
 }
 
+func (s *UnpubServiceImpl) GetPackageStats(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.authorizeRead(w, r)
+	if !ok {
+		return
+	}
+	pkgName, ok := mux.Vars(r)["name"]
+	if !ok {
+		writeBadRequest(w, nil)
+		return
+	}
+	days := 30
+	switch r.URL.Query().Get("days") {
+	case "", "30":
+	case "90":
+		days = 90
+	default:
+		writeBadRequest(w, errors.New("days must be 30 or 90"))
+		return
+	}
+
+	pkg, err := s.DB.QueryPackage(pkgName)
+	if err != nil {
+		if errors.Is(err, unpub.ErrNotFound) {
+			writeNotFound(w, "package %s not found", pkgName)
+			return
+		}
+		writeInternalErr(w, err)
+		return
+	}
+	if !c.canRead(&pkg) {
+		s.writeHidden(w, c, pkgName)
+		return
+	}
+	now := time.Now()
+	stats, err := s.DB.QueryDownloads(pkgName, now.AddDate(0, 0, 1-days))
+	if err != nil {
+		writeInternalErr(w, err)
+		return
+	}
+
+	writeJSON(w, struct {
+		Data unpub.WebAPIStatsView `json:"data"`
+	}{
+		Data: pkg.StatsView(stats, days, now),
+	})
+}
+
+// Backup streams a backup of the registry, taken while it keeps serving.
+func (s *UnpubServiceImpl) Backup(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authorize(w, r, unpub.ScopeAdmin); !ok {
+		return
+	}
+	filename := fmt.Sprintf("unpub-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	// Once streaming has started the status can no longer change, so a failed
+	// backup is only reported by the truncated archive.
+	if err := unpub.Backup(w, s.DB, s.Blobs); err != nil {
+		log.Printf("Error writing backup: %v\n", err)
+	}
+}
+
+// Restore loads a backup from the request body into the registry, which must
+// be empty.
+func (s *UnpubServiceImpl) Restore(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authorize(w, r, unpub.ScopeAdmin); !ok {
+		return
+	}
+	if err := unpub.Restore(r.Body, s.DB, s.Blobs); err != nil {
+		// Errors caused by the backup itself are typed as bad requests.
+		writeInternalErr(w, err)
+		return
+	}
+
+	writeJSON(w, struct {
+		Success interface{} `json:"success"`
+	}{
+		Success: struct {
+			Message string `json:"message"`
+		}{
+			Message: "Successfully restored backup",
+		},
+	})
+}
+
+// DeletePackage deletes a package with all of its versions. Its archives are
+// collected the next time the server starts.
+func (s *UnpubServiceImpl) DeletePackage(w http.ResponseWriter, r *http.Request) {
+	identity, ok := s.authorize(w, r, unpub.ScopeAdmin)
+	if !ok {
+		return
+	}
+	pkgName := mux.Vars(r)["name"]
+	pkg, err := s.DB.QueryPackage(pkgName)
+	if err == nil {
+		err = s.DB.DeletePackage(pkgName)
+	}
+	if err != nil {
+		if errors.Is(err, unpub.ErrNotFound) {
+			writeNotFound(w, "package %s not found", pkgName)
+			return
+		}
+		writeInternalErr(w, err)
+		return
+	}
+	versions := make([]string, 0, len(pkg.Versions))
+	for v := range pkg.Versions {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return unpub.CompareVersions(versions[i], versions[j]) == -1
+	})
+	s.audit(r, unpub.AuditEvent{
+		Action:  unpub.AuditDelete,
+		Actor:   identity,
+		Package: pkgName,
+		Before:  strings.Join(versions, ","),
+	})
+
+	writeJSON(w, struct {
+		Success interface{} `json:"success"`
+	}{
+		Success: struct {
+			Message string `json:"message"`
+		}{
+			Message: fmt.Sprintf("Deleted package %s", pkgName),
+		},
+	})
+}
+
+// DeleteVersion deletes a single version of a package. The only version of a
+// package cannot be deleted; the package must be deleted instead.
+func (s *UnpubServiceImpl) DeleteVersion(w http.ResponseWriter, r *http.Request) {
+	identity, ok := s.authorize(w, r, unpub.ScopeAdmin)
+	if !ok {
+		return
+	}
+	vars := mux.Vars(r)
+	pkgName, version := vars["name"], vars["version"]
+	var before, after string
+	var versionErr error
+	err := s.DB.UpdatePackage(pkgName, func(pkg *unpub.UnpubPackage, exists bool) error {
+		if !exists {
+			return unpub.ErrNotFound
+		}
+		before = pkg.Latest
+		versionErr = pkg.RemoveVersion(version)
+		after = pkg.Latest
+		return versionErr
+	})
+	if errors.Is(err, unpub.ErrNotFound) {
+		writeNotFound(w, "%s %s not found", pkgName, version)
+		return
+	}
+	if versionErr != nil {
+		writeBadRequest(w, versionErr)
+		return
+	}
+	if err != nil {
+		writeInternalErr(w, err)
+		return
+	}
+	s.audit(r, unpub.AuditEvent{
+		Action:  unpub.AuditDelete,
+		Actor:   identity,
+		Package: pkgName,
+		Version: version,
+		Before:  before,
+		After:   after,
+	})
+
+	writeJSON(w, struct {
+		Success interface{} `json:"success"`
+	}{
+		Success: struct {
+			Message string `json:"message"`
+		}{
+			Message: fmt.Sprintf("Deleted %s %s", pkgName, version),
+		},
+	})
+}
+
+// GetAudit returns a page of the audit log, newest first. Events can be
+// filtered by package, version, action, actor and time, and later pages are
+// fetched by passing the returned nextCursor as cursor.
+func (s *UnpubServiceImpl) GetAudit(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authorize(w, r, unpub.ScopeAdmin); !ok {
+		return
+	}
+	params := r.URL.Query()
+	query := unpub.AuditQuery{
+		Package: params.Get("package"),
+		Version: params.Get("version"),
+		Action:  params.Get("action"),
+		Actor:   params.Get("actor"),
+		Cursor:  params.Get("cursor"),
+	}
+	var err error
+	if since := params.Get("since"); since != "" {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			writeBadRequest(w, fmt.Errorf("bad since: %v", err))
+			return
+		}
+	}
+	if until := params.Get("until"); until != "" {
+		if query.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			writeBadRequest(w, fmt.Errorf("bad until: %v", err))
+			return
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit <= 0 {
+			writeBadRequest(w, errors.New("limit must be a positive number"))
+			return
+		}
+	}
+
+	result, err := s.DB.QueryAudit(query)
+	if err != nil {
+		writeInternalErr(w, err)
+		return
+	}
+	writeJSON(w, struct {
+		Data *unpub.AuditResult `json:"data"`
+	}{
+		Data: result,
+	})
+}
+
+// audit records a change made by a request. The change has already been
+// made, so failing to record it is only logged.
+func (s *UnpubServiceImpl) audit(r *http.Request, event unpub.AuditEvent) {
+	event.ClientIP = clientIP(r)
+	if err := s.DB.RecordAudit(event); err != nil {
+		log.Printf("Error recording audit event %s %s: %v\n", event.Action, event.Package, err)
+	}
+}
+
+// clientIP returns the address of the client that made r.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func writeJSON(w http.ResponseWriter, v interface{}) {
 	b, err := json.Marshal(v)
 	if err != nil {
@@ -678,18 +1404,85 @@ func writeJSON(w http.ResponseWriter, v interface{}) {
 	w.Write(b)
 }
 
+// errNotAcceptable is returned for requests which only accept an
+// unsupported version of the pub repository API.
+var errNotAcceptable = errors.New("not acceptable")
+
+// errorKinds maps the kinds of errors reported to clients to a status and
+// the code pub shows for them.
+var errorKinds = []struct {
+	kind   error
+	status int
+	code   string
+}{
+	{unpub.ErrNotFound, http.StatusNotFound, "NotFound"},
+	{unpub.ErrConflict, http.StatusConflict, "Conflict"},
+	{unpub.ErrUnauthorized, http.StatusUnauthorized, "MissingAuthentication"},
+	{unpub.ErrForbidden, http.StatusForbidden, "Forbidden"},
+	{unpub.ErrInvalidPubspec, http.StatusBadRequest, "InvalidPubspec"},
+	{unpub.ErrInvalidInput, http.StatusBadRequest, "InvalidInput"},
+	{errNotAcceptable, http.StatusNotAcceptable, "NotAcceptable"},
+}
+
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeError writes err in the format of the pub repository spec. Errors of
+// a kind in errorKinds get its status, and others status.
+func writeError(w http.ResponseWriter, status int, err error) {
+	body := errorBody{Code: "InvalidInput", Message: "bad request"}
+	if status == http.StatusInternalServerError {
+		body.Code = "InternalError"
+	}
+	if err == unpub.ErrNotFound {
+		// Rather than badger's "Key not found".
+		body.Message = "not found"
+	} else if err != nil {
+		body.Message = err.Error()
+	}
+	for _, e := range errorKinds {
+		if errors.Is(err, e.kind) {
+			status, body.Code = e.status, e.code
+			break
+		}
+	}
+	if status >= http.StatusInternalServerError {
+		log.Printf("internal server error: %v\n", err)
+	} else {
+		log.Printf("bad request: %v\n", err)
+	}
+	b, _ := json.Marshal(errorResponse{Error: body})
+	w.Header().Set("Content-Type", "application/vnd.pub.v2+json")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(b)))
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
 func writeInternalErr(w http.ResponseWriter, err error) {
-	log.Printf("internal server error: %v\n", err)
-	v := fmt.Sprintf("%v", err)
-	w.WriteHeader(http.StatusInternalServerError)
-	w.Write([]byte(v))
+	writeError(w, http.StatusInternalServerError, err)
 }
 
 func writeBadRequest(w http.ResponseWriter, err error) {
-	log.Printf("bad request: %v\n", err)
-	v := fmt.Sprintf("%v", err)
-	w.WriteHeader(http.StatusBadRequest)
-	w.Write([]byte(v))
+	writeError(w, http.StatusBadRequest, err)
+}
+
+func writeNotFound(w http.ResponseWriter, format string, args ...interface{}) {
+	writeError(w, http.StatusNotFound, unpub.NewError(unpub.ErrNotFound, format, args...))
+}
+
+func isUploader(pkg *unpub.UnpubPackage, email string) bool {
+	for _, uploader := range pkg.Uploaders {
+		if uploader == email {
+			return true
+		}
+	}
+	return false
 }
 
 func isPubClient(r *http.Request) bool {
@@ -0,0 +1,556 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dnys1/unpub"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownload(t *testing.T) {
+	require := require.New(t)
+	s := newDiskService(t)
+	r := mux.NewRouter()
+	SetupRoutes(r, s)
+
+	digest := digestOf(t, "archive")
+	pkg := newTestPackage(t, "my_pkg", "1.0.0")
+	v := pkg.Versions["1.0.0"]
+	v.ArchiveSHA256 = digest
+	pkg.Versions["1.0.0"] = v
+	require.NoError(s.publish("my_pkg", digest, strings.NewReader("archive"), createPackage(pkg)))
+
+	download := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/packages/my_pkg/versions/1.0.0.tar.gz", nil)
+		req.Header = header
+		req.Header.Set("User-Agent", "Dart pub 3.0.0")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := download(http.Header{})
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("archive", w.Body.String())
+	require.Equal("7", w.Header().Get("Content-Length"))
+	lastModified := w.Header().Get("Last-Modified")
+	require.NotEmpty(lastModified)
+
+	// An interrupted download resumes where it left off.
+	w = download(http.Header{"Range": {"bytes=3-"}})
+	require.Equal(http.StatusPartialContent, w.Code)
+	require.Equal("hive", w.Body.String())
+
+	w = download(http.Header{"If-Modified-Since": {lastModified}})
+	require.Equal(http.StatusNotModified, w.Code)
+
+	// Only the full download is counted.
+	stats, err := s.DB.QueryDownloads("my_pkg", time.Now())
+	require.NoError(err)
+	require.Equal(map[string]int{"1.0.0": 1}, stats.Versions)
+}
+
+func TestAdminDeleteAndAudit(t *testing.T) {
+	require := require.New(t)
+	const uploaderEmail = "test@example.com"
+	s := newDiskService(t)
+	s.UploaderEmail = uploaderEmail
+	r := mux.NewRouter()
+	SetupRoutes(r, s)
+
+	pkg := newTestPackage(t, "my_pkg", "1.0.0")
+	_, err := pkg.CreateVersion("1.1.0", "name: my_pkg\nversion: 1.1.0", nil, nil, nil)
+	require.NoError(err)
+	require.NoError(s.DB.SavePackage(pkg))
+
+	do := func(method, target string, body io.Reader) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, body)
+		if body != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do(http.MethodPost, "/api/packages/my_pkg/uploaders", strings.NewReader("email=other%40example.com"))
+	require.Equal(http.StatusOK, w.Code, w.Body.String())
+
+	w = do(http.MethodDelete, "/admin/packages/my_pkg/versions/1.1.0", nil)
+	require.Equal(http.StatusOK, w.Code, w.Body.String())
+	got, err := s.DB.QueryPackage("my_pkg")
+	require.NoError(err)
+	require.Equal("1.0.0", got.Latest)
+
+	w = do(http.MethodDelete, "/admin/packages/my_pkg/versions/1.0.0", nil)
+	require.Equal(http.StatusConflict, w.Code)
+	w = do(http.MethodDelete, "/admin/packages/my_pkg/versions/2.0.0", nil)
+	require.Equal(http.StatusNotFound, w.Code)
+
+	w = do(http.MethodDelete, "/admin/packages/my_pkg", nil)
+	require.Equal(http.StatusOK, w.Code, w.Body.String())
+	_, err = s.DB.QueryPackage("my_pkg")
+	require.ErrorIs(err, unpub.ErrNotFound)
+	w = do(http.MethodDelete, "/admin/packages/my_pkg", nil)
+	require.Equal(http.StatusNotFound, w.Code)
+
+	audit := func(query string) unpub.AuditResult {
+		w := do(http.MethodGet, "/admin/audit"+query, nil)
+		require.Equal(http.StatusOK, w.Code, w.Body.String())
+		var resp struct {
+			Data unpub.AuditResult `json:"data"`
+		}
+		require.NoError(json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.Data
+	}
+
+	result := audit("")
+	require.Len(result.Events, 3)
+	deleted, removed, added := result.Events[0], result.Events[1], result.Events[2]
+	require.Equal(unpub.AuditDelete, deleted.Action)
+	require.Empty(deleted.Version)
+	require.Equal("1.0.0", deleted.Before)
+	require.Equal(unpub.AuditDelete, removed.Action)
+	require.Equal("1.1.0", removed.Version)
+	require.Equal("1.1.0", removed.Before)
+	require.Equal("1.0.0", removed.After)
+	require.Equal(unpub.AuditAddUploader, added.Action)
+	require.Equal(uploaderEmail, added.Before)
+	require.Equal(uploaderEmail+",other@example.com", added.After)
+	for _, event := range result.Events {
+		require.Equal("my_pkg", event.Package)
+		require.Equal(uploaderEmail, event.Actor)
+		require.Equal("192.0.2.1", event.ClientIP)
+	}
+
+	result = audit("?action=delete&limit=1")
+	require.Equal([]unpub.AuditEvent{deleted}, result.Events)
+	result = audit("?action=delete&limit=1&cursor=" + result.NextCursor)
+	require.Equal([]unpub.AuditEvent{removed}, result.Events)
+	require.Empty(result.NextCursor)
+
+	w = do(http.MethodGet, "/admin/audit?since=yesterday", nil)
+	require.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestUploaders(t *testing.T) {
+	require := require.New(t)
+	s := newDiskService(t)
+	s.Auth = AuthWrite
+	r := mux.NewRouter()
+	SetupRoutes(r, s)
+
+	alice := saveToken(t, s, "alice@example.com", unpub.ScopePublish)
+	carol := saveToken(t, s, "carol@example.com", unpub.ScopePublish)
+	w := upload(t, withToken(r, alice), testArchive(t, "my_pkg", "1.0.0"), "")
+	require.Equal(http.StatusFound, w.Code, w.Body.String())
+
+	do := func(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	w = do(withToken(r, alice), http.MethodPost, "/api/packages/my_pkg/uploaders", "email=bob%40example.com")
+	require.Equal(http.StatusOK, w.Code, w.Body.String())
+
+	w = do(withToken(r, carol), http.MethodDelete, "/api/packages/my_pkg/uploaders/bob@example.com", "")
+	require.Equal(http.StatusForbidden, w.Code)
+	w = do(withToken(r, alice), http.MethodDelete, "/api/packages/my_pkg/uploaders/carol@example.com", "")
+	require.Equal(http.StatusBadRequest, w.Code)
+	w = do(withToken(r, alice), http.MethodDelete, "/api/packages/my_pkg/uploaders/bob@example.com", "")
+	require.Equal(http.StatusOK, w.Code, w.Body.String())
+	pkg, err := s.DB.QueryPackage("my_pkg")
+	require.NoError(err)
+	require.Equal([]string{"alice@example.com"}, pkg.Uploaders)
+
+	// The last uploader cannot be removed.
+	w = do(withToken(r, alice), http.MethodDelete, "/api/packages/my_pkg/uploaders/alice@example.com", "")
+	require.Equal(http.StatusBadRequest, w.Code)
+	w = do(withToken(r, alice), http.MethodDelete, "/api/packages/other_pkg/uploaders/alice@example.com", "")
+	require.Equal(http.StatusNotFound, w.Code)
+
+	audit, err := s.DB.QueryAudit(unpub.AuditQuery{Package: "my_pkg"})
+	require.NoError(err)
+	require.Len(audit.Events, 3)
+
+	// Of two uploaders removing each other at once, only one succeeds.
+	w = do(withToken(r, alice), http.MethodPost, "/api/packages/my_pkg/uploaders", "email=bob%40example.com")
+	require.Equal(http.StatusOK, w.Code, w.Body.String())
+	bob := saveToken(t, s, "bob@example.com", unpub.ScopePublish)
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i, remove := range [][2]string{{alice, "bob@example.com"}, {bob, "alice@example.com"}} {
+		i, remove := i, remove
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = do(withToken(r, remove[0]), http.MethodDelete, "/api/packages/my_pkg/uploaders/"+remove[1], "").Code
+		}()
+	}
+	wg.Wait()
+	// The other is refused, either as the last uploader or as no longer one.
+	require.Contains(codes, http.StatusOK)
+	require.NotEqual(codes[0], codes[1])
+	pkg, err = s.DB.QueryPackage("my_pkg")
+	require.NoError(err)
+	require.Len(pkg.Uploaders, 1)
+	removed := audit.Events[0]
+	require.Equal(unpub.AuditRemoveUploader, removed.Action)
+	require.Equal("alice@example.com", removed.Actor)
+	require.Equal("alice@example.com,bob@example.com", removed.Before)
+	require.Equal("alice@example.com", removed.After)
+	require.Equal(unpub.AuditAddUploader, audit.Events[1].Action)
+}
+
+func TestSetVersionOptions(t *testing.T) {
+	require := require.New(t)
+	s := newDiskService(t)
+	s.UploaderEmail = "test@example.com"
+	r := mux.NewRouter()
+	SetupRoutes(r, s)
+
+	pkg := newTestPackage(t, "my_pkg", "1.0.0")
+	_, err := pkg.CreateVersion("1.1.0", "name: my_pkg\nversion: 1.1.0", nil, nil, nil)
+	require.NoError(err)
+	old := pkg.Versions["1.0.0"]
+	old.CreatedAt = time.Now().Add(-unpub.RetractionWindow - time.Hour)
+	pkg.Versions["1.0.0"] = old
+	require.NoError(s.DB.SavePackage(pkg))
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+	versions := func() (latest string, retracted map[string]bool) {
+		w := do(http.MethodGet, "/api/packages/my_pkg", "")
+		require.Equal(http.StatusOK, w.Code)
+		var resp struct {
+			Latest   respVersion   `json:"latest"`
+			Versions []respVersion `json:"versions"`
+		}
+		require.NoError(json.Unmarshal(w.Body.Bytes(), &resp))
+		retracted = map[string]bool{}
+		for _, v := range resp.Versions {
+			retracted[v.Version] = v.Retracted
+		}
+		return resp.Latest.Version, retracted
+	}
+
+	w := do(http.MethodPost, "/api/packages/my_pkg/versions/1.1.0/options", `{"isRetracted": true}`)
+	require.Equal(http.StatusOK, w.Code, w.Body.String())
+	require.JSONEq(`{"isRetracted": true}`, w.Body.String())
+	latest, retracted := versions()
+	require.Equal("1.0.0", latest)
+	require.Equal(map[string]bool{"1.0.0": false, "1.1.0": true}, retracted)
+
+	w = do(http.MethodGet, "/webapi/package/my_pkg/1.1.0", "")
+	require.Equal(http.StatusOK, w.Code)
+	var details struct {
+		Data unpub.WebAPIDetailView `json:"data"`
+	}
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &details))
+	require.True(details.Data.Retracted)
+
+	w = do(http.MethodPut, "/api/packages/my_pkg/versions/1.1.0/options", `{"isRetracted": false}`)
+	require.Equal(http.StatusOK, w.Code, w.Body.String())
+	latest, retracted = versions()
+	require.Equal("1.1.0", latest)
+	require.False(retracted["1.1.0"])
+
+	// Versions outside the retraction window cannot be changed.
+	w = do(http.MethodPost, "/api/packages/my_pkg/versions/1.0.0/options", `{"isRetracted": true}`)
+	require.Equal(http.StatusForbidden, w.Code)
+	w = do(http.MethodPost, "/api/packages/my_pkg/versions/2.0.0/options", `{"isRetracted": true}`)
+	require.Equal(http.StatusNotFound, w.Code)
+
+	// Only uploaders can retract versions.
+	s.UploaderEmail = "other@example.com"
+	w = do(http.MethodPost, "/api/packages/my_pkg/versions/1.1.0/options", `{"isRetracted": true}`)
+	require.Equal(http.StatusForbidden, w.Code)
+
+	audit, err := s.DB.QueryAudit(unpub.AuditQuery{Package: "my_pkg"})
+	require.NoError(err)
+	require.Len(audit.Events, 2)
+	require.Equal(unpub.AuditUnretract, audit.Events[0].Action)
+	require.Equal(unpub.AuditRetract, audit.Events[1].Action)
+	require.Equal("1.1.0", audit.Events[1].Before)
+	require.Equal("1.0.0", audit.Events[1].After)
+}
+
+func TestPackageOptions(t *testing.T) {
+	require := require.New(t)
+	s := newDiskService(t)
+	s.UploaderEmail = "test@example.com"
+	r := mux.NewRouter()
+	SetupRoutes(r, s)
+	require.NoError(s.DB.SavePackage(newTestPackage(t, "old_pkg", "1.0.0")))
+	require.NoError(s.DB.SavePackage(newTestPackage(t, "new_pkg", "1.0.0")))
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	w := do(http.MethodGet, "/api/packages/old_pkg/options", "")
+	require.Equal(http.StatusOK, w.Code)
+	require.JSONEq(`{"isDiscontinued": false, "isUnlisted": false}`, w.Body.String())
+
+	w = do(http.MethodPut, "/api/packages/old_pkg/options", `{"replacedBy": "new_pkg"}`)
+	require.Equal(http.StatusBadRequest, w.Code)
+	w = do(http.MethodPut, "/api/packages/old_pkg/options", `{"isDiscontinued": true, "replacedBy": "missing"}`)
+	require.Equal(http.StatusBadRequest, w.Code)
+
+	w = do(http.MethodPut, "/api/packages/old_pkg/options", `{"isDiscontinued": true, "replacedBy": "new_pkg"}`)
+	require.Equal(http.StatusOK, w.Code, w.Body.String())
+	require.JSONEq(`{"isDiscontinued": true, "replacedBy": "new_pkg", "isUnlisted": false}`, w.Body.String())
+	w = do(http.MethodPut, "/api/packages/old_pkg/options", `{"isUnlisted": true}`)
+	require.Equal(http.StatusOK, w.Code, w.Body.String())
+	require.JSONEq(`{"isDiscontinued": true, "replacedBy": "new_pkg", "isUnlisted": true}`, w.Body.String())
+
+	// pub warns about discontinued packages, which stay resolvable when
+	// unlisted.
+	w = do(http.MethodGet, "/api/packages/old_pkg", "")
+	require.Equal(http.StatusOK, w.Code)
+	var versions struct {
+		IsDiscontinued bool   `json:"isDiscontinued"`
+		ReplacedBy     string `json:"replacedBy"`
+	}
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &versions))
+	require.True(versions.IsDiscontinued)
+	require.Equal("new_pkg", versions.ReplacedBy)
+
+	w = do(http.MethodGet, "/webapi/packages?size=10&page=0", "")
+	require.Equal(http.StatusOK, w.Code)
+	require.NotContains(w.Body.String(), "old_pkg")
+
+	// Restoring a package stops it being replaced.
+	w = do(http.MethodPut, "/api/packages/old_pkg/options", `{"isDiscontinued": false}`)
+	require.Equal(http.StatusOK, w.Code, w.Body.String())
+	require.JSONEq(`{"isDiscontinued": false, "isUnlisted": true}`, w.Body.String())
+
+	s.UploaderEmail = "other@example.com"
+	w = do(http.MethodPut, "/api/packages/old_pkg/options", `{"isUnlisted": false}`)
+	require.Equal(http.StatusForbidden, w.Code)
+
+	audit, err := s.DB.QueryAudit(unpub.AuditQuery{Action: unpub.AuditOptions})
+	require.NoError(err)
+	require.Len(audit.Events, 3)
+	require.Equal("discontinued,replacedBy=new_pkg", audit.Events[1].Before)
+	require.Equal("discontinued,replacedBy=new_pkg,unlisted", audit.Events[1].After)
+}
+
+func TestErrorResponses(t *testing.T) {
+	s := newDiskService(t)
+	s.UploaderEmail = "test@example.com"
+	r := mux.NewRouter()
+	SetupRoutes(r, s)
+	require.NoError(t, s.DB.SavePackage(newTestPackage(t, "my_pkg", "1.0.0")))
+
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		accept  string
+		body    string
+		status  int
+		code    string
+		message string
+	}{
+		{
+			name:    "not found",
+			method:  http.MethodGet,
+			target:  "/api/packages/my_pkg/versions/2.0.0",
+			status:  http.StatusNotFound,
+			code:    "NotFound",
+			message: "my_pkg 2.0.0 not found",
+		},
+		{
+			name:    "conflict",
+			method:  http.MethodPost,
+			target:  "/api/packages/my_pkg/uploaders",
+			body:    "email=test@example.com",
+			status:  http.StatusConflict,
+			code:    "Conflict",
+			message: "uploader already exists",
+		},
+		{
+			name:    "invalid input",
+			method:  http.MethodPut,
+			target:  "/api/packages/my_pkg/options",
+			body:    `{"replacedBy": "my_pkg"}`,
+			status:  http.StatusBadRequest,
+			code:    "InvalidInput",
+			message: "a package cannot replace itself",
+		},
+		{
+			name:    "unsupported version",
+			method:  http.MethodGet,
+			target:  "/api/packages/my_pkg",
+			accept:  "application/vnd.pub.v3+json",
+			status:  http.StatusNotAcceptable,
+			code:    "NotAcceptable",
+			message: "not acceptable: unsupported API version application/vnd.pub.v3+json, only application/vnd.pub.v2+json is served",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			require := require.New(t)
+			req := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			if strings.HasPrefix(tc.body, "email=") {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			require.Equal(tc.status, w.Code, w.Body.String())
+			require.Equal("application/vnd.pub.v2+json", w.Header().Get("Content-Type"))
+			var resp struct {
+				Error struct {
+					Code    string `json:"code"`
+					Message string `json:"message"`
+				} `json:"error"`
+			}
+			require.NoError(json.Unmarshal(w.Body.Bytes(), &resp))
+			require.Equal(tc.code, resp.Error.Code)
+			require.Equal(tc.message, resp.Error.Message)
+		})
+	}
+
+	t.Run("accepted versions", func(t *testing.T) {
+		require := require.New(t)
+		for _, accept := range []string{
+			"",
+			"application/json",
+			"application/vnd.pub.v2+json",
+			"application/vnd.pub.v3+json, application/vnd.pub.v2+json;q=0.5",
+		} {
+			req := httptest.NewRequest(http.MethodGet, "/api/packages/my_pkg", nil)
+			req.Header.Set("Accept", accept)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			require.Equal(http.StatusOK, w.Code, accept)
+		}
+	})
+}
+
+func TestGetPackageNames(t *testing.T) {
+	require := require.New(t)
+	s := newDiskService(t)
+	r := mux.NewRouter()
+	SetupRoutes(r, s)
+	require.NoError(s.DB.SavePackage(newTestPackage(t, "my_pkg", "1.0.0")))
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/package-names", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("")
+	require.Equal(http.StatusOK, w.Code)
+	require.JSONEq(`{"packages": ["my_pkg"]}`, w.Body.String())
+	etag := w.Header().Get("ETag")
+	require.NotEmpty(etag)
+
+	w = get(etag)
+	require.Equal(http.StatusNotModified, w.Code)
+	require.Empty(w.Body.String())
+	w = get(`"other", W/` + etag)
+	require.Equal(http.StatusNotModified, w.Code)
+
+	// The ETag changes with the list.
+	require.NoError(s.DB.SavePackage(newTestPackage(t, "new_pkg", "1.0.0")))
+	w = get(etag)
+	require.Equal(http.StatusOK, w.Code)
+	require.JSONEq(`{"packages": ["my_pkg", "new_pkg"]}`, w.Body.String())
+	require.NotEqual(etag, w.Header().Get("ETag"))
+}
+
+func TestUploadOlderVersion(t *testing.T) {
+	require := require.New(t)
+	s := newDiskService(t)
+	s.UploaderEmail = "test@example.com"
+	r := mux.NewRouter()
+	SetupRoutes(r, s)
+
+	for _, version := range []string{"1.0.0", "2.0.0", "1.4.3", "3.0.0-dev.1", "2.0.0+1"} {
+		w := upload(t, r, testArchive(t, "my_pkg", version), "")
+		require.Equal(http.StatusFound, w.Code, w.Body.String())
+	}
+	w := upload(t, r, testArchive(t, "my_pkg", "1.4.3"), "")
+	require.Equal(http.StatusConflict, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/packages/my_pkg", nil))
+	require.Equal(http.StatusOK, w.Code)
+	var resp struct {
+		Latest   respVersion   `json:"latest"`
+		Versions []respVersion `json:"versions"`
+	}
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Equal("2.0.0+1", resp.Latest.Version)
+	var versions []string
+	for _, v := range resp.Versions {
+		versions = append(versions, v.Version)
+	}
+	require.Equal([]string{"1.0.0", "1.4.3", "2.0.0", "2.0.0+1", "3.0.0-dev.1"}, versions)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/webapi/package/my_pkg/latest", nil))
+	require.Equal(http.StatusOK, w.Code)
+	var details struct {
+		Data unpub.WebAPIDetailView `json:"data"`
+	}
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &details))
+	require.Equal("2.0.0+1", details.Data.Version)
+}
+
+func TestUploadInvalidVersion(t *testing.T) {
+	require := require.New(t)
+	s := newDiskService(t)
+	s.UploaderEmail = "test@example.com"
+	r := mux.NewRouter()
+	SetupRoutes(r, s)
+
+	w := upload(t, r, testArchive(t, "my_pkg", "1.0.0-dev.1"), "")
+	require.Equal(http.StatusFound, w.Code, w.Body.String())
+	// Short versions would otherwise be taken as stable, and become latest.
+	for _, version := range []string{"1", "1.0", "v2.0.0", "2.0.0.1"} {
+		w = upload(t, r, testArchive(t, "my_pkg", version), "")
+		require.Equal(http.StatusBadRequest, w.Code, version)
+		var resp struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		require.NoError(json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Equal("InvalidPubspec", resp.Error.Code)
+		require.Contains(resp.Error.Message, "MAJOR.MINOR.PATCH")
+	}
+
+	pkg, err := s.DB.QueryPackage("my_pkg")
+	require.NoError(err)
+	require.Equal("1.0.0-dev.1", pkg.Latest)
+	require.Len(pkg.Versions, 1)
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/dnys1/unpub"
+	"github.com/gorilla/mux"
+)
+
+// trustPolicies is the body of the trust policy endpoints.
+type trustPolicies struct {
+	TrustPolicies []unpub.TrustPolicy `json:"trustPolicies"`
+}
+
+func summarizeTrustPolicies(policies []unpub.TrustPolicy) string {
+	summaries := []string{}
+	for _, p := range policies {
+		summaries = append(summaries, p.String())
+	}
+	return strings.Join(summaries, " ")
+}
+
+// GetTrustPolicies lists the policies letting identity tokens publish a
+// package.
+func (s *UnpubServiceImpl) GetTrustPolicies(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.authorizeRead(w, r)
+	if !ok {
+		return
+	}
+	pkgName := mux.Vars(r)["name"]
+	pkg, err := s.DB.QueryPackage(pkgName)
+	if err != nil {
+		if errors.Is(err, unpub.ErrNotFound) {
+			writeNotFound(w, "package %s not found", pkgName)
+			return
+		}
+		writeInternalErr(w, err)
+		return
+	}
+	if !c.canRead(&pkg) {
+		s.writeHidden(w, c, pkgName)
+		return
+	}
+	writeJSON(w, trustPolicies{TrustPolicies: append([]unpub.TrustPolicy{}, pkg.TrustPolicies...)})
+}
+
+// SetTrustPolicies replaces the trust policies of a package. Only uploaders
+// can change them, and only to trust configured issuers.
+func (s *UnpubServiceImpl) SetTrustPolicies(w http.ResponseWriter, r *http.Request) {
+	identity, ok := s.authorize(w, r, unpub.ScopePublish)
+	if !ok {
+		return
+	}
+	pkgName := mux.Vars(r)["name"]
+	var body trustPolicies
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeBadRequest(w, fmt.Errorf("bad trust policies: %v", err))
+		return
+	}
+	for _, policy := range body.TrustPolicies {
+		if err := policy.Validate(); err != nil {
+			writeBadRequest(w, err)
+			return
+		}
+		if !s.OIDC.HasIssuer(policy.Issuer) {
+			writeBadRequest(w, unpub.NewError(unpub.ErrInvalidInput, "issuer %s is not configured", policy.Issuer))
+			return
+		}
+	}
+
+	var before string
+	var policyErr error
+	err := s.DB.UpdatePackage(pkgName, func(pkg *unpub.UnpubPackage, exists bool) error {
+		if !exists {
+			return unpub.ErrNotFound
+		}
+		if !isUploader(pkg, identity) {
+			policyErr = unpub.NewError(unpub.ErrForbidden, "no permission")
+			return policyErr
+		}
+		before = summarizeTrustPolicies(pkg.TrustPolicies)
+		pkg.TrustPolicies = body.TrustPolicies
+		return nil
+	})
+	if errors.Is(err, unpub.ErrNotFound) {
+		writeNotFound(w, "package %s not found", pkgName)
+		return
+	}
+	if policyErr != nil {
+		writeBadRequest(w, policyErr)
+		return
+	}
+	if err != nil {
+		writeInternalErr(w, err)
+		return
+	}
+	if after := summarizeTrustPolicies(body.TrustPolicies); before != after {
+		s.audit(r, unpub.AuditEvent{
+			Action:  unpub.AuditTrust,
+			Actor:   identity,
+			Package: pkgName,
+			Before:  before,
+			After:   after,
+		})
+	}
+
+	writeJSON(w, trustPolicies{TrustPolicies: append([]unpub.TrustPolicy{}, body.TrustPolicies...)})
+}
@@ -0,0 +1,1225 @@
+package unpub
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqlSchema = `
+CREATE TABLE IF NOT EXISTS packages (
+	name       TEXT    PRIMARY KEY,
+	latest     TEXT    NOT NULL,
+	private    INTEGER NOT NULL DEFAULT 0,
+	downloads  INTEGER NOT NULL DEFAULT 0,
+	created_at INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS versions (
+	package      TEXT    NOT NULL REFERENCES packages (name) ON DELETE CASCADE,
+	version      TEXT    NOT NULL,
+	pubspec_yaml TEXT    NOT NULL,
+	uploader     TEXT,
+	readme       TEXT,
+	changelog    TEXT,
+	created_at   INTEGER NOT NULL,
+	updated_at   INTEGER NOT NULL,
+	PRIMARY KEY (package, version)
+);
+
+CREATE TABLE IF NOT EXISTS uploaders (
+	package TEXT NOT NULL REFERENCES packages (name) ON DELETE CASCADE,
+	email   TEXT NOT NULL,
+	PRIMARY KEY (package, email)
+);
+
+CREATE TABLE IF NOT EXISTS dependencies (
+	package    TEXT NOT NULL REFERENCES packages (name) ON DELETE CASCADE,
+	dependency TEXT NOT NULL,
+	PRIMARY KEY (package, dependency)
+);
+
+CREATE INDEX IF NOT EXISTS packages_downloads ON packages (downloads DESC, name);
+CREATE INDEX IF NOT EXISTS packages_updated_at ON packages (updated_at DESC, name);
+CREATE INDEX IF NOT EXISTS packages_created_at ON packages (created_at DESC, name);
+CREATE INDEX IF NOT EXISTS uploaders_email ON uploaders (email);
+CREATE INDEX IF NOT EXISTS dependencies_dependency ON dependencies (dependency);
+
+CREATE TABLE IF NOT EXISTS search_docs (
+	package  TEXT NOT NULL PRIMARY KEY REFERENCES packages (name) ON DELETE CASCADE,
+	version  TEXT NOT NULL,
+	document BLOB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS search_terms (
+	term    TEXT NOT NULL,
+	package TEXT NOT NULL REFERENCES packages (name) ON DELETE CASCADE,
+	weight  REAL NOT NULL,
+	PRIMARY KEY (term, package)
+);
+
+CREATE TABLE IF NOT EXISTS downloads (
+	package TEXT    NOT NULL REFERENCES packages (name) ON DELETE CASCADE,
+	version TEXT    NOT NULL,
+	day     TEXT    NOT NULL,
+	count   INTEGER NOT NULL,
+	PRIMARY KEY (package, day, version)
+);
+
+CREATE TABLE IF NOT EXISTS archives (
+	package TEXT NOT NULL,
+	version TEXT NOT NULL,
+	data    BLOB NOT NULL,
+	PRIMARY KEY (package, version)
+);
+`
+
+// sqlMigrations holds the statements which upgrade the schema to each version,
+// tracked by PRAGMA user_version. The first creates the initial schema, which
+// databases from before the migrations already have.
+var sqlMigrations = []string{
+	sqlSchema,
+	`
+ALTER TABLE versions ADD COLUMN archive_sha256 TEXT;
+
+DROP TABLE archives;
+
+CREATE TABLE blobs (
+	digest TEXT NOT NULL PRIMARY KEY,
+	data   BLOB NOT NULL
+);
+`,
+	// Archives moved to a BlobStore.
+	`DROP TABLE blobs;`,
+	`
+CREATE TABLE audit_events (
+	id             TEXT    NOT NULL PRIMARY KEY,
+	time           INTEGER NOT NULL,
+	action         TEXT    NOT NULL,
+	actor          TEXT    NOT NULL,
+	client_ip      TEXT    NOT NULL,
+	package        TEXT    NOT NULL,
+	version        TEXT    NOT NULL,
+	before_summary TEXT    NOT NULL,
+	after_summary  TEXT    NOT NULL
+);
+
+CREATE INDEX audit_events_package ON audit_events (package, id);
+`,
+	`
+ALTER TABLE versions ADD COLUMN expires_at INTEGER;
+
+CREATE INDEX versions_expires_at ON versions (expires_at) WHERE expires_at IS NOT NULL;
+`,
+	`ALTER TABLE versions ADD COLUMN retracted INTEGER NOT NULL DEFAULT 0;`,
+	`
+ALTER TABLE packages ADD COLUMN discontinued INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE packages ADD COLUMN replaced_by TEXT;
+ALTER TABLE packages ADD COLUMN unlisted INTEGER NOT NULL DEFAULT 0;
+`,
+	// Advisories are only read whole, so they are stored as JSON.
+	`
+CREATE TABLE advisories (
+	package  TEXT NOT NULL,
+	id       TEXT NOT NULL,
+	advisory TEXT NOT NULL,
+	PRIMARY KEY (package, id)
+);
+`,
+	// Latest versions are chosen again by sqlDataMigrations.
+	``,
+	`
+CREATE TABLE tokens (
+	id          TEXT    NOT NULL PRIMARY KEY,
+	hash        TEXT    NOT NULL,
+	identity    TEXT    NOT NULL,
+	scopes      TEXT    NOT NULL,
+	description TEXT    NOT NULL,
+	created_at  INTEGER NOT NULL,
+	expires_at  INTEGER
+);
+`,
+	// Trust policies are only read whole, so they are stored as JSON.
+	`ALTER TABLE packages ADD COLUMN trust_policies TEXT;`,
+	`
+CREATE TABLE readers (
+	package TEXT NOT NULL REFERENCES packages (name) ON DELETE CASCADE,
+	email   TEXT NOT NULL,
+	PRIMARY KEY (package, email)
+);
+
+CREATE INDEX readers_email ON readers (email);
+`,
+}
+
+// sqlDataMigrations run in Go after the statements of the schema version they
+// are keyed by, in the same transaction, for changes SQL cannot express.
+var sqlDataMigrations = map[int]func(tx *sql.Tx) error{
+	9: migrateLatestSQL,
+}
+
+// UnpubSQLDb is an UnpubDb backed by a SQLite database file.
+type UnpubSQLDb struct {
+	InMemory bool
+	Path     string
+	db       *sql.DB
+}
+
+func NewUnpubSQLDb(inMem bool, path string) (*UnpubSQLDb, error) {
+	var dbPath, dsn string
+	if inMem {
+		dsn = "file::memory:"
+	} else {
+		dbPath = filepath.Join(path, "unpub.db")
+		dsn = "file:" + dbPath
+	}
+	dsn += "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)"
+	sqlDb, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer, and an in-memory database only lives as
+	// long as its connection, so all access goes through one connection.
+	sqlDb.SetMaxOpenConns(1)
+	sqlDb.SetMaxIdleConns(1)
+	if err := migrateSQL(sqlDb); err != nil {
+		sqlDb.Close()
+		return nil, err
+	}
+	dbLoc := dbPath
+	if inMem {
+		dbLoc = "memory"
+	}
+	log.Printf("Opened SQLite DB at: %s", dbLoc)
+	return &UnpubSQLDb{
+		InMemory: inMem,
+		Path:     dbPath,
+		db:       sqlDb,
+	}, nil
+}
+
+// migrateSQL applies the pending sqlMigrations, each in its own transaction.
+func migrateSQL(db *sql.DB) error {
+	var current int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&current); err != nil {
+		return err
+	}
+	for version := current + 1; version <= len(sqlMigrations); version++ {
+		log.Printf("Running SQLite migration %d", version)
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if statements := sqlMigrations[version-1]; statements != "" {
+			_, err = tx.Exec(statements)
+		}
+		if migrate := sqlDataMigrations[version]; err == nil && migrate != nil {
+			err = migrate(tx)
+		}
+		if err == nil {
+			// PRAGMA does not accept parameters.
+			_, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version))
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("SQLite migration %d: %v", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateLatestSQL chooses the latest version of every package again, since
+// it used to be the last version uploaded even when that was a prerelease.
+func migrateLatestSQL(tx *sql.Tx) error {
+	names, err := queryStringsSQL(tx, `SELECT name FROM packages ORDER BY name`)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		pkg, err := queryPackageSQL(tx, name)
+		if err != nil {
+			return err
+		}
+		latest := pkg.Latest
+		if pkg.updateLatest(); pkg.Latest == latest {
+			continue
+		}
+		if err := savePackageSQL(tx, pkg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *UnpubSQLDb) Close() error {
+	return db.db.Close()
+}
+
+// sqlQuerier is the subset of methods shared by *sql.DB and *sql.Tx.
+type sqlQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixMilli()
+}
+
+func fromMillis(ms int64) time.Time {
+	return time.UnixMilli(ms)
+}
+
+// toNullMillis stores a nil time as NULL.
+func toNullMillis(t *time.Time) sql.NullInt64 {
+	if t == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: toMillis(*t), Valid: true}
+}
+
+func fromNullMillis(ms sql.NullInt64) *time.Time {
+	if !ms.Valid {
+		return nil
+	}
+	t := fromMillis(ms.Int64)
+	return &t
+}
+
+func (db *UnpubSQLDb) QueryPackage(name string) (UnpubPackage, error) {
+	return queryPackageSQL(db.db, name)
+}
+
+func queryPackageSQL(q sqlQuerier, name string) (pkg UnpubPackage, err error) {
+	var createdAt, updatedAt int64
+	var replacedBy, trustPolicies sql.NullString
+	err = q.QueryRow(
+		`SELECT name, latest, private, downloads, created_at, updated_at, discontinued, replaced_by, unlisted,
+			trust_policies
+		FROM packages WHERE name = ?`,
+		name,
+	).Scan(
+		&pkg.Name, &pkg.Latest, &pkg.Private, &pkg.Downloads, &createdAt, &updatedAt,
+		&pkg.IsDiscontinued, &replacedBy, &pkg.IsUnlisted, &trustPolicies,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return
+	}
+	pkg.CreatedAt = fromMillis(createdAt)
+	pkg.UpdatedAt = fromMillis(updatedAt)
+	pkg.ReplacedBy = replacedBy.String
+	if trustPolicies.Valid {
+		if err = json.Unmarshal([]byte(trustPolicies.String), &pkg.TrustPolicies); err != nil {
+			return
+		}
+	}
+
+	pkg.Versions = make(map[string]UnpubVersion)
+	rows, err := q.Query(
+		`SELECT version, pubspec_yaml, uploader, archive_sha256, expires_at, retracted, created_at, updated_at
+		FROM versions WHERE package = ?`,
+		name,
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v UnpubVersion
+		var uploader, digest sql.NullString
+		var expiresAt sql.NullInt64
+		err = rows.Scan(&v.Version, &v.PubspecYAML, &uploader, &digest, &expiresAt, &v.Retracted, &createdAt, &updatedAt)
+		if err != nil {
+			return
+		}
+		v.Uploader = fromNullString(uploader)
+		v.ArchiveSHA256 = digest.String
+		v.ExpiresAt = fromNullMillis(expiresAt)
+		v.CreatedAt = fromMillis(createdAt)
+		v.UpdatedAt = fromMillis(updatedAt)
+		pkg.Versions[v.Version] = v
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	pkg.Uploaders, err = queryUploadersSQL(q, name)
+	if err != nil {
+		return
+	}
+	pkg.Readers, err = queryStringsSQL(q, `SELECT email FROM readers WHERE package = ? ORDER BY rowid`, name)
+	return
+}
+
+func (db *UnpubSQLDb) QueryVersion(name, version string) (v UnpubVersion, err error) {
+	var uploader, readme, changelog, digest sql.NullString
+	var expiresAt sql.NullInt64
+	var createdAt, updatedAt int64
+	err = db.db.QueryRow(
+		`SELECT version, pubspec_yaml, uploader, readme, changelog, archive_sha256, expires_at, retracted,
+			created_at, updated_at
+		FROM versions WHERE package = ? AND version = ?`,
+		name, version,
+	).Scan(
+		&v.Version, &v.PubspecYAML, &uploader, &readme, &changelog, &digest, &expiresAt, &v.Retracted,
+		&createdAt, &updatedAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return
+	}
+	v.Uploader = fromNullString(uploader)
+	v.Readme = fromNullString(readme)
+	v.Changelog = fromNullString(changelog)
+	v.ArchiveSHA256 = digest.String
+	v.ExpiresAt = fromNullMillis(expiresAt)
+	v.CreatedAt = fromMillis(createdAt)
+	v.UpdatedAt = fromMillis(updatedAt)
+	return
+}
+
+// ExportPackages reads every package in one transaction before calling fn, so
+// that the single connection is not held while fn runs.
+func (db *UnpubSQLDb) ExportPackages(fn func(pkg UnpubPackage) error) error {
+	var packages []UnpubPackage
+	err := db.withTx(func(tx *sql.Tx) error {
+		names, err := queryStringsSQL(tx, `SELECT name FROM packages ORDER BY name`)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			pkg, err := queryPackageSQL(tx, name)
+			if err != nil {
+				return err
+			}
+			if err := queryVersionDocsSQL(tx, pkg); err != nil {
+				return err
+			}
+			packages = append(packages, pkg)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, pkg := range packages {
+		if err := fn(pkg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryVersionDocsSQL loads the READMEs and changelogs of the versions of pkg.
+func queryVersionDocsSQL(q sqlQuerier, pkg UnpubPackage) error {
+	rows, err := q.Query(`SELECT version, readme, changelog FROM versions WHERE package = ?`, pkg.Name)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version string
+		var readme, changelog sql.NullString
+		if err := rows.Scan(&version, &readme, &changelog); err != nil {
+			return err
+		}
+		v := pkg.Versions[version]
+		v.Readme = fromNullString(readme)
+		v.Changelog = fromNullString(changelog)
+		pkg.Versions[version] = v
+	}
+	return rows.Err()
+}
+
+func queryUploadersSQL(q sqlQuerier, name string) ([]string, error) {
+	return queryStringsSQL(q, `SELECT email FROM uploaders WHERE package = ? ORDER BY rowid`, name)
+}
+
+// sqlSortOrders maps each supported sort to its ORDER BY clause. Parameter ?1
+// is a JSON array of search hits, best first, or NULL without a keyword.
+var sqlSortOrders = map[string]string{
+	SortDownload:  "downloads DESC, name",
+	SortUpdated:   "updated_at DESC, name",
+	SortCreated:   "created_at DESC, name",
+	SortName:      "name",
+	SortRelevance: "(SELECT key FROM json_each(?1) WHERE value = name), downloads DESC, name",
+}
+
+// queryTrustingPackagesSQL returns the names of the private packages with a
+// trust policy matching claims. Policies are matched like file paths, which
+// SQLite cannot do, so only the packages which have any are loaded.
+func queryTrustingPackagesSQL(q sqlQuerier, claims IdentityClaims) ([]string, error) {
+	rows, err := q.Query(`SELECT name, trust_policies FROM packages WHERE private AND trust_policies IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := []string{}
+	for rows.Next() {
+		var pkg UnpubPackage
+		var policies string
+		if err := rows.Scan(&pkg.Name, &policies); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(policies), &pkg.TrustPolicies); err != nil {
+			return nil, err
+		}
+		if pkg.Trusts(claims) {
+			names = append(names, pkg.Name)
+		}
+	}
+	return names, rows.Err()
+}
+
+// QueryPackages runs every query in one transaction, so the count agrees
+// with the page, and packages deleted meanwhile cannot fail the listing.
+func (db *UnpubSQLDb) QueryPackages(query UnpubDbQuery) (*UnpubQueryResult, error) {
+	var result *UnpubQueryResult
+	err := db.withTx(func(tx *sql.Tx) error {
+		var err error
+		result, err = queryPackagesSQL(tx, query)
+		return err
+	})
+	return result, err
+}
+
+func queryPackagesSQL(q sqlQuerier, query UnpubDbQuery) (*UnpubQueryResult, error) {
+	sortBy := query.Sort
+	if sortBy == "" {
+		sortBy = SortDownload
+	}
+	order, ok := sqlSortOrders[sortBy]
+	if !ok {
+		return nil, fmt.Errorf("unknown sort: %s", query.Sort)
+	}
+
+	var hits interface{}
+	terms := queryTerms(query.Keyword)
+	if query.Keyword != "" {
+		ranked, err := searchPackagesSQL(q, query.Keyword, terms)
+		if err != nil {
+			return nil, err
+		}
+		names := []string{}
+		for _, hit := range ranked {
+			names = append(names, hit.Package)
+		}
+		b, err := json.Marshal(names)
+		if err != nil {
+			return nil, err
+		}
+		hits = string(b)
+	}
+
+	trusted := "[]"
+	if query.Trusted != nil && !query.IncludePrivate {
+		names, err := queryTrustingPackagesSQL(q, *query.Trusted)
+		if err != nil {
+			return nil, err
+		}
+		b, err := json.Marshal(names)
+		if err != nil {
+			return nil, err
+		}
+		trusted = string(b)
+	}
+
+	const where = `WHERE (?1 IS NULL OR name IN (SELECT value FROM json_each(?1)))
+		AND (?2 = '' OR name IN (SELECT package FROM uploaders WHERE email = ?2))
+		AND (?3 = '' OR name IN (SELECT package FROM dependencies WHERE dependency = ?3))
+		AND (?4 OR NOT unlisted)
+		AND (?5 OR NOT private
+			OR name IN (SELECT package FROM uploaders WHERE email = ?6)
+			OR name IN (SELECT package FROM readers WHERE email = ?6)
+			OR name IN (SELECT value FROM json_each(?7)))`
+	args := []interface{}{hits, query.Uploader, query.Dependency, query.IncludeUnlisted, query.IncludePrivate, query.Reader, trusted}
+
+	var count int
+	if err := q.QueryRow(`SELECT count(*) FROM packages `+where, args...).Scan(&count); err != nil {
+		return nil, err
+	}
+
+	limit, offset := -1, 0
+	if query.Size > 0 {
+		limit, offset = query.Size, query.Page*query.Size
+	}
+	names, err := queryStringsSQL(
+		q,
+		`SELECT name FROM packages `+where+` ORDER BY `+order+` LIMIT ?8 OFFSET ?9`,
+		append(args, limit, offset)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var packages []*UnpubPackage
+	snippets := make(map[string]string)
+	for _, name := range names {
+		pkg, err := queryPackageSQL(q, name)
+		if err != nil {
+			return nil, err
+		}
+		packages = append(packages, &pkg)
+		if len(terms) == 0 {
+			continue
+		}
+		doc, err := querySearchDocumentSQL(q, name)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		if snippet := doc.snippet(terms); snippet != "" {
+			snippets[name] = snippet
+		}
+	}
+	return &UnpubQueryResult{
+		Count:    count,
+		Packages: packages,
+		Snippets: snippets,
+	}, nil
+}
+
+// searchPackages ranks every package against keyword using the search_terms
+// table.
+func searchPackagesSQL(q sqlQuerier, keyword string, terms []string) ([]searchHit, error) {
+	names, err := queryStringsSQL(q, `SELECT name FROM packages ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	postings := make(map[string][]searchPosting)
+	for _, term := range terms {
+		rows, err := q.Query(`SELECT package, weight FROM search_terms WHERE term = ?`, term)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var p searchPosting
+			if err := rows.Scan(&p.Package, &p.Weight); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			postings[term] = append(postings[term], p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return rankSearch(keyword, terms, postings, names), nil
+}
+
+func querySearchDocumentSQL(q sqlQuerier, name string) (doc searchDocument, err error) {
+	var b []byte
+	if err = q.QueryRow(`SELECT document FROM search_docs WHERE package = ?`, name).Scan(&b); err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &doc)
+	return
+}
+
+// indexSearchDocumentSQL updates the search tables when the latest version of
+// pkg has changed since it was last indexed.
+func indexSearchDocumentSQL(tx *sql.Tx, pkg UnpubPackage) error {
+	var version string
+	err := tx.QueryRow(`SELECT version FROM search_docs WHERE package = ?`, pkg.Name).Scan(&version)
+	switch {
+	case err == nil:
+		if version == pkg.Latest {
+			return nil
+		}
+	case !errors.Is(err, sql.ErrNoRows):
+		return err
+	}
+
+	latest := pkg.LatestVersion()
+	if latest.Readme == nil {
+		var readme sql.NullString
+		err := tx.QueryRow(
+			`SELECT readme FROM versions WHERE package = ? AND version = ?`,
+			pkg.Name, latest.Version,
+		).Scan(&readme)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		latest.Readme = fromNullString(readme)
+	}
+	doc := newSearchDocument(pkg.Name, latest)
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO search_docs (package, version, document) VALUES (?, ?, ?)
+		ON CONFLICT (package) DO UPDATE SET version = excluded.version, document = excluded.document`,
+		pkg.Name, doc.Version, b,
+	)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM search_terms WHERE package = ?`, pkg.Name); err != nil {
+		return err
+	}
+	for term, weight := range doc.Terms {
+		_, err := tx.Exec(`INSERT INTO search_terms (term, package, weight) VALUES (?, ?, ?)`, term, pkg.Name, weight)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryStringsSQL returns the single string column selected by query.
+func queryStringsSQL(q sqlQuerier, query string, args ...interface{}) ([]string, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+func (db *UnpubSQLDb) SavePackage(pkg UnpubPackage) error {
+	return db.withTx(func(tx *sql.Tx) error {
+		return savePackageSQL(tx, pkg)
+	})
+}
+
+func savePackageSQL(tx *sql.Tx, pkg UnpubPackage) error {
+	var trustPolicies *string
+	if len(pkg.TrustPolicies) > 0 {
+		b, err := json.Marshal(pkg.TrustPolicies)
+		if err != nil {
+			return err
+		}
+		trustPolicies = nonEmpty(string(b))
+	}
+	_, err := tx.Exec(
+		`INSERT INTO packages (
+			name, latest, private, downloads, created_at, updated_at, discontinued, replaced_by, unlisted,
+			trust_policies
+		)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET
+			latest = excluded.latest,
+			private = excluded.private,
+			downloads = excluded.downloads,
+			created_at = excluded.created_at,
+			updated_at = excluded.updated_at,
+			discontinued = excluded.discontinued,
+			replaced_by = excluded.replaced_by,
+			unlisted = excluded.unlisted,
+			trust_policies = excluded.trust_policies`,
+		pkg.Name, pkg.Latest, pkg.Private, pkg.Downloads, toMillis(pkg.CreatedAt), toMillis(pkg.UpdatedAt),
+		pkg.IsDiscontinued, toNullString(nonEmpty(pkg.ReplacedBy)), pkg.IsUnlisted, toNullString(trustPolicies),
+	)
+	if err != nil {
+		return err
+	}
+
+	// Versions are upserted so that unchanged rows are not rewritten. A NULL
+	// README or changelog means it was not loaded, and keeps the stored one.
+	versions := []string{}
+	for _, v := range pkg.Versions {
+		versions = append(versions, v.Version)
+		_, err := tx.Exec(
+			`INSERT INTO versions (
+				package, version, pubspec_yaml, uploader, readme, changelog, archive_sha256, expires_at,
+				retracted, created_at, updated_at
+			)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (package, version) DO UPDATE SET
+				pubspec_yaml = excluded.pubspec_yaml,
+				uploader = excluded.uploader,
+				readme = coalesce(excluded.readme, readme),
+				changelog = coalesce(excluded.changelog, changelog),
+				archive_sha256 = excluded.archive_sha256,
+				expires_at = excluded.expires_at,
+				retracted = excluded.retracted,
+				created_at = excluded.created_at,
+				updated_at = excluded.updated_at
+			WHERE pubspec_yaml IS NOT excluded.pubspec_yaml
+				OR uploader IS NOT excluded.uploader
+				OR excluded.readme IS NOT NULL
+				OR excluded.changelog IS NOT NULL
+				OR archive_sha256 IS NOT excluded.archive_sha256
+				OR expires_at IS NOT excluded.expires_at
+				OR retracted IS NOT excluded.retracted
+				OR created_at IS NOT excluded.created_at
+				OR updated_at IS NOT excluded.updated_at`,
+			pkg.Name, v.Version, v.PubspecYAML, toNullString(v.Uploader), toNullString(v.Readme),
+			toNullString(v.Changelog), toNullString(nonEmpty(v.ArchiveSHA256)), toNullMillis(v.ExpiresAt),
+			v.Retracted, toMillis(v.CreatedAt), toMillis(v.UpdatedAt),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	versionsJSON, err := json.Marshal(versions)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`DELETE FROM versions WHERE package = ? AND version NOT IN (SELECT value FROM json_each(?))`,
+		pkg.Name, string(versionsJSON),
+	)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM uploaders WHERE package = ?`, pkg.Name); err != nil {
+		return err
+	}
+	for _, email := range pkg.Uploaders {
+		_, err := tx.Exec(`INSERT OR IGNORE INTO uploaders (package, email) VALUES (?, ?)`, pkg.Name, email)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM readers WHERE package = ?`, pkg.Name); err != nil {
+		return err
+	}
+	for _, email := range pkg.Readers {
+		_, err := tx.Exec(`INSERT OR IGNORE INTO readers (package, email) VALUES (?, ?)`, pkg.Name, email)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM dependencies WHERE package = ?`, pkg.Name); err != nil {
+		return err
+	}
+	for _, dep := range pkg.DependencyNames() {
+		_, err := tx.Exec(`INSERT INTO dependencies (package, dependency) VALUES (?, ?)`, pkg.Name, dep)
+		if err != nil {
+			return err
+		}
+	}
+	return indexSearchDocumentSQL(tx, pkg)
+}
+
+func (db *UnpubSQLDb) AddUploader(name, email string) error {
+	return db.withTx(func(tx *sql.Tx) error {
+		if err := requirePackageSQL(tx, name); err != nil {
+			return err
+		}
+		res, err := tx.Exec(`INSERT OR IGNORE INTO uploaders (package, email) VALUES (?, ?)`, name, email)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return errors.New("uploader already exists")
+		}
+		return nil
+	})
+}
+
+func (db *UnpubSQLDb) RemoveUploader(name, email string) error {
+	return db.withTx(func(tx *sql.Tx) error {
+		if err := requirePackageSQL(tx, name); err != nil {
+			return err
+		}
+		res, err := tx.Exec(`DELETE FROM uploaders WHERE package = ? AND email = ?`, name, email)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return errors.New("uploader does not exist")
+		}
+		return nil
+	})
+}
+
+func (db *UnpubSQLDb) IncreaseDownloads(name, version string) error {
+	return db.withTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(`UPDATE packages SET downloads = downloads + 1 WHERE name = ?`, name)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrNotFound
+		}
+		_, err = tx.Exec(
+			`INSERT INTO downloads (package, version, day, count) VALUES (?, ?, ?, 1)
+			ON CONFLICT (package, day, version) DO UPDATE SET count = count + 1`,
+			name, version, DownloadDay(time.Now()),
+		)
+		return err
+	})
+}
+
+func (db *UnpubSQLDb) QueryDownloads(name string, since time.Time) (*DownloadStats, error) {
+	stats := &DownloadStats{
+		Versions: make(map[string]int),
+	}
+	rows, err := db.db.Query(`SELECT version, sum(count) FROM downloads WHERE package = ? GROUP BY version`, name)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var version string
+		var count int
+		if err := rows.Scan(&version, &count); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stats.Versions[version] = count
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.db.Query(
+		`SELECT day, version, count FROM downloads WHERE package = ? AND day >= ? ORDER BY day, version`,
+		name, DownloadDay(since),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d DailyDownloads
+		if err := rows.Scan(&d.Day, &d.Version, &d.Count); err != nil {
+			return nil, err
+		}
+		stats.Daily = append(stats.Daily, d)
+	}
+	return stats, rows.Err()
+}
+
+// UpdatePackage needs no retries, since SQLite serializes write transactions
+// and all access shares a single connection.
+func (db *UnpubSQLDb) UpdatePackage(name string, fn PackageUpdate) error {
+	return db.withTx(func(tx *sql.Tx) error {
+		return updatePackageSQL(tx, name, fn)
+	})
+}
+
+func updatePackageSQL(tx *sql.Tx, name string, fn PackageUpdate) error {
+	pkg, err := queryPackageSQL(tx, name)
+	exists := err == nil
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if !exists {
+		pkg = UnpubPackage{}
+	}
+	if err := fn(&pkg, exists); err != nil {
+		return err
+	}
+	if exists && len(pkg.Versions) == 0 {
+		_, err := deletePackageSQL(tx, name)
+		return err
+	}
+	return savePackageSQL(tx, pkg)
+}
+
+// deletePackageSQL deletes the named package, relying on foreign keys to
+// delete everything referring to it. The advisories table has no foreign key,
+// so advisories are deleted explicitly. It reports whether the package
+// existed.
+func deletePackageSQL(tx *sql.Tx, name string) (bool, error) {
+	if _, err := tx.Exec(`DELETE FROM advisories WHERE package = ?`, name); err != nil {
+		return false, err
+	}
+	result, err := tx.Exec(`DELETE FROM packages WHERE name = ?`, name)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// withTx runs fn in a transaction, committing if it succeeds and rolling back
+// otherwise.
+func (db *UnpubSQLDb) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("%v (rollback failed: %v)", err, rbErr)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+func requirePackageSQL(q sqlQuerier, name string) error {
+	var exists bool
+	err := q.QueryRow(`SELECT EXISTS (SELECT 1 FROM packages WHERE name = ?)`, name).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func toNullString(s *string) sql.NullString {
+	if s == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: *s, Valid: true}
+}
+
+// nonEmpty returns nil for an empty string, so that it is stored as NULL.
+func nonEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func fromNullString(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
+
+func (db *UnpubSQLDb) DeletePackage(name string) error {
+	return db.withTx(func(tx *sql.Tx) error {
+		existed, err := deletePackageSQL(tx, name)
+		if err == nil && !existed {
+			err = ErrNotFound
+		}
+		return err
+	})
+}
+
+func (db *UnpubSQLDb) QueryExpiredPackages(now time.Time) ([]string, error) {
+	return queryStringsSQL(db.db,
+		`SELECT DISTINCT package FROM versions WHERE expires_at <= ? ORDER BY package`,
+		toMillis(now),
+	)
+}
+
+func (db *UnpubSQLDb) RecordAudit(event AuditEvent) error {
+	event, err := prepareAuditEvent(event)
+	if err != nil {
+		return err
+	}
+	_, err = db.db.Exec(
+		`INSERT INTO audit_events (
+			id, time, action, actor, client_ip, package, version, before_summary, after_summary
+		)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		event.ID, toMillis(event.Time), event.Action, event.Actor, event.ClientIP,
+		event.Package, event.Version, event.Before, event.After,
+	)
+	return err
+}
+
+func (db *UnpubSQLDb) QueryAudit(query AuditQuery) (*AuditResult, error) {
+	var conds []string
+	var args []interface{}
+	for _, filter := range []struct {
+		column, value string
+	}{
+		{"package", query.Package},
+		{"version", query.Version},
+		{"action", query.Action},
+		{"actor", query.Actor},
+	} {
+		if filter.value != "" {
+			conds = append(conds, filter.column+" = ?")
+			args = append(args, filter.value)
+		}
+	}
+	if !query.Since.IsZero() {
+		conds = append(conds, "time >= ?")
+		args = append(args, toMillis(query.Since))
+	}
+	if !query.Until.IsZero() {
+		conds = append(conds, "time < ?")
+		args = append(args, toMillis(query.Until))
+	}
+	if query.Cursor != "" {
+		conds = append(conds, "id < ?")
+		args = append(args, query.Cursor)
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = "WHERE " + strings.Join(conds, " AND ")
+	}
+	limit := query.limit()
+	// One more row than needed tells whether there is another page.
+	args = append(args, limit+1)
+
+	rows, err := db.db.Query(
+		`SELECT id, time, action, actor, client_ip, package, version, before_summary, after_summary
+		FROM audit_events `+where+` ORDER BY id DESC LIMIT ?`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := &AuditResult{Events: []AuditEvent{}}
+	for rows.Next() {
+		var event AuditEvent
+		var t int64
+		err := rows.Scan(
+			&event.ID, &t, &event.Action, &event.Actor, &event.ClientIP,
+			&event.Package, &event.Version, &event.Before, &event.After,
+		)
+		if err != nil {
+			return nil, err
+		}
+		event.Time = fromMillis(t)
+		result.Events = append(result.Events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(result.Events) > limit {
+		result.Events = result.Events[:limit]
+		result.NextCursor = result.Events[limit-1].ID
+	}
+	return result, nil
+}
+
+func (db *UnpubSQLDb) QueryPackageNames() ([]string, error) {
+	return queryStringsSQL(db.db,
+		`SELECT name FROM packages WHERE NOT unlisted AND NOT private ORDER BY name`,
+	)
+}
+
+func (db *UnpubSQLDb) SaveAdvisory(advisory Advisory) error {
+	b, err := json.Marshal(advisory)
+	if err != nil {
+		return err
+	}
+	_, err = db.db.Exec(
+		`INSERT INTO advisories (package, id, advisory) VALUES (?, ?, ?)
+		ON CONFLICT (package, id) DO UPDATE SET advisory = excluded.advisory`,
+		advisory.Package, advisory.ID, string(b),
+	)
+	return err
+}
+
+func (db *UnpubSQLDb) QueryAdvisories(name string) ([]Advisory, error) {
+	docs, err := queryStringsSQL(db.db,
+		`SELECT advisory FROM advisories WHERE package = ? ORDER BY id`,
+		name,
+	)
+	if err != nil {
+		return nil, err
+	}
+	advisories := []Advisory{}
+	for _, doc := range docs {
+		var advisory Advisory
+		if err := json.Unmarshal([]byte(doc), &advisory); err != nil {
+			return nil, err
+		}
+		advisories = append(advisories, advisory)
+	}
+	return advisories, nil
+}
+
+func (db *UnpubSQLDb) SaveToken(token Token) error {
+	_, err := db.db.Exec(
+		`INSERT INTO tokens (id, hash, identity, scopes, description, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			hash = excluded.hash,
+			identity = excluded.identity,
+			scopes = excluded.scopes,
+			description = excluded.description,
+			created_at = excluded.created_at,
+			expires_at = excluded.expires_at`,
+		token.ID, token.Hash, token.Identity, strings.Join(token.Scopes, ","), token.Description,
+		toMillis(token.CreatedAt), toNullMillis(token.ExpiresAt),
+	)
+	return err
+}
+
+const tokenColumns = `id, hash, identity, scopes, description, created_at, expires_at`
+
+func scanTokenSQL(row interface{ Scan(...interface{}) error }) (token Token, err error) {
+	var scopes string
+	var createdAt int64
+	var expiresAt sql.NullInt64
+	err = row.Scan(&token.ID, &token.Hash, &token.Identity, &scopes, &token.Description, &createdAt, &expiresAt)
+	if err != nil {
+		return
+	}
+	token.Scopes = strings.Split(scopes, ",")
+	token.CreatedAt = fromMillis(createdAt)
+	token.ExpiresAt = fromNullMillis(expiresAt)
+	return
+}
+
+func (db *UnpubSQLDb) QueryToken(id string) (Token, error) {
+	token, err := scanTokenSQL(db.db.QueryRow(`SELECT `+tokenColumns+` FROM tokens WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		err = ErrNotFound
+	}
+	return token, err
+}
+
+func (db *UnpubSQLDb) QueryTokens() ([]Token, error) {
+	rows, err := db.db.Query(`SELECT ` + tokenColumns + ` FROM tokens ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []Token{}
+	for rows.Next() {
+		token, err := scanTokenSQL(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (db *UnpubSQLDb) DeleteToken(id string) error {
+	res, err := db.db.Exec(`DELETE FROM tokens WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Interface guard
+var _ = (UnpubDb)(&UnpubSQLDb{})
@@ -0,0 +1,107 @@
+package unpub
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+// Scopes of an access token. Each includes the ones before it, so a publish
+// token can also read, and an admin token can do anything.
+const (
+	ScopeRead    = "read"
+	ScopePublish = "publish"
+	ScopeAdmin   = "admin"
+)
+
+var scopeLevels = map[string]int{
+	ScopeRead:    1,
+	ScopePublish: 2,
+	ScopeAdmin:   3,
+}
+
+// tokenSecretPrefix starts every secret, so leaked tokens are easy to spot.
+const tokenSecretPrefix = "unpub_"
+
+// Token is an access token which acts as Identity within its scopes. Only a
+// hash of the secret is stored, which also gives the token its ID.
+type Token struct {
+	ID          string     `json:"id"`
+	Hash        string     `json:"hash,omitempty"`
+	Identity    string     `json:"identity"`
+	Scopes      []string   `json:"scopes"`
+	Description string     `json:"description,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+}
+
+// NewToken creates a token for identity and returns it along with its secret,
+// which is not stored anywhere and must be handed to the client. A ttl of zero
+// never expires.
+func NewToken(identity string, scopes []string, ttl time.Duration, now time.Time) (Token, string, error) {
+	if identity == "" {
+		return Token{}, "", NewError(ErrInvalidInput, "token identity is required")
+	}
+	if len(scopes) == 0 {
+		return Token{}, "", NewError(ErrInvalidInput, "token needs at least one scope")
+	}
+	for _, scope := range scopes {
+		if scopeLevels[scope] == 0 {
+			return Token{}, "", NewError(ErrInvalidInput, "unknown scope %q, expected read, publish or admin", scope)
+		}
+	}
+	if ttl < 0 {
+		return Token{}, "", NewError(ErrInvalidInput, "token ttl must not be negative")
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return Token{}, "", err
+	}
+	secret := tokenSecretPrefix + base64.RawURLEncoding.EncodeToString(b)
+	hash := hashToken(secret)
+	token := Token{
+		ID:        hash[:16],
+		Hash:      hash,
+		Identity:  identity,
+		Scopes:    scopes,
+		CreatedAt: now.Truncate(time.Millisecond),
+	}
+	if ttl > 0 {
+		expiresAt := token.CreatedAt.Add(ttl)
+		token.ExpiresAt = &expiresAt
+	}
+	return token, secret, nil
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokenID returns the ID of the token with the given secret.
+func TokenID(secret string) string {
+	return hashToken(secret)[:16]
+}
+
+// Matches reports whether secret is the secret of the token.
+func (t Token) Matches(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(t.Hash)) == 1
+}
+
+// HasScope reports whether the token grants scope.
+func (t Token) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if scopeLevels[s] >= scopeLevels[scope] {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports whether the token has expired at now.
+func (t Token) Expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
@@ -0,0 +1,61 @@
+package unpub
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewToken(t *testing.T) {
+	require := require.New(t)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	token, secret, err := NewToken(uploader, []string{ScopePublish}, time.Hour, now)
+	require.NoError(err)
+	require.True(strings.HasPrefix(secret, tokenSecretPrefix))
+	require.Equal(TokenID(secret), token.ID)
+	require.True(token.Matches(secret))
+	require.False(token.Matches(secret + "x"))
+	require.Equal(now.Add(time.Hour), *token.ExpiresAt)
+
+	other, otherSecret, err := NewToken(uploader, []string{ScopePublish}, 0, now)
+	require.NoError(err)
+	require.NotEqual(secret, otherSecret)
+	require.Nil(other.ExpiresAt)
+
+	for name, scopes := range map[string][]string{
+		"no scopes": nil,
+		"unknown":   {"write"},
+	} {
+		_, _, err := NewToken(uploader, scopes, 0, now)
+		require.ErrorIs(err, ErrInvalidInput, name)
+	}
+	_, _, err = NewToken("", []string{ScopeRead}, 0, now)
+	require.ErrorIs(err, ErrInvalidInput)
+	_, _, err = NewToken(uploader, []string{ScopeRead}, -time.Hour, now)
+	require.ErrorIs(err, ErrInvalidInput)
+}
+
+func TestTokenHasScope(t *testing.T) {
+	require := require.New(t)
+	read := Token{Scopes: []string{ScopeRead}}
+	require.True(read.HasScope(ScopeRead))
+	require.False(read.HasScope(ScopePublish))
+	require.False(read.HasScope(ScopeAdmin))
+
+	admin := Token{Scopes: []string{ScopeAdmin}}
+	require.True(admin.HasScope(ScopeRead))
+	require.True(admin.HasScope(ScopePublish))
+	require.True(admin.HasScope(ScopeAdmin))
+}
+
+func TestTokenExpired(t *testing.T) {
+	require := require.New(t)
+	now := time.Now()
+	require.False(Token{}.Expired(now))
+	expiresAt := now.Add(time.Minute)
+	token := Token{ExpiresAt: &expiresAt}
+	require.False(token.Expired(now))
+	require.True(token.Expired(expiresAt))
+}
@@ -38,8 +38,10 @@ class ListApiPackage {
 class DetailViewVersion {
   final String version;
   final DateTime createdAt;
+  @JsonKey(defaultValue: false)
+  final bool retracted;
 
-  const DetailViewVersion(this.version, this.createdAt);
+  const DetailViewVersion(this.version, this.createdAt, this.retracted);
 
   factory DetailViewVersion.fromJson(Map<String, dynamic> map) =>
       _$DetailViewVersionFromJson(map);
@@ -47,6 +49,29 @@ class DetailViewVersion {
   Map<String, dynamic> toJson() => _$DetailViewVersionToJson(this);
 }
 
+@JsonSerializable()
+class DetailViewAdvisory {
+  final String id;
+  final String summary;
+  final String severity;
+  @JsonKey(defaultValue: [])
+  final List<String> aliases;
+  final bool affected;
+
+  const DetailViewAdvisory(
+    this.id,
+    this.summary,
+    this.severity,
+    this.aliases,
+    this.affected,
+  );
+
+  factory DetailViewAdvisory.fromJson(Map<String, dynamic> map) =>
+      _$DetailViewAdvisoryFromJson(map);
+
+  Map<String, dynamic> toJson() => _$DetailViewAdvisoryToJson(this);
+}
+
 @JsonSerializable()
 class WebapiDetailView {
   final String name;
@@ -61,6 +86,10 @@ class WebapiDetailView {
   final List<String> authors;
   final List<String>? dependencies;
   final List<String> tags;
+  @JsonKey(defaultValue: false)
+  final bool retracted;
+  @JsonKey(defaultValue: [])
+  final List<DetailViewAdvisory> advisories;
 
   const WebapiDetailView(
     this.name,
@@ -75,6 +104,8 @@ class WebapiDetailView {
     this.authors,
     this.dependencies,
     this.tags,
+    this.retracted,
+    this.advisories,
   );
 
   factory WebapiDetailView.fromJson(Map<String, dynamic> map) =>
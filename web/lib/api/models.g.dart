@@ -40,12 +40,34 @@ DetailViewVersion _$DetailViewVersionFromJson(Map<String, dynamic> json) =>
     DetailViewVersion(
       json['version'] as String,
       DateTime.parse(json['createdAt'] as String),
+      json['retracted'] as bool? ?? false,
     );
 
 Map<String, dynamic> _$DetailViewVersionToJson(DetailViewVersion instance) =>
     <String, dynamic>{
       'version': instance.version,
       'createdAt': instance.createdAt.toIso8601String(),
+      'retracted': instance.retracted,
+      'advisories': instance.advisories,
+    };
+
+DetailViewAdvisory _$DetailViewAdvisoryFromJson(Map<String, dynamic> json) =>
+    DetailViewAdvisory(
+      json['id'] as String,
+      json['summary'] as String,
+      json['severity'] as String,
+      (json['aliases'] as List<dynamic>?)?.map((e) => e as String).toList() ??
+          [],
+      json['affected'] as bool,
+    );
+
+Map<String, dynamic> _$DetailViewAdvisoryToJson(DetailViewAdvisory instance) =>
+    <String, dynamic>{
+      'id': instance.id,
+      'summary': instance.summary,
+      'severity': instance.severity,
+      'aliases': instance.aliases,
+      'affected': instance.affected,
     };
 
 WebapiDetailView _$WebapiDetailViewFromJson(Map<String, dynamic> json) =>
@@ -66,6 +88,12 @@ WebapiDetailView _$WebapiDetailViewFromJson(Map<String, dynamic> json) =>
           ?.map((e) => e as String)
           .toList(),
       (json['tags'] as List<dynamic>).map((e) => e as String).toList(),
+      json['retracted'] as bool? ?? false,
+      (json['advisories'] as List<dynamic>?)
+              ?.map(
+                  (e) => DetailViewAdvisory.fromJson(e as Map<String, dynamic>))
+              .toList() ??
+          [],
     );
 
 Map<String, dynamic> _$WebapiDetailViewToJson(WebapiDetailView instance) =>
@@ -82,4 +110,6 @@ Map<String, dynamic> _$WebapiDetailViewToJson(WebapiDetailView instance) =>
       'authors': instance.authors,
       'dependencies': instance.dependencies,
       'tags': instance.tags,
+      'retracted': instance.retracted,
+      'advisories': instance.advisories,
     };
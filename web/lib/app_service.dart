@@ -35,8 +35,8 @@ class AppService {
     var data = json.decode(res.body);
 
     if (data['error'] != null) {
-      var error = data['error'] as String;
-      if (error.contains('package not exists')) {
+      var error = data['error']['message'] as String;
+      if (data['error']['code'] == 'NotFound') {
         throw PackageNotExistsException(error);
       }
       throw error;